@@ -4,9 +4,18 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/imansprn/gostly/pkg/api"
 	"github.com/imansprn/gostly/pkg/database"
+	"github.com/wailsapp/wails/v2/pkg/runtime"
+)
+
+// Event forwarding to the frontend
+const (
+	eventBuffer      = 1024
+	eventBatchSize   = 200
+	eventBatchWindow = 100 * time.Millisecond
 )
 
 var (
@@ -20,6 +29,7 @@ type App struct {
 	ctx      context.Context
 	api      *api.API
 	apiMutex sync.Mutex
+	events   *api.Subscription
 }
 
 // NewApp creates a new App application struct
@@ -61,11 +71,49 @@ func (a *App) startup(ctx context.Context) {
 	if err := a.ensureAPI(); err != nil {
 		fmt.Printf("Error initializing API on startup: %v\n", err)
 		a.api = nil
+		return
+	}
+
+	a.events = a.api.Subscribe(eventBuffer)
+	go a.forwardEvents(ctx, a.events)
+}
+
+// forwardEvents pushes the API's events to the frontend in batches: one
+// "gostly:<topic>" event per topic, carrying that topic's payloads in order.
+// If the frontend fell behind and events were dropped, "gostly:resync" tells
+// it to refetch instead.
+func (a *App) forwardEvents(ctx context.Context, sub *api.Subscription) {
+	var dropped int64
+	for {
+		batch, ok := sub.NextBatch(eventBatchSize, eventBatchWindow)
+		if !ok {
+			return
+		}
+
+		var topics []string
+		byTopic := make(map[string][]interface{})
+		for _, e := range batch {
+			if _, seen := byTopic[e.Topic]; !seen {
+				topics = append(topics, e.Topic)
+			}
+			byTopic[e.Topic] = append(byTopic[e.Topic], e.Data)
+		}
+		for _, topic := range topics {
+			runtime.EventsEmit(ctx, "gostly:"+topic, byTopic[topic])
+		}
+
+		if d := sub.Dropped(); d != dropped {
+			dropped = d
+			runtime.EventsEmit(ctx, "gostly:resync", d)
+		}
 	}
 }
 
 // shutdown is called when the app is closing
 func (a *App) shutdown(ctx context.Context) {
+	if a.events != nil {
+		a.events.Unsubscribe()
+	}
 	// Close API
 	if a.api != nil {
 		a.api.Close()
@@ -104,6 +152,22 @@ func (a *App) AddProfile(profile database.Profile) (int64, error) {
 	return a.api.AddProfile(profile)
 }
 
+// ValidateProfile checks a profile without saving it and returns field-level errors
+func (a *App) ValidateProfile(profile database.Profile) ([]api.FieldError, error) {
+	if a.api == nil {
+		return nil, fmt.Errorf("API not initialized - database connection failed")
+	}
+	return a.api.ValidateProfile(profile)
+}
+
+// GetProtocols returns the GOST handler and listener types profiles can use
+func (a *App) GetProtocols() ([]api.ProtocolSpec, error) {
+	if a.api == nil {
+		return nil, fmt.Errorf("API not initialized - database connection failed")
+	}
+	return a.api.GetProtocols(), nil
+}
+
 // UpdateProfile updates an existing profile
 func (a *App) UpdateProfile(profile database.Profile) error {
 	if a.api == nil {
@@ -136,6 +200,54 @@ func (a *App) StopProfile(id int64) error {
 	return a.api.StopProfile(id)
 }
 
+// SetStopTimeout sets how many seconds a profile gets to shut down before it is killed
+func (a *App) SetStopTimeout(seconds int) error {
+	if a.api == nil {
+		return fmt.Errorf("API not initialized - database connection failed")
+	}
+	return a.api.SetStopTimeout(seconds)
+}
+
+// GetStopTimeout returns the profile shutdown timeout in seconds
+func (a *App) GetStopTimeout() (int, error) {
+	if a.api == nil {
+		return 0, fmt.Errorf("API not initialized - database connection failed")
+	}
+	return a.api.GetStopTimeout(), nil
+}
+
+// SetProfileAutostart sets whether a profile is restored when the app starts
+func (a *App) SetProfileAutostart(id int64, autostart bool) error {
+	if a.api == nil {
+		return fmt.Errorf("API not initialized - database connection failed")
+	}
+	return a.api.SetProfileAutostart(id, autostart)
+}
+
+// GetProfileStats returns a profile's traffic counters
+func (a *App) GetProfileStats(id int64) (api.ProfileStats, error) {
+	if a.api == nil {
+		return api.ProfileStats{}, fmt.Errorf("API not initialized - database connection failed")
+	}
+	return a.api.GetProfileStats(id), nil
+}
+
+// GetAllProfileStats returns the traffic counters of every profile
+func (a *App) GetAllProfileStats() ([]api.ProfileStats, error) {
+	if a.api == nil {
+		return nil, fmt.Errorf("API not initialized - database connection failed")
+	}
+	return a.api.GetAllProfileStats(), nil
+}
+
+// GetProfileStatsHistory returns a profile's recent throughput samples for charting
+func (a *App) GetProfileStatsHistory(id int64) ([]api.StatsSample, error) {
+	if a.api == nil {
+		return nil, fmt.Errorf("API not initialized - database connection failed")
+	}
+	return a.api.GetProfileStatsHistory(id), nil
+}
+
 // GetActivityLogs returns all activity logs
 func (a *App) GetActivityLogs() ([]database.ActivityLog, error) {
 	if a.api == nil {
@@ -184,13 +296,53 @@ func (a *App) GetLogsBySource(source string) ([]api.LogEntry, error) {
 	return a.api.GetLogsBySource(source)
 }
 
-// SetGostLogLevel sets the GOST logging level
+// QueryLogs searches the persisted logs, newest first, a page at a time
+func (a *App) QueryLogs(query api.LogQuery) (*api.LogPage, error) {
+	if a.api == nil {
+		return nil, fmt.Errorf("API not initialized - database connection failed")
+	}
+	return a.api.QueryLogs(query)
+}
+
+// GetLogsSince returns the log entries after a cursor, for incremental tailing
+func (a *App) GetLogsSince(cursor string, limit int) (*api.LogTail, error) {
+	if a.api == nil {
+		return nil, fmt.Errorf("API not initialized - database connection failed")
+	}
+	return a.api.GetLogsSince(cursor, limit)
+}
+
+// SetLogRetention sets how much log history is kept
+func (a *App) SetLogRetention(retention api.LogRetention) error {
+	if a.api == nil {
+		return fmt.Errorf("API not initialized - database connection failed")
+	}
+	return a.api.SetLogRetention(retention)
+}
+
+// GetLogRetention returns how much log history is kept
+func (a *App) GetLogRetention() (api.LogRetention, error) {
+	if a.api == nil {
+		return api.LogRetention{}, fmt.Errorf("API not initialized - database connection failed")
+	}
+	return a.api.GetLogRetention(), nil
+}
+
+// SetGostLogLevel sets the default GOST logging level
 func (a *App) SetGostLogLevel(level string) error {
 	if a.api == nil {
 		return fmt.Errorf("API not initialized - database connection failed")
 	}
-	a.api.SetGostLogLevel(level)
-	return nil
+	return a.api.SetGostLogLevel(level)
+}
+
+// SetProfileGostLogLevel overrides the GOST log level of one profile; an
+// empty level goes back to the default
+func (a *App) SetProfileGostLogLevel(id int64, level string) error {
+	if a.api == nil {
+		return fmt.Errorf("API not initialized - database connection failed")
+	}
+	return a.api.SetProfileGostLogLevel(id, level)
 }
 
 // GetGostLogLevel returns the current GOST logging level
@@ -201,7 +353,7 @@ func (a *App) GetGostLogLevel() (string, error) {
 	return a.api.GetGostLogLevel(), nil
 }
 
-// ClearLogs clears all logs
+// ClearLogs clears the logs shown in the app, keeping the persisted history
 func (a *App) ClearLogs() error {
 	if a.api == nil {
 		return fmt.Errorf("API not initialized - database connection failed")
@@ -209,6 +361,14 @@ func (a *App) ClearLogs() error {
 	return a.api.ClearLogs()
 }
 
+// PurgeLogHistory deletes the workspace's persisted log history
+func (a *App) PurgeLogHistory() error {
+	if a.api == nil {
+		return fmt.Errorf("API not initialized - database connection failed")
+	}
+	return a.api.PurgeLogHistory()
+}
+
 // GetGostDebugInfo returns debug information about GOST detection
 func (a *App) GetGostDebugInfo() map[string]interface{} {
 	if a.api == nil {
@@ -235,6 +395,118 @@ func (a *App) GetGostVersion() string {
 	return a.api.GetGostVersion()
 }
 
+// GetChains returns all proxy chains
+func (a *App) GetChains() ([]database.Chain, error) {
+	if a.api == nil {
+		return nil, fmt.Errorf("API not initialized - database connection failed")
+	}
+	return a.api.GetChains()
+}
+
+// GetChain returns a proxy chain by ID
+func (a *App) GetChain(id int64) (*database.Chain, error) {
+	if a.api == nil {
+		return nil, fmt.Errorf("API not initialized - database connection failed")
+	}
+	return a.api.GetChain(id)
+}
+
+// AddChain adds a new proxy chain
+func (a *App) AddChain(chain database.Chain) (int64, error) {
+	if a.api == nil {
+		return 0, fmt.Errorf("API not initialized - database connection failed")
+	}
+	return a.api.AddChain(chain)
+}
+
+// UpdateChain updates an existing proxy chain
+func (a *App) UpdateChain(chain database.Chain) error {
+	if a.api == nil {
+		return fmt.Errorf("API not initialized - database connection failed")
+	}
+	return a.api.UpdateChain(chain)
+}
+
+// DeleteChain deletes a proxy chain
+func (a *App) DeleteChain(id int64) error {
+	if a.api == nil {
+		return fmt.Errorf("API not initialized - database connection failed")
+	}
+	return a.api.DeleteChain(id)
+}
+
+// GenerateSelfSignedCert creates a self-signed certificate for local testing
+func (a *App) GenerateSelfSignedCert(name string, hosts []string) (*api.CertificateFiles, error) {
+	if a.api == nil {
+		return nil, fmt.Errorf("API not initialized - database connection failed")
+	}
+	return a.api.GenerateSelfSignedCert(name, hosts)
+}
+
+// RotateEncryptionKey re-encrypts stored credentials under a new key
+func (a *App) RotateEncryptionKey(newPassphrase string) error {
+	if a.api == nil {
+		return fmt.Errorf("API not initialized - database connection failed")
+	}
+	return a.api.RotateEncryptionKey(newPassphrase)
+}
+
+// ExportBundle exports profiles, chains and host mappings as a JSON or YAML bundle
+func (a *App) ExportBundle(opts api.ExportOptions) (string, error) {
+	if a.api == nil {
+		return "", fmt.Errorf("API not initialized - database connection failed")
+	}
+	return a.api.ExportBundle(opts)
+}
+
+// ImportBundle imports a bundle, or reports what it would change in a dry run
+func (a *App) ImportBundle(data string, opts api.ImportOptions) (*api.ImportReport, error) {
+	if a.api == nil {
+		return nil, fmt.Errorf("API not initialized - database connection failed")
+	}
+	return a.api.ImportBundle(data, opts)
+}
+
+// ImportGostConfig imports a native GOST v3 config or a v2 style command line
+func (a *App) ImportGostConfig(text string, opts api.ImportOptions) (*api.GostImportReport, error) {
+	if a.api == nil {
+		return nil, fmt.Errorf("API not initialized - database connection failed")
+	}
+	return a.api.ImportGostConfig(text, opts)
+}
+
+// ExportDeployment renders profiles as a standalone GOST config with an optional service unit
+func (a *App) ExportDeployment(ids []int64, opts api.DeployOptions) (*api.Deployment, error) {
+	if a.api == nil {
+		return nil, fmt.Errorf("API not initialized - database connection failed")
+	}
+	return a.api.ExportDeployment(ids, opts)
+}
+
+// GetDatabaseInfo returns where the open workspace's database is stored
+func (a *App) GetDatabaseInfo() (*api.DatabaseInfo, error) {
+	if a.api == nil {
+		return nil, fmt.Errorf("API not initialized - database connection failed")
+	}
+	return a.api.GetDatabaseInfo()
+}
+
+// ListWorkspaces returns the available workspaces
+func (a *App) ListWorkspaces() ([]string, error) {
+	if a.api == nil {
+		return nil, fmt.Errorf("API not initialized - database connection failed")
+	}
+	return a.api.ListWorkspaces()
+}
+
+// SwitchWorkspace stops the current workspace's profiles and opens another one
+func (a *App) SwitchWorkspace(name string) error {
+	if a.api == nil {
+		return fmt.Errorf("API not initialized - database connection failed")
+	}
+	return a.api.SwitchWorkspace(name)
+}
+
 // Host Router controls
 func (a *App) StartHostRouter(addr string) error {
 	if a.api == nil {
@@ -287,6 +559,30 @@ func (a *App) IsHostRouterRunning() (bool, string) {
 	return a.api.IsHostRouterRunning()
 }
 
+// StartMetricsServer serves Gostly's Prometheus metrics on addr
+func (a *App) StartMetricsServer(addr string) error {
+	if a.api == nil {
+		return fmt.Errorf("API not initialized - database connection failed")
+	}
+	return a.api.StartMetricsServer(addr)
+}
+
+// StopMetricsServer stops the Prometheus metrics endpoint
+func (a *App) StopMetricsServer() error {
+	if a.api == nil {
+		return fmt.Errorf("API not initialized - database connection failed")
+	}
+	return a.api.StopMetricsServer()
+}
+
+// IsMetricsServerRunning returns whether the metrics endpoint is running and its addr
+func (a *App) IsMetricsServerRunning() (bool, string) {
+	if a.api == nil {
+		return false, ""
+	}
+	return a.api.IsMetricsServerRunning()
+}
+
 // GetTimelineEvents returns all timeline events
 func (a *App) GetTimelineEvents() ([]api.TimelineEvent, error) {
 	if err := a.ensureAPI(); err != nil {
@@ -295,6 +591,14 @@ func (a *App) GetTimelineEvents() ([]api.TimelineEvent, error) {
 	return a.api.GetTimelineEvents(), nil
 }
 
+// GetTimelineEventsSince returns the timeline events after a cursor
+func (a *App) GetTimelineEventsSince(cursor string, limit int) (*api.TimelineTail, error) {
+	if err := a.ensureAPI(); err != nil {
+		return nil, fmt.Errorf("API not initialized - %v", err)
+	}
+	return a.api.GetTimelineEventsSince(cursor, limit)
+}
+
 // TestConnection is a simple test method to verify Wails binding works
 func (a *App) TestConnection() string {
 	return "Wails backend is working!"
@@ -1,5 +1,5 @@
 import React, { useState, useEffect } from 'react';
-import { Profile, LogEntry, TimelineEvent } from '../types';
+import { Profile, LogEntry, TimelineEvent, ProfileStateEvent, HostRouterEvent } from '../types';
 import ProfileForm from '../components/ProfileForm';
 import ProfileTable from '../components/ProfileTable';
 import Sidebar from '../components/Sidebar';
@@ -425,30 +425,46 @@ const Dashboard: React.FC = () => {
           }
         } catch {}
       })();
-      const interval = setInterval(async () => {
-        try {
-          if (isWails && window.go?.main?.App?.IsHostRouterRunning) {
-            const res = await window.go.main.App.IsHostRouterRunning();
-            let running: boolean = false;
-            let addr: string | undefined = undefined;
-            if (typeof res === 'boolean') {
-              running = res as boolean;
-            } else if (Array.isArray(res)) {
-              running = !!(res as any)[0];
-              addr = (res as any)[1];
-            } else if (res && typeof res === 'object') {
-              running = !!(res as any).running;
-              addr = (res as any).addr;
-            }
-            setHostRouterRunning(!!running);
-            if (addr) setHostRouterAddr(addr);
-          }
-        } catch {}
-      }, 5000);
-      return () => clearInterval(interval);
     }
   }, [activeTab]);
 
+  // Live updates pushed by the backend, batched per topic
+  useEffect(() => {
+    const eventsOn = window.runtime?.EventsOn;
+    if (!isWails || !eventsOn) return;
+
+    const unsubscribers = [
+      eventsOn('gostly:log', (entries: LogEntry[]) => {
+        setSystemLogs(prev => [...prev, ...entries].slice(-100));
+      }),
+      eventsOn('gostly:timeline', (events: TimelineEvent[]) => {
+        setActivityLogs(prev => [...prev, ...events].slice(-100));
+      }),
+      eventsOn('gostly:profile_state', (changes: ProfileStateEvent[]) => {
+        setProfiles(prev => {
+          const next = prev.map(p => {
+            const latest = changes.filter(c => c.profile_id === p.id).pop();
+            return latest ? { ...p, status: latest.state } : p;
+          });
+          updateConnectionStatus(next);
+          return next;
+        });
+      }),
+      eventsOn('gostly:host_router', (changes: HostRouterEvent[]) => {
+        const latest = changes[changes.length - 1];
+        setHostRouterRunning(latest.running);
+        if (latest.addr) setHostRouterAddr(latest.addr);
+      }),
+      // Events were dropped while the UI was busy; reload the full state
+      eventsOn('gostly:resync', () => {
+        fetchProfiles();
+        fetchLogs();
+        fetchActivityLogs();
+      }),
+    ];
+    return () => unsubscribers.forEach(off => off());
+  }, []);
+
   const startHostRouter = async () => {
     try {
       setRouterBusy(true);
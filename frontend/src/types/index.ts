@@ -23,6 +23,10 @@ export interface LogEntry {
   message: string;
   profile_id?: number;
   profile_name?: string;
+  src?: string;
+  dst?: string;
+  duration_ms?: number;
+  fields?: Record<string, string>;
 }
 
 export interface ActivityLog {
@@ -54,6 +58,19 @@ export interface TimelineEvent {
   duration?: string;
 }
 
+export interface ProfileStateEvent {
+  profile_id: number;
+  profile_name: string;
+  state: string;
+  last_error?: string;
+  restart_count: number;
+}
+
+export interface HostRouterEvent {
+  running: boolean;
+  addr: string;
+}
+
 export interface ConfigurationTemplate {
   name: string;
   description: string;
@@ -69,5 +86,8 @@ declare global {
         App?: any;
       };
     };
+    runtime?: {
+      EventsOn: (eventName: string, callback: (...data: any) => void) => () => void;
+    };
   }
 }
\ No newline at end of file
@@ -3,11 +3,15 @@ package main
 import (
 	"context"
 	"embed"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
 
+	"github.com/imansprn/gostly/pkg/api"
+	"github.com/imansprn/gostly/pkg/database"
 	"github.com/wailsapp/wails/v2"
 	"github.com/wailsapp/wails/v2/pkg/options"
 	"github.com/wailsapp/wails/v2/pkg/options/assetserver"
@@ -19,6 +23,27 @@ import (
 var assets embed.FS
 
 func main() {
+	rotateKey := flag.Bool("rotate-key", false, "re-encrypt stored credentials under a new key and exit (set GOSTLY_NEW_PASSPHRASE to use a passphrase instead of a keyfile)")
+	dbDir := flag.String("db-dir", "", "directory to store databases in (overrides "+database.DirEnv+")")
+	dbPath := flag.String("db", "", "database file of the default workspace, other workspaces are stored next to it (overrides "+database.PathEnv+" and -db-dir)")
+	workspace := flag.String("workspace", "", "workspace to open on startup (overrides "+database.WorkspaceEnv+")")
+	flag.Parse()
+
+	// The database package reads its location from the environment
+	if *dbDir != "" {
+		os.Setenv(database.DirEnv, *dbDir)
+	}
+	if *dbPath != "" {
+		os.Setenv(database.PathEnv, *dbPath)
+	}
+	if *workspace != "" {
+		os.Setenv(database.WorkspaceEnv, *workspace)
+	}
+
+	if *rotateKey {
+		os.Exit(runRotateKey())
+	}
+
 	// Create an instance of the app structure
 	app := NewApp()
 
@@ -40,6 +65,14 @@ func main() {
 		Bind: []interface{}{
 			app,
 		},
+		// Send validation failures to the frontend as structured field errors
+		ErrorFormatter: func(err error) any {
+			var verr *api.ValidationError
+			if errors.As(err, &verr) {
+				return verr
+			}
+			return err.Error()
+		},
 		// Platform-specific options
 		Mac: &mac.Options{
 			TitleBar: mac.TitleBarDefault(),
@@ -67,3 +100,27 @@ func main() {
 		os.Exit(0)
 	}()
 }
+
+// runRotateKey implements -rotate-key. The new passphrase is read from the
+// environment so it doesn't end up in shell history.
+func runRotateKey() int {
+	db, err := database.New()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "open database: %v\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	newPassphrase := os.Getenv("GOSTLY_NEW_PASSPHRASE")
+	if err := db.RotateKey(newPassphrase); err != nil {
+		fmt.Fprintf(os.Stderr, "rotate key: %v\n", err)
+		return 1
+	}
+
+	if newPassphrase != "" {
+		fmt.Printf("Credentials re-encrypted. Start Gostly with %s set to the new passphrase.\n", database.PassphraseEnv)
+	} else {
+		fmt.Println("Credentials re-encrypted with a new keyfile.")
+	}
+	return 0
+}
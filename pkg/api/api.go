@@ -1,16 +1,14 @@
 package api
 
 import (
-	"bufio"
 	"context"
-	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"os/exec"
-	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -20,11 +18,19 @@ import (
 
 // API handles the application's business logic
 type API struct {
-	db            *database.DB
-	processes     map[int64]*exec.Cmd
+	db            *database.DB // replaced by SwitchWorkspace, read it with currentDB
+	dbMutex       sync.RWMutex
+	workspaceMu   sync.Mutex // serializes workspace switches with restoring profiles
+	processes     map[int64]*supervisedProcess
+	groups        map[string]*processGroup
+	groupSeq      int
 	mutex         sync.Mutex
 	logs          []LogEntry
+	logCounts     map[string]int64 // messages logged per level, for the metrics endpoint
+	logWriter     *logWriter       // persists logs to the workspace database
+	lastLogID     int64
 	logMutex      sync.RWMutex
+	gostMu        sync.RWMutex // guards gostAvailable and gostVersion, set by checkGostAvailability
 	gostAvailable bool
 	gostVersion   string
 
@@ -33,11 +39,24 @@ type API struct {
 	hostRouterCmd     *exec.Cmd
 	hostRouterServer  *http.Server
 	hostRouterRunning bool
+	routerMetrics     *routerMetrics
+
+	// Prometheus endpoint for Gostly's own metrics
+	metricsServer *http.Server
+	metricsMutex  sync.Mutex
 
 	// Timeline events
 	timelineEvents []TimelineEvent
 	timelineMutex  sync.RWMutex
 	nextEventID    int64
+
+	// Logs, timeline events and state changes are pushed to subscribers
+	events *eventBus
+
+	// Per-profile traffic statistics scraped from GOST's metrics
+	stats      map[int64]*statsTracker
+	statsMutex sync.RWMutex
+	statsStop  chan struct{}
 }
 
 // LogEntry represents a log entry from GOST or system
@@ -49,6 +68,12 @@ type LogEntry struct {
 	Message     string `json:"message"`
 	ProfileID   *int64 `json:"profile_id,omitempty"`
 	ProfileName string `json:"profile_name,omitempty"`
+
+	// Structured fields of GOST JSON log lines
+	Src        string            `json:"src,omitempty"`         // client address
+	Dst        string            `json:"dst,omitempty"`         // destination host:port
+	DurationMs float64           `json:"duration_ms,omitempty"` // connection duration
+	Fields     map[string]string `json:"fields,omitempty"`      // every field but level, time and msg
 }
 
 // TimelineEvent represents an activity timeline event
@@ -73,14 +98,36 @@ func New() (*API, error) {
 		return nil, err
 	}
 
-	api := &API{
-		db:        db,
-		processes: make(map[int64]*exec.Cmd),
-		logs:      []LogEntry{},
-	}
+	// Configs hold credentials; don't leave any from a crashed run lying around
+	removeGostConfigs()
 
-	// Check GOST availability asynchronously to avoid blocking init
-	go api.checkGostAvailability()
+	api := &API{
+		db:            db,
+		processes:     make(map[int64]*supervisedProcess),
+		groups:        make(map[string]*processGroup),
+		logs:          []LogEntry{},
+		logCounts:     make(map[string]int64),
+		events:        newEventBus(),
+		logWriter:     newLogWriter(),
+		stats:         make(map[int64]*statsTracker),
+		routerMetrics: newRouterMetrics(),
+		statsStop:     make(chan struct{}),
+		nextEventID:   1,
+	}
+
+	// Show the previous run's logs and keep persisting new ones
+	api.seedLogID(db)
+	api.loadRecentLogs()
+	go api.runLogWriter()
+
+	// Check GOST availability asynchronously to avoid blocking init, then
+	// bring back the profiles that were running when Gostly last exited
+	go func() {
+		api.checkGostAvailability()
+		api.restoreProfiles()
+	}()
+	go api.runStatsCollector()
+	api.startMetricsFromEnv()
 
 	// Add initial system log
 	api.addLog("INFO", "system", "Gostly API initialized successfully", nil, "")
@@ -98,11 +145,13 @@ func New() (*API, error) {
 func (a *API) checkGostAvailability() {
 	// Check if GOST is available
 	if a.isGostAvailable() {
-		a.gostAvailable = true
 		version, err := a.getGostVersion()
+		a.gostMu.Lock()
+		a.gostAvailable = true
 		if err == nil {
 			a.gostVersion = version
 		}
+		a.gostMu.Unlock()
 		a.addLog("INFO", "system", fmt.Sprintf("GOST detected: %s", version), nil, "")
 
 		// Create timeline event for GOST detection
@@ -110,12 +159,54 @@ func (a *API) checkGostAvailability() {
 			fmt.Sprintf("GOST binary detected: %s", version),
 			"success", "system", "1s", "")
 	} else {
+		a.gostMu.Lock()
 		a.gostAvailable = false
+		a.gostMu.Unlock()
 		a.addLog("INFO", "system", "GOST not found - manual installation required", nil, "")
 		a.addLog("INFO", "system", "To install GOST: brew install gost (macOS) or download from GitHub releases", nil, "")
 	}
 }
 
+// restoreProfiles starts every profile whose persisted desired state is running
+func (a *API) restoreProfiles() {
+	a.workspaceMu.Lock()
+	defer a.workspaceMu.Unlock()
+
+	profiles, err := a.currentDB().GetAutostartProfiles()
+	if err != nil {
+		a.addLog("ERROR", "system", fmt.Sprintf("Failed to load profiles to restore: %v", err), nil, "")
+		return
+	}
+	if len(profiles) == 0 {
+		return
+	}
+
+	var restored, failed []string
+	for _, p := range profiles {
+		if err := a.StartProfile(p.ID); err != nil {
+			failed = append(failed, fmt.Sprintf("%s (%v)", p.Name, err))
+			continue
+		}
+		restored = append(restored, p.Name)
+	}
+
+	status := "success"
+	details := fmt.Sprintf("Restored %d of %d profiles", len(restored), len(profiles))
+	if len(restored) > 0 {
+		details += ": " + strings.Join(restored, ", ")
+	}
+	if len(failed) > 0 {
+		status = "warning"
+		if len(restored) == 0 {
+			status = "error"
+		}
+		details += fmt.Sprintf("; failed to restore: %s", strings.Join(failed, ", "))
+	}
+
+	a.addLog("INFO", "system", details, nil, "")
+	a.addTimelineEvent("system", "Profiles Restored", details, status, "system", "", "")
+}
+
 // GetGostDebugInfo returns debug information about GOST detection
 func (a *API) GetGostDebugInfo() map[string]interface{} {
 	info := make(map[string]interface{})
@@ -159,8 +250,8 @@ func (a *API) GetGostDebugInfo() map[string]interface{} {
 	info["common_locations"] = locationResults
 
 	// Current GOST status
-	info["gost_available"] = a.gostAvailable
-	info["gost_version"] = a.gostVersion
+	info["gost_available"] = a.IsGostAvailable()
+	info["gost_version"] = a.GetGostVersion()
 
 	return info
 }
@@ -266,66 +357,73 @@ func (a *API) getGostVersion() (string, error) {
 
 // IsGostAvailable returns whether GOST is available
 func (a *API) IsGostAvailable() bool {
+	a.gostMu.RLock()
+	defer a.gostMu.RUnlock()
 	return a.gostAvailable
 }
 
 // GetGostVersion returns the GOST version if available
 func (a *API) GetGostVersion() string {
+	a.gostMu.RLock()
+	defer a.gostMu.RUnlock()
 	return a.gostVersion
 }
 
 // Close closes the API and releases resources
 func (a *API) Close() error {
 	fmt.Printf("API: Closing API, stopping all GOST processes...\n")
+	close(a.statsStop)
+	if running, _ := a.IsMetricsServerRunning(); running {
+		a.StopMetricsServer()
+	}
+	a.stopAllProcesses()
+	removeGostConfigs()
+	a.stopLogWriter()
 
-	// Stop all running processes
-	a.mutex.Lock()
-	processCount := len(a.processes)
-	fmt.Printf("API: Found %d running GOST processes to stop\n", processCount)
-
-	for id, cmd := range a.processes {
-		if cmd != nil && cmd.Process != nil {
-			fmt.Printf("API: Stopping GOST process for profile ID %d (PID: %d)\n", id, cmd.Process.Pid)
+	// Close database connection
+	if db := a.currentDB(); db != nil {
+		return db.Close()
+	}
 
-			// Try graceful shutdown first
-			err := cmd.Process.Signal(os.Interrupt)
-			if err != nil {
-				fmt.Printf("API: Failed to send interrupt to process %d: %v\n", cmd.Process.Pid, err)
-			}
+	return nil
+}
 
-			// Wait a bit for graceful shutdown
-			done := make(chan error, 1)
-			go func() {
-				done <- cmd.Wait()
-			}()
-
-			select {
-			case <-done:
-				fmt.Printf("API: Process %d stopped gracefully\n", cmd.Process.Pid)
-			case <-time.After(3 * time.Second):
-				fmt.Printf("API: Process %d didn't stop gracefully, killing it\n", cmd.Process.Pid)
-				cmd.Process.Kill()
+// stopAllProcesses stops every running GOST process without touching the
+// profiles' persisted desired state
+func (a *API) stopAllProcesses() {
+	// The supervisors need the mutex to reap their processes, so take
+	// ownership of the map before waiting on them.
+	a.mutex.Lock()
+	processes := a.processes
+	a.processes = make(map[int64]*supervisedProcess)
+	a.mutex.Unlock()
+	timeout := a.stopTimeoutDuration()
+
+	fmt.Printf("API: Found %d running GOST processes to stop\n", len(processes))
+
+	var wg sync.WaitGroup
+	for id, proc := range processes {
+		wg.Add(1)
+		go func(id int64, proc *supervisedProcess) {
+			defer wg.Done()
+			exitCode, killed := a.terminate(proc, timeout)
+			if killed {
+				fmt.Printf("API: Profile ID %d didn't stop gracefully and was killed\n", id)
+			} else {
+				fmt.Printf("API: Profile ID %d stopped gracefully (exit code %d)\n", id, exitCode)
 			}
-		}
-		delete(a.processes, id)
+		}(id, proc)
 	}
-	a.mutex.Unlock()
+	wg.Wait()
 
 	fmt.Printf("API: All GOST processes stopped\n")
-
-	// Close database connection
-	if a.db != nil {
-		return a.db.Close()
-	}
-
-	return nil
 }
 
 // GetProfiles returns all profiles
 func (a *API) GetProfiles() ([]database.Profile, error) {
 	fmt.Printf("API: GetProfiles called\n")
 
-	profiles, err := a.db.GetProfiles()
+	profiles, err := a.currentDB().GetProfiles()
 	if err != nil {
 		fmt.Printf("API: GetProfiles database error: %v\n", err)
 		a.addLog("ERROR", "api", fmt.Sprintf("GetProfiles failed: %v", err), nil, "")
@@ -337,11 +435,7 @@ func (a *API) GetProfiles() ([]database.Profile, error) {
 	// Update status for each profile
 	a.mutex.Lock()
 	for i := range profiles {
-		if _, ok := a.processes[profiles[i].ID]; ok {
-			profiles[i].Status = "running"
-		} else {
-			profiles[i].Status = "stopped"
-		}
+		a.applyProcessStatus(&profiles[i])
 	}
 	a.mutex.Unlock()
 
@@ -351,18 +445,14 @@ func (a *API) GetProfiles() ([]database.Profile, error) {
 
 // GetProfile returns a profile by ID
 func (a *API) GetProfile(id int64) (*database.Profile, error) {
-	profile, err := a.db.GetProfile(id)
+	profile, err := a.currentDB().GetProfile(id)
 	if err != nil {
 		return nil, err
 	}
 
 	// Update status
 	a.mutex.Lock()
-	if _, ok := a.processes[profile.ID]; ok {
-		profile.Status = "running"
-	} else {
-		profile.Status = "stopped"
-	}
+	a.applyProcessStatus(profile)
 	a.mutex.Unlock()
 
 	return profile, nil
@@ -370,9 +460,12 @@ func (a *API) GetProfile(id int64) (*database.Profile, error) {
 
 // AddProfile adds a new profile
 func (a *API) AddProfile(profile database.Profile) (int64, error) {
-	fmt.Printf("API: AddProfile called with profile: %+v\n", profile)
+	if err := a.validateForSave(&profile); err != nil {
+		a.addLog("WARN", "api", fmt.Sprintf("Rejected profile %s: %v", profile.Name, err), nil, profile.Name)
+		return 0, err
+	}
 
-	err := a.db.AddProfile(&profile)
+	err := a.currentDB().AddProfile(&profile)
 	if err != nil {
 		a.addLog("ERROR", "api", fmt.Sprintf("Failed to add profile %s: %v", profile.Name, err), nil, profile.Name)
 		fmt.Printf("API: AddProfile database error: %v\n", err)
@@ -395,16 +488,47 @@ func (a *API) AddProfile(profile database.Profile) (int64, error) {
 
 // UpdateProfile updates an existing profile
 func (a *API) UpdateProfile(profile database.Profile) error {
-	// Check if profile is running
+	// Running profiles are changed in place: a group's process reloads its
+	// config, and a profile's own process is updated through the GOST API
+	var group *processGroup
+	var running *supervisedProcess
 	a.mutex.Lock()
-	if _, ok := a.processes[profile.ID]; ok {
-		a.mutex.Unlock()
-		a.addLog("WARN", "api", fmt.Sprintf("Cannot update running profile %s (ID: %d)", profile.Name, profile.ID), &profile.ID, profile.Name)
-		return fmt.Errorf("cannot update a running profile, stop it first")
+	if proc, ok := a.processes[profile.ID]; ok && proc.isActive() {
+		switch {
+		case proc.group == nil && profile.Group == "":
+			running = proc
+		case proc.group != nil && proc.group.name == profile.Group:
+			group = proc.group
+		default:
+			a.mutex.Unlock()
+			a.addLog("WARN", "api", fmt.Sprintf("Cannot move running profile %s (ID: %d) to another group", profile.Name, profile.ID), &profile.ID, profile.Name)
+			return fmt.Errorf("cannot move a running profile to another group, stop it first")
+		}
 	}
 	a.mutex.Unlock()
 
-	err := a.db.UpdateProfile(&profile)
+	if err := a.validateForSave(&profile); err != nil {
+		a.addLog("WARN", "api", fmt.Sprintf("Rejected update of profile %s: %v", profile.Name, err), &profile.ID, profile.Name)
+		return err
+	}
+
+	var old *database.Profile
+	if running != nil || group != nil {
+		var err error
+		if old, err = a.currentDB().GetProfile(profile.ID); err != nil {
+			return err
+		}
+		// The running process holds the old port, so only probe a new one.
+		// A group reloading onto a taken port would take every member down.
+		if old.Listen != profile.Listen || listenNetwork(old) != listenNetwork(&profile) {
+			if err := a.checkListenAvailable(&profile); err != nil {
+				a.addLog("WARN", "api", fmt.Sprintf("Rejected update of profile %s: %v", profile.Name, err), &profile.ID, profile.Name)
+				return err
+			}
+		}
+	}
+
+	err := a.currentDB().UpdateProfile(&profile)
 	if err != nil {
 		a.addLog("ERROR", "api", fmt.Sprintf("Failed to update profile %s: %v", profile.Name, err), &profile.ID, profile.Name)
 	} else {
@@ -417,14 +541,37 @@ func (a *API) UpdateProfile(profile database.Profile) error {
 
 		// Log the activity
 		a.logActivity(profile.ID, profile.Name, "updated", fmt.Sprintf("Profile updated with type: %s, listen: %s, remote: %s", profile.Type, profile.Listen, profile.Remote))
+
+		if group != nil {
+			a.reloadGroupMember(group, &profile)
+		}
+		if running != nil {
+			err = a.applyLiveUpdate(running, old, &profile)
+		}
 	}
 	return err
 }
 
+// validateForSave validates a profile against the stored profiles before it is written
+func (a *API) validateForSave(profile *database.Profile) error {
+	profiles, err := a.currentDB().GetProfiles()
+	if err != nil {
+		return err
+	}
+
+	verr := validateProfile(profile, profiles)
+	if profile.ChainID != 0 {
+		if _, err := a.currentDB().GetChain(profile.ChainID); err != nil {
+			verr.add("chain_id", CodeNotFound, "chain %d does not exist", profile.ChainID)
+		}
+	}
+	return verr.errOrNil()
+}
+
 // DeleteProfile deletes a profile
 func (a *API) DeleteProfile(id int64) error {
 	// Get profile info before deletion for logging
-	profile, err := a.db.GetProfile(id)
+	profile, err := a.currentDB().GetProfile(id)
 	if err != nil {
 		a.addLog("ERROR", "api", fmt.Sprintf("Failed to get profile for deletion (ID: %d): %v", id, err), &id, "")
 		return err
@@ -432,18 +579,21 @@ func (a *API) DeleteProfile(id int64) error {
 
 	// Check if profile is running
 	a.mutex.Lock()
-	if _, ok := a.processes[id]; ok {
+	if proc, ok := a.processes[id]; ok && proc.isActive() {
 		a.mutex.Unlock()
 		a.addLog("WARN", "api", fmt.Sprintf("Cannot delete running profile %s (ID: %d)", profile.Name, id), &id, profile.Name)
 		return fmt.Errorf("cannot delete a running profile, stop it first")
 	}
+	// Forget any crash-looping supervisor for this profile
+	delete(a.processes, id)
 	a.mutex.Unlock()
 
-	err = a.db.DeleteProfile(id)
+	err = a.currentDB().DeleteProfile(id)
 	if err != nil {
 		a.addLog("ERROR", "api", fmt.Sprintf("Failed to delete profile %s: %v", profile.Name, err), &id, profile.Name)
 	} else {
 		a.addLog("INFO", "api", fmt.Sprintf("Profile deleted successfully: %s (ID: %d)", profile.Name, id), &id, profile.Name)
+		a.dropStats(id)
 
 		// Create timeline event for profile deletion
 		a.addTimelineEvent("configuration", "Profile Deleted",
@@ -456,37 +606,17 @@ func (a *API) DeleteProfile(id int64) error {
 	return err
 }
 
-// GostConfig represents the GOST configuration
-type GostConfig struct {
-	Services []struct {
-		Name    string `json:"name"`
-		Addr    string `json:"addr"`
-		Handler struct {
-			Type string `json:"type"`
-			Auth struct {
-				Username string `json:"username,omitempty"`
-				Password string `json:"password,omitempty"`
-			} `json:"auth,omitempty"`
-		} `json:"handler"`
-		Forwarder struct {
-			Nodes []struct {
-				Addr string `json:"addr"`
-			} `json:"nodes"`
-		} `json:"forwarder"`
-	} `json:"services"`
-}
-
 // StartProfile starts a profile
 func (a *API) StartProfile(id int64) error {
 	// Check if GOST is available
-	if !a.gostAvailable {
+	if !a.IsGostAvailable() {
 		a.addLog("ERROR", "api", fmt.Sprintf("Cannot start profile %d: GOST is not available", id), &id, "")
 		return fmt.Errorf("GOST is not available. Please install GOST or restart the application to auto-install")
 	}
 
 	// Check if profile is already running
 	a.mutex.Lock()
-	if _, ok := a.processes[id]; ok {
+	if proc, ok := a.processes[id]; ok && proc.isActive() {
 		a.mutex.Unlock()
 		a.addLog("WARN", "api", fmt.Sprintf("Profile %d is already running", id), &id, "")
 		return fmt.Errorf("profile is already running")
@@ -494,90 +624,44 @@ func (a *API) StartProfile(id int64) error {
 	a.mutex.Unlock()
 
 	// Get profile
-	profile, err := a.db.GetProfile(id)
+	profile, err := a.currentDB().GetProfile(id)
 	if err != nil {
 		a.addLog("ERROR", "api", fmt.Sprintf("Failed to get profile %d: %v", id, err), &id, "")
 		return err
 	}
 
-	a.addLog("INFO", "api", fmt.Sprintf("Starting profile: %s (ID: %d)", profile.Name, id), &id, profile.Name)
-
-	// Create config file with logging configuration
-	configPath, err := a.createGostConfigWithLogging(profile)
-	if err != nil {
-		a.addLog("ERROR", "api", fmt.Sprintf("Failed to create config for profile %s: %v", profile.Name, err), &id, profile.Name)
-		return err
-	}
-
-	a.addLog("DEBUG", "api", fmt.Sprintf("Config file created: %s", configPath), &id, profile.Name)
-
-	// Start GOST process with output capture
-	gostPath := a.getGostPath()
-	cmd := exec.Command(gostPath, "-C", configPath)
-
-	// Capture stdout and stderr
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		a.addLog("ERROR", "api", fmt.Sprintf("Failed to create stdout pipe: %v", err), &id, profile.Name)
-		os.Remove(configPath)
-		return err
-	}
-
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		a.addLog("ERROR", "api", fmt.Sprintf("Failed to create stderr pipe: %v", err), &id, profile.Name)
-		os.Remove(configPath)
+	// Refuse to start on a port another profile or process already holds
+	if err := a.checkListenAvailable(profile); err != nil {
+		a.addLog("ERROR", "api", fmt.Sprintf("Cannot start profile %s: %v", profile.Name, err), &id, profile.Name)
 		return err
 	}
 
-	err = cmd.Start()
-	if err != nil {
-		a.addLog("ERROR", "api", fmt.Sprintf("Failed to start GOST process: %v", err), &id, profile.Name)
-		os.Remove(configPath)
-		return err
-	}
-
-	// Store process
-	a.mutex.Lock()
-	a.processes[id] = cmd
-	a.mutex.Unlock()
-
-	// Create timeline event for profile start
-	a.addTimelineEvent("proxy_action", "Profile Started",
-		fmt.Sprintf("Proxy profile '%s' started on %s", profile.Name, profile.Listen),
-		"success", "admin", "2s", profile.Name)
-
-	a.addLog("INFO", "gost", fmt.Sprintf("GOST process started for profile %s (PID: %d)", profile.Name, cmd.Process.Pid), &id, profile.Name)
+	a.addLog("INFO", "api", fmt.Sprintf("Starting profile: %s (ID: %d)", profile.Name, id), &id, profile.Name)
 
-	// Capture GOST output in goroutines
-	go func() {
-		scanner := bufio.NewScanner(stdout)
-		for scanner.Scan() {
-			line := scanner.Text()
-			a.addLog("INFO", "gost", line, &id, profile.Name)
+	if profile.Group != "" {
+		// Runs as a service of the group's shared GOST process
+		if err := a.startGroupMember(profile); err != nil {
+			return err
 		}
-	}()
-
-	go func() {
-		scanner := bufio.NewScanner(stderr)
-		for scanner.Scan() {
-			line := scanner.Text()
-			level := a.detectGostLogLevel(line)
-			a.addLog(level, "gost", line, &id, profile.Name)
+	} else {
+		proc := newSupervisedProcess(profile, a.events)
+		if err := a.launchProfileProcess(proc, profile); err != nil {
+			return err
 		}
-	}()
-
-	// Clean up when process exits
-	go func() {
-		cmd.Wait()
-		os.Remove(configPath)
 
+		// Store process, replacing any crash-looping supervisor
 		a.mutex.Lock()
-		delete(a.processes, id)
+		a.processes[id] = proc
 		a.mutex.Unlock()
 
-		a.addLog("INFO", "gost", fmt.Sprintf("GOST process exited for profile %s", profile.Name), &id, profile.Name)
-	}()
+		// Restart the process if it exits without StopProfile
+		go a.superviseProfile(proc)
+	}
+
+	// Remember that this profile should be running across app restarts
+	if err := a.currentDB().SetProfileAutostart(id, true); err != nil {
+		a.addLog("WARN", "api", fmt.Sprintf("Failed to persist desired state for profile %s: %v", profile.Name, err), &id, profile.Name)
+	}
 
 	// Log the activity
 	a.logActivity(id, profile.Name, "started", fmt.Sprintf("Profile started: %s", profile.Name))
@@ -585,157 +669,134 @@ func (a *API) StartProfile(id int64) error {
 	return nil
 }
 
-// StopProfile stops a profile
+// StopProfile stops a profile, giving GOST the configured drain timeout to
+// exit after SIGTERM, and returns once the process has actually exited. The
+// profile is stopped either way, but an error reports that it had to be
+// killed or exited with a failure status.
 func (a *API) StopProfile(id int64) error {
 	// Check if profile is running
 	a.mutex.Lock()
-	cmd, ok := a.processes[id]
-	if !ok {
+	proc, ok := a.processes[id]
+	if !ok || proc.state == StateStopping {
 		a.mutex.Unlock()
 		a.addLog("WARN", "api", fmt.Sprintf("Profile %d is not running", id), &id, "")
 		return fmt.Errorf("profile is not running")
 	}
-
-	// Kill process
-	err := cmd.Process.Kill()
-	delete(a.processes, id)
 	a.mutex.Unlock()
+	timeout := a.stopTimeoutDuration()
 
-	if err != nil {
-		a.addLog("ERROR", "api", fmt.Sprintf("Failed to kill process for profile %d: %v", id, err), &id, "")
-	} else {
-		a.addLog("INFO", "api", fmt.Sprintf("Profile %d stopped successfully", id), &id, "")
+	// The user stopped it, so don't bring it back on the next launch
+	if err := a.currentDB().SetProfileAutostart(id, false); err != nil {
+		a.addLog("WARN", "api", fmt.Sprintf("Failed to persist desired state for profile %d: %v", id, err), &id, "")
+	}
 
-		// Create timeline event for profile stop
-		profile, err := a.db.GetProfile(id)
-		if err == nil {
-			a.addTimelineEvent("proxy_action", "Profile Stopped",
-				fmt.Sprintf("Proxy profile '%s' stopped", profile.Name),
-				"success", "admin", "1s", profile.Name)
-		}
+	start := time.Now()
+	exitCode, killed := a.terminate(proc, timeout)
+	elapsed := time.Since(start).Round(time.Millisecond)
+
+	// Only now is the profile really stopped
+	a.mutex.Lock()
+	if a.processes[id] == proc {
+		delete(a.processes, id)
 	}
+	a.mutex.Unlock()
+
+	exitStatus := fmt.Sprintf("exit code %d", exitCode)
+	level, status := "INFO", "success"
+	var stopErr error
+	switch {
+	case killed:
+		exitStatus = fmt.Sprintf("killed after %s drain timeout", timeout)
+		level, status = "WARN", "warning"
+		stopErr = fmt.Errorf("profile %s didn't stop within %s and was killed", proc.profileName, timeout)
+	case exitCode > 0:
+		level, status = "WARN", "warning"
+		stopErr = fmt.Errorf("profile %s exited with code %d while stopping", proc.profileName, exitCode)
+	}
+	details := fmt.Sprintf("Profile stopped: %s (%s)", proc.profileName, exitStatus)
+
+	a.addLog(level, "api", details, &id, proc.profileName)
+
+	// Create timeline event for profile stop
+	a.addTimelineEvent("proxy_action", "Profile Stopped",
+		fmt.Sprintf("Proxy profile '%s' stopped (%s)", proc.profileName, exitStatus),
+		status, "admin", elapsed.String(), proc.profileName)
 
 	// Log the activity
-	profile, err := a.db.GetProfile(id)
-	if err == nil {
-		a.logActivity(id, profile.Name, "stopped", fmt.Sprintf("Profile stopped: %s", profile.Name))
+	a.logActivity(id, proc.profileName, "stopped", details)
+	return stopErr
+}
+
+// SetStopTimeout sets how long StopProfile waits for GOST to drain before
+// killing it, and saves it with the workspace settings
+func (a *API) SetStopTimeout(seconds int) error {
+	if seconds <= 0 {
+		return fmt.Errorf("stop timeout must be positive, got %d", seconds)
 	}
-	return err
+	if err := a.currentDB().SetSetting(stopTimeoutSetting, strconv.Itoa(seconds)); err != nil {
+		a.addLog("ERROR", "api", fmt.Sprintf("Failed to save profile stop timeout: %v", err), nil, "")
+		return err
+	}
+
+	a.addLog("INFO", "api", fmt.Sprintf("Profile stop timeout set to %ds", seconds), nil, "")
+	return nil
+}
+
+// GetStopTimeout returns the drain timeout used by StopProfile, in seconds
+func (a *API) GetStopTimeout() int {
+	return int(a.stopTimeoutDuration() / time.Second)
 }
 
-// createConfigFile creates a temporary config file for GOST
-func (a *API) createConfigFile(profile *database.Profile) (string, error) {
-	// Create config directory if it doesn't exist
-	configDir, err := os.UserCacheDir()
+// stopTimeoutDuration returns the workspace's stop timeout, or the default
+// when it isn't set
+func (a *API) stopTimeoutDuration() time.Duration {
+	value, err := a.currentDB().GetSetting(stopTimeoutSetting)
 	if err != nil {
-		return "", err
+		return defaultStopTimeout
 	}
-	configDir = filepath.Join(configDir, "gostly")
-	err = os.MkdirAll(configDir, 0755)
-	if err != nil {
-		return "", err
-	}
-
-	// Create config file
-	configPath := filepath.Join(configDir, fmt.Sprintf("config_%d.json", profile.ID))
-
-	// Determine handler type based on profile type
-	handlerType := "socks5" // default fallback
-	fmt.Printf("DEBUG: Profile type from DB: '%s'\n", profile.Type)
-	switch profile.Type {
-	case "forward":
-		handlerType = "socks5"
-		fmt.Printf("DEBUG: Selected handler type: socks5\n")
-	case "reverse":
-		handlerType = "tcp"
-		fmt.Printf("DEBUG: Selected handler type: tcp\n")
-	case "http":
-		handlerType = "http"
-		fmt.Printf("DEBUG: Selected handler type: http\n")
-	case "tcp":
-		handlerType = "tcp"
-		fmt.Printf("DEBUG: Selected handler type: tcp\n")
-	case "udp":
-		handlerType = "udp"
-		fmt.Printf("DEBUG: Selected handler type: udp\n")
-	case "ss":
-		handlerType = "ss"
-		fmt.Printf("DEBUG: Selected handler type: ss\n")
-	default:
-		// For unknown types, default to socks5
-		handlerType = "socks5"
-		fmt.Printf("DEBUG: Unknown profile type, defaulting to socks5\n")
-	}
-	fmt.Printf("DEBUG: Final handler type: '%s'\n", handlerType)
-
-	// Create config
-	config := GostConfig{}
-	config.Services = []struct {
-		Name    string `json:"name"`
-		Addr    string `json:"addr"`
-		Handler struct {
-			Type string `json:"type"`
-			Auth struct {
-				Username string `json:"username,omitempty"`
-				Password string `json:"password,omitempty"`
-			} `json:"auth,omitempty"`
-		} `json:"handler"`
-		Forwarder struct {
-			Nodes []struct {
-				Addr string `json:"addr"`
-			} `json:"nodes"`
-		} `json:"forwarder"`
-	}{
-		{
-			Name: profile.Name,
-			Addr: profile.Listen,
-			Handler: struct {
-				Type string `json:"type"`
-				Auth struct {
-					Username string `json:"username,omitempty"`
-					Password string `json:"password,omitempty"`
-				} `json:"auth,omitempty"`
-			}{
-				Type: handlerType, // Use dynamic handler type
-			},
-			Forwarder: struct {
-				Nodes []struct {
-					Addr string `json:"addr"`
-				} `json:"nodes"`
-			}{
-				Nodes: []struct {
-					Addr string `json:"addr"`
-				}{
-					{
-						Addr: profile.Remote,
-					},
-				},
-			},
-		},
-	}
-
-	// Add auth if provided (only for protocols that support it)
-	if profile.Username != "" && profile.Password != "" {
-		// Only add auth for protocols that support it
-		switch handlerType {
-		case "socks5", "http":
-			config.Services[0].Handler.Auth.Username = profile.Username
-			config.Services[0].Handler.Auth.Password = profile.Password
-		}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds <= 0 {
+		return defaultStopTimeout
 	}
+	return time.Duration(seconds) * time.Second
+}
 
-	// Write config to file
-	configData, err := json.MarshalIndent(config, "", "  ")
+// SetProfileAutostart sets whether a profile is started automatically when Gostly launches
+func (a *API) SetProfileAutostart(id int64, autostart bool) error {
+	profile, err := a.currentDB().GetProfile(id)
 	if err != nil {
-		return "", err
+		a.addLog("ERROR", "api", fmt.Sprintf("Failed to get profile %d: %v", id, err), &id, "")
+		return err
 	}
 
-	err = os.WriteFile(configPath, configData, 0644)
-	if err != nil {
-		return "", err
+	if err := a.currentDB().SetProfileAutostart(id, autostart); err != nil {
+		a.addLog("ERROR", "api", fmt.Sprintf("Failed to update autostart for profile %s: %v", profile.Name, err), &id, profile.Name)
+		return err
+	}
+
+	a.addLog("INFO", "api", fmt.Sprintf("Autostart for profile %s set to %t", profile.Name, autostart), &id, profile.Name)
+	return nil
+}
+
+// RotateEncryptionKey re-encrypts all stored credentials under a new key.
+// An empty passphrase switches to a freshly generated keyfile.
+func (a *API) RotateEncryptionKey(newPassphrase string) error {
+	if err := a.currentDB().RotateKey(newPassphrase); err != nil {
+		a.addLog("ERROR", "api", fmt.Sprintf("Failed to rotate encryption key: %v", err), nil, "")
+		return err
+	}
+
+	source := "a new keyfile"
+	if newPassphrase != "" {
+		source = "a new passphrase"
 	}
+	a.addLog("INFO", "api", fmt.Sprintf("Stored credentials re-encrypted with %s", source), nil, "")
 
-	return configPath, nil
+	a.addTimelineEvent("configuration", "Encryption Key Rotated",
+		fmt.Sprintf("Stored credentials re-encrypted with %s", source),
+		"success", "admin", "1s", "")
+
+	return nil
 }
 
 // logActivity logs a profile operation to the activity log
@@ -749,7 +810,7 @@ func (a *API) logActivity(profileID int64, profileName, action, details string)
 		Status:      "success",
 	}
 
-	err := a.db.AddActivityLog(log)
+	err := a.currentDB().AddActivityLog(log)
 	if err != nil {
 		fmt.Printf("API: Failed to log activity: %v\n", err)
 	}
@@ -757,40 +818,79 @@ func (a *API) logActivity(profileID int64, profileName, action, details string)
 
 // GetActivityLogs returns all activity logs
 func (a *API) GetActivityLogs() ([]database.ActivityLog, error) {
-	return a.db.GetActivityLogs(nil)
+	return a.currentDB().GetActivityLogs(nil)
 }
 
 // GetRecentActivityLogs returns the most recent activity logs
 func (a *API) GetRecentActivityLogs(limit int) ([]database.ActivityLog, error) {
-	return a.db.GetRecentActivityLogs(limit)
+	return a.currentDB().GetRecentActivityLogs(limit)
 }
 
 // addLog adds a log entry to the in-memory logs
 func (a *API) addLog(level, source, message string, profileID *int64, profileName string) {
-	a.logMutex.Lock()
-	defer a.logMutex.Unlock()
-
-	entry := LogEntry{
-		ID:          a.getNextLogID(),
-		Timestamp:   time.Now().Format(time.RFC3339),
+	a.appendLog(LogEntry{
 		Level:       level,
 		Source:      source,
 		Message:     message,
 		ProfileID:   profileID,
 		ProfileName: profileName,
-	}
+	})
+}
+
+// appendLog stamps an entry with its ID and time and records it
+func (a *API) appendLog(entry LogEntry) {
+	a.logMutex.Lock()
+	defer a.logMutex.Unlock()
+
+	now := time.Now()
+	entry.ID = a.getNextLogID()
+	entry.Timestamp = now.Format(time.RFC3339)
 
 	a.logs = append(a.logs, entry)
+	a.logCounts[entry.Level]++
+	a.persistLog(entry, now)
+	a.events.publish(TopicLog, entry)
 	// Keep only last 1000 logs to prevent memory issues
 	if len(a.logs) > 1000 {
 		a.logs = a.logs[len(a.logs)-1000:]
 	}
-	fmt.Printf("[%s] %s: %s\n", level, source, message)
+	fmt.Printf("[%s] %s: %s\n", entry.Level, entry.Source, entry.Message)
 }
 
-// getNextLogID returns the next available log ID without locking (caller should hold lock if needed)
+// getNextLogID returns the next log ID. IDs are a sequence rather than
+// timestamps so they never repeat or go backwards. Caller must hold logMutex.
 func (a *API) getNextLogID() int64 {
-	return time.Now().UnixNano()
+	a.lastLogID++
+	return a.lastLogID
+}
+
+// seedLogID continues the log ID sequence past every ID persisted in db
+func (a *API) seedLogID(db *database.DB) {
+	last, err := db.LastLogID()
+	if err != nil {
+		fmt.Printf("API: failed to read the last log ID: %v\n", err)
+		return
+	}
+	a.logMutex.Lock()
+	defer a.logMutex.Unlock()
+	if last > a.lastLogID {
+		a.lastLogID = last
+	}
+}
+
+// loadRecentLogs fills the in-memory logs with the newest persisted entries
+func (a *API) loadRecentLogs() {
+	records, err := a.currentDB().QueryLogs(database.LogFilter{Limit: 1000})
+	if err != nil {
+		fmt.Printf("API: failed to load persisted logs: %v\n", err)
+		return
+	}
+
+	a.logMutex.Lock()
+	defer a.logMutex.Unlock()
+	for i := len(records) - 1; i >= 0; i-- {
+		a.logs = append(a.logs, logEntryFromRecord(records[i]))
+	}
 }
 
 // addTimelineEvent adds a timeline event
@@ -812,6 +912,7 @@ func (a *API) addTimelineEvent(eventType, action, details, status, user, duratio
 
 	a.timelineEvents = append(a.timelineEvents, event)
 	a.nextEventID++
+	a.events.publish(TopicTimeline, event)
 }
 
 // GetTimelineEvents returns all timeline events
@@ -853,7 +954,8 @@ func (a *API) GetRecentLogs(limit int) ([]LogEntry, error) {
 	return logs, nil
 }
 
-// ClearLogs clears all logs
+// ClearLogs clears the logs held in memory. The persisted history stays
+// searchable; PurgeLogHistory deletes it.
 func (a *API) ClearLogs() error {
 	a.logMutex.Lock()
 	defer a.logMutex.Unlock()
@@ -898,7 +1000,7 @@ func (a *API) GetLogsBySource(source string) ([]LogEntry, error) {
 
 // Host Mapping API passthroughs
 func (a *API) GetHostMappings() ([]database.HostMapping, error) {
-	return a.db.GetHostMappings()
+	return a.currentDB().GetHostMappings()
 }
 
 func (a *API) UpsertHostMapping(m database.HostMapping) error {
@@ -912,7 +1014,7 @@ func (a *API) UpsertHostMapping(m database.HostMapping) error {
 		fmt.Sprintf("Host mapping: %s -> %s:%d (%s)", m.Hostname, m.IP, m.Port, m.Protocol),
 		"success", "admin", "1s", "")
 
-	return a.db.UpsertHostMapping(&m)
+	return a.currentDB().UpsertHostMapping(&m)
 }
 
 func (a *API) DeleteHostMappingByHostname(hostname string) error {
@@ -921,7 +1023,7 @@ func (a *API) DeleteHostMappingByHostname(hostname string) error {
 		fmt.Sprintf("Host mapping removed: %s", hostname),
 		"success", "admin", "1s", "")
 
-	return a.db.DeleteHostMappingByHostname(hostname)
+	return a.currentDB().DeleteHostMappingByHostname(hostname)
 }
 
 func (a *API) DeleteHostMappingByID(id int64) error {
@@ -930,7 +1032,7 @@ func (a *API) DeleteHostMappingByID(id int64) error {
 		fmt.Sprintf("Host mapping removed (ID: %d)", id),
 		"success", "admin", "1s", "")
 
-	return a.db.DeleteHostMappingByID(id)
+	return a.currentDB().DeleteHostMappingByID(id)
 }
 
 // StartHostRouter starts a custom HTTP server that routes by Host header
@@ -950,7 +1052,7 @@ func (a *API) StartHostRouter(addr string) error {
 		a.addLog("WARN", "api", fmt.Sprintf("Failed to kill processes on port %s: %v", addr, err), nil, "")
 	}
 
-	mappings, err := a.db.GetHostMappings()
+	mappings, err := a.currentDB().GetHostMappings()
 	if err != nil {
 		return err
 	}
@@ -1006,8 +1108,10 @@ func (a *API) StartHostRouter(addr string) error {
 
 		// Find the matching host mapping
 		var targetURL string
+		metricHost := "default"
 		for _, m := range mappings {
 			if m.Active && !strings.EqualFold(m.Protocol, "TCP") && m.Hostname == host {
+				metricHost = m.Hostname
 				scheme := "http"
 				if strings.EqualFold(m.Protocol, "HTTPS") {
 					scheme = "https"
@@ -1023,7 +1127,13 @@ func (a *API) StartHostRouter(addr string) error {
 		}
 
 		// Forward the request
-		a.forwardRequest(w, r, targetURL)
+		started := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		a.forwardRequest(recorder, r, targetURL)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		a.routerMetrics.observe(metricHost, recorder.status, time.Since(started))
 	})
 
 	// Start the server in a goroutine
@@ -1036,6 +1146,7 @@ func (a *API) StartHostRouter(addr string) error {
 	a.hostRouterServer = server
 	a.hostRouterAddr = addr
 	a.hostRouterRunning = true
+	a.events.publish(TopicHostRouter, HostRouterEvent{Running: true, Addr: addr})
 
 	// Create timeline event
 	a.addTimelineEvent("host_mapping", "Host Router Started",
@@ -1072,6 +1183,7 @@ func (a *API) StopHostRouter() error {
 	a.hostRouterRunning = false
 	a.hostRouterServer = nil
 	a.hostRouterAddr = ""
+	a.events.publish(TopicHostRouter, HostRouterEvent{Running: false})
 
 	// Create timeline event
 	a.addTimelineEvent("host_mapping", "Host Router Stopped",
@@ -1087,30 +1199,9 @@ func (a *API) IsHostRouterRunning() (bool, string) {
 	return a.hostRouterRunning, a.hostRouterAddr
 }
 
-// detectGostLogLevel analyzes GOST log output to determine the actual log level
-func (a *API) detectGostLogLevel(line string) string {
-	// GOST typically outputs JSON logs with a "level" field
-	// Try to parse as JSON first
-	var logData map[string]interface{}
-	if err := json.Unmarshal([]byte(line), &logData); err == nil {
-		if level, ok := logData["level"].(string); ok {
-			// Convert GOST levels to our levels
-			switch strings.ToLower(level) {
-			case "debug":
-				return "DEBUG"
-			case "info":
-				return "INFO"
-			case "warn", "warning":
-				return "WARN"
-			case "error":
-				return "ERROR"
-			default:
-				return "INFO" // Default to INFO for unknown levels
-			}
-		}
-	}
-
-	// If not JSON, try to detect level from common patterns
+// detectLogLevelFromText guesses the level of a GOST log line that isn't
+// JSON or carries no level
+func detectLogLevelFromText(line string) string {
 	lineLower := strings.ToLower(line)
 
 	// Error indicators
@@ -1151,149 +1242,6 @@ func (a *API) detectGostLogLevel(line string) string {
 	return "INFO"
 }
 
-// createGostConfigWithLogging creates a GOST config with proper logging configuration
-func (a *API) createGostConfigWithLogging(profile *database.Profile) (string, error) {
-	// Create config directory if it doesn't exist
-	configDir, err := os.UserCacheDir()
-	if err != nil {
-		return "", err
-	}
-	configDir = filepath.Join(configDir, "gostly")
-	err = os.MkdirAll(configDir, 0755)
-	if err != nil {
-		return "", err
-	}
-
-	// Create config file
-	configPath := filepath.Join(configDir, fmt.Sprintf("config_%d.json", profile.ID))
-
-	// Determine handler type based on profile type
-	handlerType := "socks5" // default fallback
-	fmt.Printf("DEBUG: Profile type from DB: '%s'\n", profile.Type)
-	switch profile.Type {
-	case "forward":
-		handlerType = "socks5"
-		fmt.Printf("DEBUG: Selected handler type: socks5\n")
-	case "reverse":
-		handlerType = "tcp"
-		fmt.Printf("DEBUG: Selected handler type: tcp\n")
-	case "http":
-		handlerType = "http"
-		fmt.Printf("DEBUG: Selected handler type: http\n")
-	case "tcp":
-		handlerType = "tcp"
-		fmt.Printf("DEBUG: Selected handler type: tcp\n")
-	case "udp":
-		handlerType = "udp"
-		fmt.Printf("DEBUG: Selected handler type: udp\n")
-	case "ss":
-		handlerType = "ss"
-		fmt.Printf("DEBUG: Selected handler type: ss\n")
-	default:
-		// For unknown types, default to socks5
-		handlerType = "socks5"
-		fmt.Printf("DEBUG: Unknown profile type, defaulting to socks5\n")
-	}
-	fmt.Printf("DEBUG: Final handler type: '%s'\n", handlerType)
-
-	// Create config with logging configuration
-	config := GostConfig{}
-	config.Services = []struct {
-		Name    string `json:"name"`
-		Addr    string `json:"addr"`
-		Handler struct {
-			Type string `json:"type"`
-			Auth struct {
-				Username string `json:"username,omitempty"`
-				Password string `json:"password,omitempty"`
-			} `json:"auth,omitempty"`
-		} `json:"handler"`
-		Forwarder struct {
-			Nodes []struct {
-				Addr string `json:"addr"`
-			} `json:"nodes"`
-		} `json:"forwarder"`
-	}{
-		{
-			Name: profile.Name,
-			Addr: profile.Listen,
-			Handler: struct {
-				Type string `json:"type"`
-				Auth struct {
-					Username string `json:"username,omitempty"`
-					Password string `json:"password,omitempty"`
-				} `json:"auth,omitempty"`
-			}{
-				Type: handlerType,
-				Auth: struct {
-					Username string `json:"username,omitempty"`
-					Password string `json:"password,omitempty"`
-				}{
-					Username: profile.Username,
-					Password: profile.Password,
-				},
-			},
-			Forwarder: struct {
-				Nodes []struct {
-					Addr string `json:"addr"`
-				} `json:"nodes"`
-			}{
-				Nodes: []struct {
-					Addr string `json:"addr"`
-				}{
-					{Addr: profile.Remote},
-				},
-			},
-		},
-	}
-
-	// Add logging configuration to reduce verbose output
-	configData := map[string]interface{}{
-		"services": config.Services,
-		"log": map[string]interface{}{
-			"level":  "info", // Set GOST log level to info to reduce noise
-			"format": "json",
-			"output": "stderr",
-		},
-	}
-
-	// Write config to file
-	data, err := json.MarshalIndent(configData, "", "  ")
-	if err != nil {
-		return "", err
-	}
-
-	err = os.WriteFile(configPath, data, 0644)
-	if err != nil {
-		return "", err
-	}
-
-	return configPath, nil
-}
-
-// SetGostLogLevel sets the logging level for GOST processes
-func (a *API) SetGostLogLevel(level string) {
-	// Validate log level
-	validLevels := map[string]bool{
-		"debug": true,
-		"info":  true,
-		"warn":  true,
-		"error": true,
-	}
-
-	if !validLevels[strings.ToLower(level)] {
-		level = "info" // Default to info if invalid
-	}
-
-	a.addLog("INFO", "api", fmt.Sprintf("GOST log level set to: %s", level), nil, "")
-}
-
-// GetGostLogLevel returns the current GOST log level
-func (a *API) GetGostLogLevel() string {
-	// For now, return a default level - this could be enhanced to store in config
-	return "info"
-}
-
 // killGostProcessesOnPort kills any GOST processes using the specified port
 func (a *API) killGostProcessesOnPort(addr string) error {
 	// Extract port from addr (e.g., ":8080" -> "8080")
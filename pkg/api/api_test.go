@@ -1,10 +1,54 @@
 package api
 
 import (
+	"encoding/binary"
 	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/imansprn/gostly/pkg/database"
 )
 
+// newTestAPI opens an API under a temporary config dir
+func newTestAPI(t *testing.T) *API {
+	t.Helper()
+	t.Setenv(database.DirEnv, t.TempDir())
+	t.Setenv(database.WorkspaceEnv, "")
+	t.Setenv(database.PassphraseEnv, "")
+	t.Setenv(database.KeyfileEnv, "")
+	t.Setenv(MetricsAddrEnv, "")
+	return openTestAPI(t)
+}
+
+// openTestAPI opens an API on the test's config dir, as a restart would. It
+// is closed at the end of the test unless the test closed it already.
+func openTestAPI(t *testing.T) *API {
+	t.Helper()
+	a, err := New()
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() {
+		select {
+		case <-a.statsStop:
+		default:
+			a.Close()
+		}
+	})
+	return a
+}
+
 func TestLogEntry_JSONTags(t *testing.T) {
 	// Test that LogEntry struct has proper JSON tags
 	entry := LogEntry{
@@ -46,3 +90,1456 @@ func TestLogEntry_Empty(t *testing.T) {
 		t.Errorf("Failed to marshal empty LogEntry to JSON: %v", err)
 	}
 }
+
+func TestSupervisorBackoff(t *testing.T) {
+	// Backoff doubles per consecutive failure and is capped
+	cases := map[int]time.Duration{
+		1:  supervisorBaseBackoff,
+		2:  2 * supervisorBaseBackoff,
+		3:  4 * supervisorBaseBackoff,
+		20: supervisorMaxBackoff,
+	}
+	for failures, want := range cases {
+		if got := supervisorBackoff(failures); got != want {
+			t.Errorf("supervisorBackoff(%d) = %v, want %v", failures, got, want)
+		}
+	}
+}
+
+func TestProfileStateTransitions(t *testing.T) {
+	// Running is only reachable through starting
+	if canTransition(StateStopped, StateRunning) {
+		t.Error("stopped -> running should not be allowed")
+	}
+	if !canTransition(StateStarting, StateRunning) {
+		t.Error("starting -> running should be allowed")
+	}
+	if !canTransition(StateStarting, StateFailed) {
+		t.Error("starting -> failed should be allowed")
+	}
+	if canTransition(StateStopping, StateRunning) {
+		t.Error("stopping -> running should not be allowed")
+	}
+
+	proc := &supervisedProcess{state: StateStarting}
+	if !proc.setState(StateFailed, "bind: address already in use") {
+		t.Fatal("setState(failed) returned false")
+	}
+	if proc.lastError != "bind: address already in use" {
+		t.Errorf("lastError = %q", proc.lastError)
+	}
+	if proc.isActive() {
+		t.Error("failed process should not be active")
+	}
+}
+
+func TestListenerProbeAddr(t *testing.T) {
+	cases := map[string]string{
+		":1080":          "127.0.0.1:1080",
+		"0.0.0.0:8080":   "127.0.0.1:8080",
+		"10.0.0.1:3128":  "10.0.0.1:3128",
+		"not-an-address": "",
+	}
+	for listen, want := range cases {
+		if got := listenerProbeAddr(listen); got != want {
+			t.Errorf("listenerProbeAddr(%q) = %q, want %q", listen, got, want)
+		}
+	}
+}
+
+func TestUDPPortBound(t *testing.T) {
+	if _, ok := udpPortBound(nil, 0); !ok {
+		t.Skip("UDP socket tables aren't available")
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	if bound, _ := udpPortBound(nil, port); !bound {
+		t.Errorf("udpPortBound(nil, %d) = false while it is bound", port)
+	}
+	if bound, _ := udpPortBound(net.ParseIP("127.0.0.1"), port); !bound {
+		t.Errorf("udpPortBound(127.0.0.1, %d) = false while it is bound", port)
+	}
+	// The port is taken on loopback only
+	if bound, _ := udpPortBound(net.ParseIP("127.0.0.2"), port); bound {
+		t.Errorf("udpPortBound(127.0.0.2, %d) = true for another address", port)
+	}
+	if conn6, err := net.ListenPacket("udp", "[::1]:0"); err == nil {
+		port6 := conn6.LocalAddr().(*net.UDPAddr).Port
+		if bound, _ := udpPortBound(net.ParseIP("::1"), port6); !bound {
+			t.Errorf("udpPortBound(::1, %d) = false while it is bound", port6)
+		}
+		conn6.Close()
+	}
+	conn.Close()
+	if bound, _ := udpPortBound(nil, port); bound {
+		t.Errorf("udpPortBound(nil, %d) = true after closing it", port)
+	}
+}
+
+func TestParseProcNetIP(t *testing.T) {
+	// The cases are printed by a little-endian host
+	if binary.NativeEndian.Uint16([]byte{1, 0}) != 1 {
+		t.Skip("needs a little-endian host")
+	}
+	cases := map[string]string{
+		"0100007F":                         "127.0.0.1",
+		"00000000":                         "0.0.0.0",
+		"00000000000000000000000001000000": "::1",
+		"0000000000000000FFFF00000100007F": "127.0.0.1",
+		"zz":                               "<nil>",
+	}
+	for in, want := range cases {
+		if got := parseProcNetIP(in).String(); got != want {
+			t.Errorf("parseProcNetIP(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestValidateProfile(t *testing.T) {
+	others := []database.Profile{
+		{ID: 1, Name: "Existing", Type: "forward", Listen: ":1080"},
+	}
+
+	valid := database.Profile{Name: "Web", Type: "http", Listen: "127.0.0.1:8080"}
+	if verr := validateProfile(&valid, others); len(verr.Errors) != 0 {
+		t.Errorf("expected no errors, got %v", verr.Errors)
+	}
+
+	invalid := database.Profile{Name: "", Type: "vmess", Listen: "127.0.0.1:1080", Remote: "bad address", Username: "user"}
+	codes := map[string]string{}
+	for _, fe := range validateProfile(&invalid, others).Errors {
+		codes[fe.Field] = fe.Code
+	}
+	want := map[string]string{
+		"name":     CodeRequired,
+		"type":     CodeUnsupported,
+		"listen":   CodeDuplicate,
+		"remote":   CodeInvalid,
+		"password": CodeRequired,
+	}
+	for field, code := range want {
+		if codes[field] != code {
+			t.Errorf("field %s: got code %q, want %q", field, codes[field], code)
+		}
+	}
+
+	// TCP and UDP listeners can share a port number
+	udp := database.Profile{ID: 2, Name: "DNS", Type: "udp", Listen: ":1080", Remote: "1.1.1.1:53"}
+	if verr := validateProfile(&udp, others); len(verr.Errors) != 0 {
+		t.Errorf("udp listener clashed with a tcp one: %v", verr.Errors)
+	}
+	quic := database.Profile{Name: "QUIC", Type: "http", Listener: "quic", Listen: ":1080"}
+	if verr := validateProfile(&quic, append(others, udp)); len(verr.Errors) != 1 || verr.Errors[0].Code != CodeDuplicate {
+		t.Errorf("quic listener should clash with the udp one, got %v", verr.Errors)
+	}
+
+	// Updating a profile must not conflict with itself
+	self := others[0]
+	if verr := validateProfile(&self, others); len(verr.Errors) != 0 {
+		t.Errorf("expected no errors when validating against itself, got %v", verr.Errors)
+	}
+}
+
+func TestRenderChain(t *testing.T) {
+	chain := &database.Chain{
+		ID:   7,
+		Name: "corp",
+		Hops: []database.Hop{
+			{Addr: "proxy.corp:3128", Connector: "http", Dialer: "tcp", Username: "u", Password: "p"},
+			{Name: "jump", Addr: "jump.corp:22", Connector: "sshd", Dialer: "sshd", Username: "admin", Password: "secret"},
+			{Addr: "edge.corp:443", Connector: "socks5", Dialer: "tls", TLSServerName: "edge.corp", TLSSecure: true},
+		},
+	}
+
+	gc := renderChain(chain)
+	if gc.Name != "chain-7" || len(gc.Hops) != 3 {
+		t.Fatalf("unexpected chain %+v", gc)
+	}
+	if gc.Hops[0].Name != "hop-0" || gc.Hops[0].Nodes[0].Connector.Auth == nil {
+		t.Errorf("http hop should carry connector auth: %+v", gc.Hops[0].Nodes[0])
+	}
+	if gc.Hops[1].Nodes[0].Dialer.Auth == nil || gc.Hops[1].Nodes[0].Connector.Auth != nil {
+		t.Errorf("ssh hop should carry dialer auth: %+v", gc.Hops[1].Nodes[0])
+	}
+	if tls := gc.Hops[2].Nodes[0].Dialer.TLS; tls == nil || tls.ServerName != "edge.corp" || !tls.Secure {
+		t.Errorf("tls hop should carry TLS options: %+v", gc.Hops[2].Nodes[0].Dialer)
+	}
+
+	if verr := validateChain(chain); len(verr.Errors) != 0 {
+		t.Errorf("expected valid chain, got %v", verr.Errors)
+	}
+}
+
+func TestRenderForwarder(t *testing.T) {
+	single := &database.Profile{Remote: "10.0.0.1:80"}
+	if fw := renderForwarder(single); fw == nil || len(fw.Nodes) != 1 || fw.Selector != nil {
+		t.Errorf("single remote should render one node without selector: %+v", fw)
+	}
+
+	balanced := &database.Profile{
+		Remote: "10.0.0.1:80",
+		Nodes: []database.UpstreamNode{
+			{Addr: "10.0.0.1:80", Weight: 3},
+			{Name: "backup", Addr: "10.0.0.2:80"},
+		},
+		Selector: database.Selector{Strategy: "random", MaxFails: 2, FailTimeout: 30},
+	}
+	fw := renderForwarder(balanced)
+	if fw == nil || len(fw.Nodes) != 2 {
+		t.Fatalf("expected two nodes, got %+v", fw)
+	}
+	if fw.Nodes[0].Metadata["weight"] != 3 || fw.Nodes[1].Name != "backup" {
+		t.Errorf("unexpected nodes: %+v", fw.Nodes)
+	}
+	if fw.Selector == nil || fw.Selector.Strategy != "rand" || fw.Selector.MaxFails != 2 || fw.Selector.FailTimeout != "30s" {
+		t.Errorf("unexpected selector: %+v", fw.Selector)
+	}
+
+	if renderForwarder(&database.Profile{}) != nil {
+		t.Error("profile without upstreams should have no forwarder")
+	}
+}
+
+func TestResolveProtocols(t *testing.T) {
+	handler, listener, err := resolveProtocols(&database.Profile{Type: "forward"})
+	if err != nil || handler.Type != "socks5" || listener.Type != "tcp" {
+		t.Errorf("forward should resolve to socks5 over tcp, got %s/%s: %v", handler.Type, listener.Type, err)
+	}
+
+	handler, listener, err = resolveProtocols(&database.Profile{Type: "udp"})
+	if err != nil || handler.Type != "udp" || listener.Type != "udp" {
+		t.Errorf("udp should default to a udp listener, got %s/%s: %v", handler.Type, listener.Type, err)
+	}
+
+	// QUIC binds UDP but carries streams
+	handler, listener, err = resolveProtocols(&database.Profile{Type: "http", Listener: "quic"})
+	if err != nil || listener.Network != "udp" || listener.carried() != handler.Network {
+		t.Errorf("http over quic = %+v: %v", listener, err)
+	}
+
+	for _, p := range []database.Profile{
+		{Type: "bogus"},
+		{Type: "vmess"},
+		{Type: "http", Listener: "bogus"},
+		{Type: "udp", Listener: "tls"},
+		{Type: "udp", Listener: "kcp"},
+	} {
+		if _, _, err := resolveProtocols(&p); err == nil {
+			t.Errorf("expected error for type %q listener %q", p.Type, p.Listener)
+		}
+	}
+
+	verr := &ValidationError{}
+	validateProtocols(verr, &database.Profile{Type: "rtcp", Listener: "rtcp"})
+	fields := map[string]bool{}
+	for _, fe := range verr.Errors {
+		fields[fe.Field] = true
+	}
+	if !fields["remote"] || !fields["chain_id"] {
+		t.Errorf("rtcp listener should require remote and chain, got %v", verr.Errors)
+	}
+}
+
+func TestCheckListenAvailableUDP(t *testing.T) {
+	a := newTestAPI(t)
+
+	taken, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	defer taken.Close()
+
+	profile := &database.Profile{Name: "quic", Type: "http", Listener: "quic", Listen: taken.LocalAddr().String()}
+	if err := a.checkListenAvailable(profile); err == nil {
+		t.Error("a UDP port that is already bound should be reported for a quic listener")
+	}
+}
+
+func TestUpdateRunningGroupMemberListen(t *testing.T) {
+	a := newTestAPI(t)
+
+	id, err := a.AddProfile(database.Profile{Name: "web", Type: "http", Listen: "127.0.0.1:18190", Group: "edge"})
+	if err != nil {
+		t.Fatalf("AddProfile: %v", err)
+	}
+	profile, _ := a.db.GetProfile(id)
+	proc := newSupervisedProcess(profile, a.events)
+	proc.state = StateRunning
+	proc.group = &processGroup{name: "edge", members: map[int64]*supervisedProcess{id: proc}}
+	a.mutex.Lock()
+	a.processes[id] = proc
+	a.mutex.Unlock()
+
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer taken.Close()
+
+	// Moving a running member onto a taken port fails before the group reloads
+	moved := *profile
+	moved.Listen = taken.Addr().String()
+	if err := a.UpdateProfile(moved); err == nil {
+		t.Fatal("moving a running group member onto a bound port should fail")
+	}
+	if saved, _ := a.db.GetProfile(id); saved.Listen != profile.Listen {
+		t.Errorf("rejected listen was saved: %s", saved.Listen)
+	}
+	a.mutex.Lock()
+	listen := proc.listen
+	a.mutex.Unlock()
+	if listen != profile.Listen {
+		t.Errorf("running member moved to %s", listen)
+	}
+}
+
+func TestProfileTLS(t *testing.T) {
+	dir := t.TempDir()
+	files := &CertificateFiles{
+		CertFile: filepath.Join(dir, "test.crt"),
+		KeyFile:  filepath.Join(dir, "test.key"),
+		Hosts:    []string{"localhost", "127.0.0.1"},
+	}
+	if err := writeSelfSignedCert(files); err != nil {
+		t.Fatalf("writeSelfSignedCert: %v", err)
+	}
+
+	p := &database.Profile{
+		Type:     "http",
+		Listener: "tls",
+		TLS: database.TLSOptions{
+			CertFile:   files.CertFile,
+			KeyFile:    files.KeyFile,
+			CAFile:     files.CertFile,
+			ClientAuth: true,
+			MinVersion: "1.2",
+		},
+	}
+	verr := &ValidationError{}
+	validateProfileTLS(verr, p)
+	if len(verr.Errors) != 0 {
+		t.Errorf("expected valid TLS settings, got %v", verr.Errors)
+	}
+
+	gt := renderListenerTLS(p.TLS)
+	if gt == nil || gt.CAFile != files.CertFile || gt.Options == nil || gt.Options.MinVersion != "VersionTLS12" {
+		t.Errorf("unexpected tls block: %+v", gt)
+	}
+
+	bad := *p
+	bad.TLS.KeyFile = filepath.Join(dir, "missing.key")
+	bad.TLS.MinVersion = "1.4"
+	verr = &ValidationError{}
+	validateProfileTLS(verr, &bad)
+	if len(verr.Errors) != 2 {
+		t.Errorf("expected missing key and bad version errors, got %v", verr.Errors)
+	}
+
+	plain := &database.Profile{Type: "http", TLS: database.TLSOptions{MinVersion: "1.3"}}
+	verr = &ValidationError{}
+	validateProfileTLS(verr, plain)
+	if len(verr.Errors) != 1 || verr.Errors[0].Code != CodeUnsupported {
+		t.Errorf("tcp listener should reject TLS settings, got %v", verr.Errors)
+	}
+}
+
+func TestValidateRawConfig(t *testing.T) {
+	yamlBody := `
+services:
+  - name: web
+    addr: ":8443"
+    handler:
+      type: http
+      chain: upstream
+    listener:
+      type: tls
+chains:
+  - name: upstream
+    hops:
+      - name: hop-0
+        nodes:
+          - name: n0
+            addr: 10.0.0.1:1080
+            connector: {type: socks5}
+            dialer: {type: tcp}
+`
+	p := &database.Profile{Name: "raw", Type: ProfileTypeRaw, RawConfig: yamlBody}
+	if verr := validateProfile(p, nil); len(verr.Errors) != 0 {
+		t.Fatalf("expected valid raw config, got %v", verr.Errors)
+	}
+	if p.Listen != ":8443" {
+		t.Errorf("listen should come from the first service, got %q", p.Listen)
+	}
+
+	jsonBody := `{"services":[{"name":"s","addr":":1080","handler":{"type":"socks5","chain":"missing"}}],"bogus":{}}`
+	verr := &ValidationError{}
+	validateRawConfig(verr, jsonBody)
+	fields := map[string]bool{}
+	for _, fe := range verr.Errors {
+		fields[fe.Field] = true
+	}
+	if !fields["raw_config.bogus"] || !fields["raw_config.services[0].handler.chain"] {
+		t.Errorf("expected unknown section and missing chain errors, got %v", verr.Errors)
+	}
+
+	verr = &ValidationError{}
+	validateRawConfig(verr, "services: [")
+	if len(verr.Errors) != 1 || verr.Errors[0].Field != "raw_config" {
+		t.Errorf("expected a parse error, got %v", verr.Errors)
+	}
+}
+
+func TestBundleRoundTrip(t *testing.T) {
+	a := newTestAPI(t)
+
+	chain := database.Chain{Name: "egress", Hops: []database.Hop{
+		{Addr: "hop.example.com:1080", Connector: "socks5", Dialer: "tcp", Username: "hop", Password: "hop-secret"},
+	}}
+	if _, err := a.AddChain(chain); err != nil {
+		t.Fatalf("AddChain: %v", err)
+	}
+	chains, _ := a.GetChains()
+	profile := database.Profile{Name: "chained", Type: "http", Listen: ":18090", Username: "u", Password: "p-secret", ChainID: chains[0].ID, LogLevel: "debug"}
+	if _, err := a.AddProfile(profile); err != nil {
+		t.Fatalf("AddProfile: %v", err)
+	}
+	if err := a.SetGostLogLevel("warn"); err != nil {
+		t.Fatalf("SetGostLogLevel: %v", err)
+	}
+	reverse := database.Profile{Name: "reverse", Type: "rtcp", Listener: "rtcp", Listen: ":18092", Remote: "127.0.0.1:80", ChainID: chains[0].ID}
+	if _, err := a.AddProfile(reverse); err != nil {
+		t.Fatalf("AddProfile(reverse): %v", err)
+	}
+	raw := database.Profile{Name: "raw", Type: ProfileTypeRaw, RawConfig: `{"services":[{"name":"raw","addr":":18091","handler":{"type":"http","auth":{"username":"r","password":"raw-secret"}},"listener":{"type":"tcp"}}]}`}
+	if _, err := a.AddProfile(raw); err != nil {
+		t.Fatalf("AddProfile(raw): %v", err)
+	}
+
+	// Raw configs can't be redacted, so their profiles are left out
+	redacted, err := a.ExportBundle(ExportOptions{Secrets: SecretsRedact})
+	if err != nil {
+		t.Fatalf("ExportBundle(redact): %v", err)
+	}
+	if strings.Contains(redacted, "raw-secret") || !strings.Contains(redacted, `"omitted": [
+    "raw"
+  ]`) {
+		t.Errorf("redacted bundle = %s", redacted)
+	}
+
+	for _, format := range []string{BundleFormatJSON, BundleFormatYAML} {
+		data, err := a.ExportBundle(ExportOptions{Format: format, Secrets: SecretsEncrypt, Passphrase: "bundle-pass"})
+		if err != nil {
+			t.Fatalf("ExportBundle(%s): %v", format, err)
+		}
+		if strings.Contains(data, "p-secret") || strings.Contains(data, "hop-secret") || strings.Contains(data, "raw-secret") {
+			t.Fatalf("%s bundle contains plaintext secrets", format)
+		}
+		if _, err := a.ImportBundle(data, ImportOptions{Passphrase: "wrong", DryRun: true}); err == nil {
+			t.Errorf("%s: import with the wrong passphrase should fail", format)
+		}
+
+		if err := a.SwitchWorkspace("import-" + format); err != nil {
+			t.Fatalf("SwitchWorkspace: %v", err)
+		}
+
+		// A dry run reports the plan without writing anything
+		report, err := a.ImportBundle(data, ImportOptions{Passphrase: "bundle-pass", DryRun: true})
+		if err != nil {
+			t.Fatalf("dry run: %v", err)
+		}
+		actions := map[string]string{}
+		for _, item := range report.Items {
+			actions[item.Kind+"/"+item.Name] = item.Action
+		}
+		// reverse needs the chain the bundle creates
+		if actions["chain/egress"] != ImportCreate || actions["profile/chained"] != ImportCreate || actions["profile/reverse"] != ImportCreate || actions["profile/HTTP Proxy"] != ImportSkip {
+			t.Errorf("%s dry run actions = %v", format, actions)
+		}
+		if chains, _ := a.GetChains(); len(chains) != 0 {
+			t.Errorf("%s dry run created chains", format)
+		}
+
+		if _, err := a.ImportBundle(data, ImportOptions{Passphrase: "bundle-pass"}); err != nil {
+			t.Fatalf("import: %v", err)
+		}
+		profiles, _ := a.GetProfiles()
+		var imported *database.Profile
+		for i := range profiles {
+			if profiles[i].Name == "chained" {
+				imported = &profiles[i]
+			}
+		}
+		if imported == nil || imported.Password != "p-secret" || imported.ChainID == 0 || imported.LogLevel != "debug" {
+			t.Fatalf("%s: imported profile = %+v", format, imported)
+		}
+		if level := a.GetGostLogLevel(); level != "warn" {
+			t.Errorf("%s: imported workspace log level = %s", format, level)
+		}
+		if format == BundleFormatJSON {
+			changed := strings.Replace(data, `"log_level": "debug"`, `"log_level": "error"`, 1)
+			changed = strings.Replace(changed, `"chain": "egress"`, `"autostart": true, "chain": "egress"`, 1)
+			if _, err := a.ImportBundle(changed, ImportOptions{Passphrase: "bundle-pass", Conflict: ConflictOverwrite}); err != nil {
+				t.Fatalf("overwrite import: %v", err)
+			}
+			if p, _ := a.GetProfile(imported.ID); p == nil || p.LogLevel != "error" || !p.Autostart {
+				t.Errorf("overwritten profile = %+v", p)
+			}
+		}
+		rawImported := false
+		for _, p := range profiles {
+			rawImported = rawImported || p.Name == "raw" && strings.Contains(p.RawConfig, "raw-secret")
+		}
+		if !rawImported {
+			t.Errorf("%s: raw profile wasn't imported with its config", format)
+		}
+		importedChain, err := a.GetChain(imported.ChainID)
+		if err != nil || importedChain.Hops[0].Password != "hop-secret" {
+			t.Errorf("%s: imported chain = %+v (%v)", format, importedChain, err)
+		}
+
+		// Renaming avoids the name clash; the listen port still conflicts
+		report, err = a.ImportBundle(data, ImportOptions{Passphrase: "bundle-pass", Conflict: ConflictRename, DryRun: true})
+		if err != nil {
+			t.Fatalf("rename dry run: %v", err)
+		}
+		for _, item := range report.Items {
+			if item.Kind == "chain" && (item.Action != ImportRename || item.NewName != "egress (2)") {
+				t.Errorf("%s: chain rename = %+v", format, item)
+			}
+			if item.Kind == "profile" && item.Name == "chained" && item.Action != ImportError {
+				t.Errorf("%s: renamed profile should clash on its port, got %+v", format, item)
+			}
+		}
+
+		if err := a.SwitchWorkspace(database.DefaultWorkspace); err != nil {
+			t.Fatalf("SwitchWorkspace back: %v", err)
+		}
+	}
+
+	// Running profiles are updated live, but not moved to another group
+	profiles, _ := a.GetProfiles()
+	var running *database.Profile
+	for i := range profiles {
+		if profiles[i].Name == "chained" {
+			running = &profiles[i]
+		}
+	}
+	a.mutex.Lock()
+	a.processes[running.ID] = &supervisedProcess{profileID: running.ID, state: StateRunning}
+	a.mutex.Unlock()
+	defer func() {
+		a.mutex.Lock()
+		delete(a.processes, running.ID)
+		a.mutex.Unlock()
+	}()
+	data, err := a.ExportBundle(ExportOptions{})
+	if err != nil {
+		t.Fatalf("ExportBundle: %v", err)
+	}
+	for group, want := range map[string]string{"": ImportOverwrite, "edge": ImportError} {
+		moved := strings.Replace(data, `"name": "chained",`, fmt.Sprintf(`"name": "chained", "group": %q,`, group), 1)
+		report, err := a.ImportBundle(moved, ImportOptions{Conflict: ConflictOverwrite, DryRun: true})
+		if err != nil {
+			t.Fatalf("overwrite dry run: %v", err)
+		}
+		for _, item := range report.Items {
+			if item.Kind == "profile" && item.Name == "chained" && (item.Action != want || item.Message == "") {
+				t.Errorf("running profile in group %q: %+v", group, item)
+			}
+		}
+	}
+}
+
+func TestSwitchWorkspaceConcurrentReads(t *testing.T) {
+	a := newTestAPI(t)
+
+	// Readers keep going while the database is swapped under them
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				a.GetProfiles()
+				a.GetDatabaseInfo()
+				a.writeMetrics(io.Discard)
+			}
+		}()
+	}
+	for _, name := range []string{"staging", database.DefaultWorkspace, "staging"} {
+		if err := a.SwitchWorkspace(name); err != nil {
+			t.Errorf("SwitchWorkspace(%s): %v", name, err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if info, err := a.GetDatabaseInfo(); err != nil || info.Workspace != "staging" {
+		t.Errorf("GetDatabaseInfo = %+v, %v", info, err)
+	}
+}
+
+func TestResolveImportName(t *testing.T) {
+	taken := map[string]bool{"a": true, "a (2)": true}
+	cases := []struct {
+		name, conflict, action, target string
+	}{
+		{"b", ConflictSkip, ImportCreate, "b"},
+		{"a", ConflictSkip, ImportSkip, "a"},
+		{"a", ConflictOverwrite, ImportOverwrite, "a"},
+		{"a", ConflictRename, ImportRename, "a (3)"},
+	}
+	for _, c := range cases {
+		action, target := resolveImportName(c.name, taken, c.conflict)
+		if action != c.action || target != c.target {
+			t.Errorf("resolveImportName(%q, %s) = %s %q, want %s %q", c.name, c.conflict, action, target, c.action, c.target)
+		}
+	}
+}
+
+func TestParseGostConfig(t *testing.T) {
+	config := `
+services:
+  - name: web
+    addr: ":18443"
+    handler:
+      type: http
+      chain: upstream
+      auther: users
+      metadata:
+        probeResistance: code:404
+    listener:
+      type: tls
+      tls:
+        certFile: cert.pem
+        keyFile: key.pem
+  - name: fwd
+    addr: ":18053"
+    handler:
+      type: tcp
+    listener:
+      type: tcp
+    forwarder:
+      nodes:
+        - name: a
+          addr: 10.0.0.1:53
+          metadata:
+            weight: 2
+        - name: b
+          addr: 10.0.0.2:53
+      selector:
+        strategy: round
+        maxFails: 3
+        failTimeout: 30s
+chains:
+  - name: upstream
+    hops:
+      - name: hop-0
+authers:
+  - name: users
+    auths:
+      - username: alice
+        password: secret
+hops:
+  - name: hop-0
+    nodes:
+      - name: node-0
+        addr: proxy.example.com:1080
+        connector:
+          type: socks5
+          auth:
+            username: bob
+            password: pw
+        dialer:
+          type: tcp
+limiters:
+  - name: lim
+`
+	bundle, issues, err := parseGostConfig(config)
+	if err != nil {
+		t.Fatalf("parseGostConfig: %v", err)
+	}
+
+	if len(bundle.Chains) != 1 || len(bundle.Chains[0].Hops) != 1 {
+		t.Fatalf("chains = %+v", bundle.Chains)
+	}
+	hop := bundle.Chains[0].Hops[0]
+	if hop.Addr != "proxy.example.com:1080" || hop.Connector != "socks5" || hop.Username != "bob" {
+		t.Errorf("hop = %+v", hop)
+	}
+
+	web, fwd := bundle.Profiles[0], bundle.Profiles[1]
+	if web.Type != "http" || web.Listener != "tls" || web.Chain != "upstream" || web.Username != "alice" || web.TLS == nil || web.TLS.CertFile != "cert.pem" {
+		t.Errorf("web profile = %+v", web)
+	}
+	if fwd.Listener != "" || len(fwd.Nodes) != 2 || fwd.Nodes[0].Weight != 2 || fwd.Selector == nil || fwd.Selector.FailTimeout != 30 {
+		t.Errorf("fwd profile = %+v", fwd)
+	}
+
+	paths := map[string]bool{}
+	for _, issue := range issues {
+		paths[issue.Path] = true
+	}
+	if !paths["services[0].handler.metadata"] || !paths["limiters"] || len(issues) != 2 {
+		t.Errorf("unmapped = %+v", issues)
+	}
+}
+
+func TestParseGostArgs(t *testing.T) {
+	bundle, issues, err := parseGostArgs(`gost -L "http://user:p%40ss@:18080" -L tcp://:12222/10.0.0.5:22 -L=ss+tls://aes-128-gcm:pw@:18338?cert=c.pem&key=k.pem&foo=1 -F socks5+wss://hop.example.com:443?serverName=hop.example.com -D`)
+	if err != nil {
+		t.Fatalf("parseGostArgs: %v", err)
+	}
+
+	if len(bundle.Chains) != 1 {
+		t.Fatalf("chains = %+v", bundle.Chains)
+	}
+	hop := bundle.Chains[0].Hops[0]
+	if hop.Connector != "socks5" || hop.Dialer != "wss" || hop.TLSServerName != "hop.example.com" {
+		t.Errorf("hop = %+v", hop)
+	}
+
+	if len(bundle.Profiles) != 3 {
+		t.Fatalf("profiles = %+v", bundle.Profiles)
+	}
+	httpProfile, tcpProfile, ssProfile := bundle.Profiles[0], bundle.Profiles[1], bundle.Profiles[2]
+	if httpProfile.Type != "http" || httpProfile.Listen != ":18080" || httpProfile.Password != "p@ss" || httpProfile.Chain != bundle.Chains[0].Name {
+		t.Errorf("http profile = %+v", httpProfile)
+	}
+	if tcpProfile.Type != "tcp" || tcpProfile.Remote != "10.0.0.5:22" || tcpProfile.Listener != "" {
+		t.Errorf("tcp profile = %+v", tcpProfile)
+	}
+	if ssProfile.Type != "ss" || ssProfile.Listener != "tls" || ssProfile.Username != "aes-128-gcm" || ssProfile.TLS == nil || ssProfile.TLS.KeyFile != "k.pem" {
+		t.Errorf("ss profile = %+v", ssProfile)
+	}
+
+	if len(issues) != 2 || issues[0].Path != "-D" || issues[1].Path != "-L[2]?foo" {
+		t.Errorf("unmapped = %+v", issues)
+	}
+}
+
+func TestExportDeployment(t *testing.T) {
+	a := newTestAPI(t)
+
+	certDir := t.TempDir()
+	ca := &CertificateFiles{CertFile: filepath.Join(certDir, "hop-ca.crt"), KeyFile: filepath.Join(certDir, "hop-ca.key"), Hosts: []string{"hop.example.com"}}
+	if err := writeSelfSignedCert(ca); err != nil {
+		t.Fatalf("writeSelfSignedCert: %v", err)
+	}
+	chainID, err := a.AddChain(database.Chain{Name: "egress", Hops: []database.Hop{
+		{Addr: "hop.example.com:443", Connector: "socks5", Dialer: "tls", TLSCAFile: ca.CertFile},
+	}})
+	if err != nil {
+		t.Fatalf("AddChain: %v", err)
+	}
+	first, err := a.AddProfile(database.Profile{Name: "Web Proxy", Type: "http", Listen: ":18091", Username: "u", Password: "p-secret", ChainID: chainID})
+	if err != nil {
+		t.Fatalf("AddProfile: %v", err)
+	}
+	second, err := a.AddProfile(database.Profile{Name: "ssh", Type: "tcp", Listen: "127.0.0.1:12223", Remote: "10.0.0.5:22", ChainID: chainID})
+	if err != nil {
+		t.Fatalf("AddProfile: %v", err)
+	}
+
+	dir := t.TempDir()
+	deployment, err := a.ExportDeployment([]int64{first, second}, DeployOptions{Target: DeployTargetSystemd, Name: "edge", OutputDir: dir})
+	if err != nil {
+		t.Fatalf("ExportDeployment: %v", err)
+	}
+
+	cfg, err := parseRawConfig(deployment.Config.Content)
+	if err != nil {
+		t.Fatalf("exported config does not parse: %v", err)
+	}
+	if services, _ := cfg["services"].([]interface{}); len(services) != 2 {
+		t.Errorf("services = %v", cfg["services"])
+	}
+	if chains, _ := cfg["chains"].([]interface{}); len(chains) != 1 {
+		t.Errorf("shared chain should be exported once, chains = %v", cfg["chains"])
+	}
+	if _, ok := cfg["log"]; ok {
+		t.Error("exported config should not carry Gostly's log settings")
+	}
+
+	if deployment.Unit == nil || deployment.Unit.Name != "edge.service" || !strings.Contains(deployment.Unit.Content, "ExecStart=/usr/local/bin/gost -C /etc/gost/edge.yaml") {
+		t.Errorf("unit = %+v", deployment.Unit)
+	}
+	if len(deployment.Warnings) != 3 {
+		t.Errorf("warnings = %q", deployment.Warnings)
+	}
+	info, err := os.Stat(filepath.Join(dir, "edge.yaml"))
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("written config = %v, %v", info, err)
+	}
+
+	compose, err := a.ExportDeployment([]int64{first}, DeployOptions{Format: BundleFormatJSON, Target: DeployTargetCompose})
+	if err != nil {
+		t.Fatalf("ExportDeployment(compose): %v", err)
+	}
+	if compose.Name != "web-proxy" || compose.Config.Name != "web-proxy.json" || !strings.Contains(compose.Unit.Content, fmt.Sprintf("%q", ca.CertFile+":"+ca.CertFile+":ro")) {
+		t.Errorf("compose = %+v, %s", compose, compose.Unit.Content)
+	}
+
+	if _, err := a.ExportDeployment([]int64{first}, DeployOptions{Target: "upstart"}); err == nil {
+		t.Error("unknown target should be rejected")
+	}
+}
+
+func TestBuildGroupConfig(t *testing.T) {
+	a := newTestAPI(t)
+
+	if _, err := a.AddProfile(database.Profile{Name: "bad", Type: "http", Listen: ":18095", Group: "-edge"}); err == nil {
+		t.Error("invalid group name should be rejected")
+	}
+
+	g := &processGroup{name: "edge", members: map[int64]*supervisedProcess{}}
+	for i, name := range []string{"web", "ssh"} {
+		id, err := a.AddProfile(database.Profile{Name: name, Type: "http", Listen: fmt.Sprintf(":%d", 18096+i), Group: "edge"})
+		if err != nil {
+			t.Fatalf("AddProfile: %v", err)
+		}
+		g.members[id] = &supervisedProcess{profileID: id, profileName: name}
+	}
+
+	config, services, profiles, err := a.buildGroupConfig(g)
+	if err != nil {
+		t.Fatalf("buildGroupConfig: %v", err)
+	}
+	if len(profiles) != 2 || len(services) != 2 || services["web"] != profiles[0].ID || services["ssh"] != profiles[1].ID {
+		t.Errorf("services = %v", services)
+	}
+	if list, _ := config["services"].([]interface{}); len(list) != 2 {
+		t.Errorf("config services = %v", config["services"])
+	}
+	if config["log"] == nil {
+		t.Error("group config should carry the log settings Gostly parses")
+	}
+
+	if got := parseGostLog(`{"level":"info","msg":"listening on [::]:18096/tcp","service":"web"}`).Fields["service"]; got != "web" {
+		t.Errorf("service = %q", got)
+	}
+	if got := parseGostLog("plain text").Fields["service"]; got != "" {
+		t.Errorf("service of plain text = %q", got)
+	}
+}
+
+func TestGostLogLevels(t *testing.T) {
+	a := newTestAPI(t)
+
+	if got := a.GetGostLogLevel(); got != "info" {
+		t.Errorf("default level = %q", got)
+	}
+	if err := a.SetGostLogLevel("verbose"); err == nil {
+		t.Error("unknown level should be rejected")
+	}
+	if err := a.SetGostLogLevel("DEBUG"); err != nil || a.GetGostLogLevel() != "debug" {
+		t.Fatalf("SetGostLogLevel: %v, level %q", err, a.GetGostLogLevel())
+	}
+
+	g := &processGroup{name: "edge", members: map[int64]*supervisedProcess{}}
+	var ids []int64
+	for i, name := range []string{"web", "ssh"} {
+		id, err := a.AddProfile(database.Profile{Name: name, Type: "http", Listen: fmt.Sprintf(":%d", 18120+i), Group: "edge"})
+		if err != nil {
+			t.Fatalf("AddProfile: %v", err)
+		}
+		g.members[id] = &supervisedProcess{profileID: id, profileName: name}
+		ids = append(ids, id)
+	}
+	if err := a.SetProfileGostLogLevel(ids[1], "warn"); err != nil {
+		t.Fatalf("SetProfileGostLogLevel: %v", err)
+	}
+	if err := a.SetProfileGostLogLevel(ids[1], "loud"); err == nil {
+		t.Error("unknown profile level should be rejected")
+	}
+
+	// A profile's own process logs at its level
+	ssh, _ := a.db.GetProfile(ids[1])
+	path, err := a.createGostConfigWithLogging(ssh, nil, nil)
+	if err != nil {
+		t.Fatalf("createGostConfigWithLogging: %v", err)
+	}
+	defer os.Remove(path)
+	data, _ := os.ReadFile(path)
+	var single GostConfig
+	if err := json.Unmarshal(data, &single); err != nil {
+		t.Fatalf("config: %v", err)
+	}
+	if single.Log.Level != "warn" || len(single.Loggers) != 1 || single.Loggers[0].Log.Level != "warn" || single.Services[0].Logger != single.Loggers[0].Name {
+		t.Errorf("single config logging = %s", data)
+	}
+
+	// In a group each member's services log through the member's logger
+	config, _, _, err := a.buildGroupConfig(g)
+	if err != nil {
+		t.Fatalf("buildGroupConfig: %v", err)
+	}
+	levels := map[string]string{}
+	for _, logger := range config["loggers"].([]interface{}) {
+		l := logger.(GostLogger)
+		levels[l.Name] = l.Log.Level
+	}
+	for _, item := range config["services"].([]interface{}) {
+		service := item.(map[string]interface{})
+		levels[service["name"].(string)] = levels[service["logger"].(string)]
+	}
+	if levels["web"] != "debug" || levels["ssh"] != "warn" || config["log"].(*GostLogConfig).Level != "debug" {
+		t.Errorf("group levels = %v", levels)
+	}
+
+	// Clearing the override goes back to the default
+	if err := a.SetProfileGostLogLevel(ids[1], ""); err != nil {
+		t.Fatalf("SetProfileGostLogLevel: %v", err)
+	}
+	if ssh, _ := a.db.GetProfile(ids[1]); ssh.LogLevel != "" || a.gostLogLevelFor(ssh) != "debug" {
+		t.Errorf("level after reset = %q", a.gostLogLevelFor(ssh))
+	}
+}
+
+func TestStopProfile(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("needs sh")
+	}
+	a := newTestAPI(t)
+
+	if got := a.GetStopTimeout(); got != int(defaultStopTimeout/time.Second) {
+		t.Errorf("default stop timeout = %d", got)
+	}
+	if err := a.SetStopTimeout(0); err == nil {
+		t.Error("zero stop timeout should be rejected")
+	}
+	if err := a.SetStopTimeout(1); err != nil {
+		t.Fatalf("SetStopTimeout: %v", err)
+	}
+
+	// Stand in for a supervisor running a process that handles SIGTERM with script
+	port := 18180
+	start := func(name, script string) int64 {
+		port++
+		id, err := a.AddProfile(database.Profile{Name: name, Type: "http", Listen: fmt.Sprintf(":%d", port)})
+		if err != nil {
+			t.Fatalf("AddProfile: %v", err)
+		}
+		profile, _ := a.db.GetProfile(id)
+		proc := newSupervisedProcess(profile, a.events)
+		proc.cmd = exec.Command("sh", "-c", script+"; echo ready; while :; do sleep 0.05; done")
+		stdout, _ := proc.cmd.StdoutPipe()
+		if err := proc.cmd.Start(); err != nil {
+			t.Fatalf("start: %v", err)
+		}
+		stdout.Read(make([]byte, 8)) // wait until the trap is set
+		proc.state = StateRunning
+		a.mutex.Lock()
+		a.processes[id] = proc
+		a.mutex.Unlock()
+		go func() {
+			exitCode := waitExitCode(proc.cmd)
+			a.mutex.Lock()
+			proc.lastExitCode = exitCode
+			a.mutex.Unlock()
+			close(proc.done)
+		}()
+		return id
+	}
+
+	if err := a.StopProfile(start("clean", "trap 'exit 0' TERM")); err != nil {
+		t.Errorf("clean stop: %v", err)
+	}
+	if err := a.StopProfile(start("failing", "trap 'exit 3' TERM")); err == nil || !strings.Contains(err.Error(), "code 3") {
+		t.Errorf("failing stop: %v", err)
+	}
+	if err := a.StopProfile(start("stuck", "trap '' TERM")); err == nil || !strings.Contains(err.Error(), "killed") {
+		t.Errorf("stuck stop: %v", err)
+	}
+
+	// The timeout is kept with the workspace
+	a.Close()
+	a = openTestAPI(t)
+	if got := a.GetStopTimeout(); got != 1 {
+		t.Errorf("stop timeout after reopening = %d", got)
+	}
+}
+
+func TestUpdateViaGostAPI(t *testing.T) {
+	a := newTestAPI(t)
+
+	var requests []string
+	var service GostService
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "gostly" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"code":40100,"msg":"Unauthorized"}`))
+			return
+		}
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/api/config/services/") {
+			json.NewDecoder(r.Body).Decode(&service)
+		}
+		w.Write([]byte(`{"msg":"OK"}`))
+	}))
+	defer server.Close()
+
+	chainID, err := a.AddChain(database.Chain{Name: "egress", Hops: []database.Hop{{Addr: "hop.example.com:1080", Connector: "socks5", Dialer: "tcp"}}})
+	if err != nil {
+		t.Fatalf("AddChain: %v", err)
+	}
+	old := database.Profile{Name: "live", Type: "http", Listen: ":18093", ChainID: chainID}
+	if old.ID, err = a.AddProfile(old); err != nil {
+		t.Fatalf("AddProfile: %v", err)
+	}
+
+	client := &gostAPIClient{addr: strings.TrimPrefix(server.URL, "http://"), username: "gostly", password: "secret", http: server.Client()}
+	proc := &supervisedProcess{profileID: old.ID, profileName: old.Name, state: StateRunning, api: client}
+
+	updated := old
+	updated.Listen = ":18094"
+	updated.ChainID = 0
+	if err := a.updateViaGostAPI(proc, &old, &updated); err != nil {
+		t.Fatalf("updateViaGostAPI: %v", err)
+	}
+	want := []string{"PUT /api/config/services/live", fmt.Sprintf("DELETE /api/config/chains/chain-%d", chainID)}
+	if strings.Join(requests, ", ") != strings.Join(want, ", ") {
+		t.Errorf("requests = %q, want %q", requests, want)
+	}
+	if service.Addr != ":18094" || service.Handler.Chain != "" || proc.listen != ":18094" {
+		t.Errorf("service = %+v, listen = %s", service, proc.listen)
+	}
+
+	// Renames can't be swapped in place
+	requests = nil
+	renamed := updated
+	renamed.Name = "renamed"
+	if err := a.updateViaGostAPI(proc, &updated, &renamed); err == nil || len(requests) != 0 {
+		t.Errorf("rename should fall back to a restart, err = %v, requests = %q", err, requests)
+	}
+
+	client.password = "wrong"
+	err = client.updateService(GostService{Name: "live"})
+	if apiErr, ok := err.(*gostAPIError); !ok || apiErr.Status != http.StatusUnauthorized || apiErr.Message != "Unauthorized" {
+		t.Errorf("error = %v", err)
+	}
+}
+
+func TestCollectStats(t *testing.T) {
+	a := newTestAPI(t)
+
+	var mu sync.Mutex
+	bytesIn := 1000
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "gostly" || pass != "secret" || r.URL.Path != "/metrics" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(w, `# HELP gost_service_transfer_input_bytes_total Total service input data transfer size in bytes
+# TYPE gost_service_transfer_input_bytes_total counter
+gost_service_transfer_input_bytes_total{host="box",service="solo"} %d
+gost_service_transfer_input_bytes_total{host="box",service="grouped"} 50
+gost_service_transfer_output_bytes_total{host="box",service="solo"} 4.2e+03
+gost_service_requests_total{host="box",service="solo"} 7
+gost_service_requests_in_flight{host="box",service="solo"} 2
+gost_service_handler_errors_total{host="box",service="solo"} 1
+gost_service_requests_total{host="box",service="stranger"} 99
+go_goroutines 12
+`, bytesIn)
+	}))
+	defer server.Close()
+
+	client := &gostMetricsClient{addr: strings.TrimPrefix(server.URL, "http://"), username: "gostly", password: "secret", http: server.Client()}
+	services, err := client.scrape()
+	if err != nil {
+		t.Fatalf("scrape: %v", err)
+	}
+	if c := services["solo"]; c == nil || c.bytesIn != 1000 || c.bytesOut != 4200 || c.requests != 7 || c.inFlight != 2 || c.errors != 1 {
+		t.Fatalf("solo counters = %+v", c)
+	}
+
+	// A solo process owns every service, a group only its members'
+	a.mutex.Lock()
+	a.processes[1] = &supervisedProcess{profileID: 1, state: StateRunning, metrics: client}
+	a.groups["edge"] = &processGroup{name: "edge", cmd: &exec.Cmd{}, metrics: client, services: map[string]int64{"grouped": 2}}
+	a.mutex.Unlock()
+
+	a.collectStats()
+	mu.Lock()
+	bytesIn = 1500
+	mu.Unlock()
+	a.collectStats()
+
+	solo := a.GetProfileStats(1)
+	if solo.BytesIn != 1550 || solo.BytesOut != 4200 || solo.TotalConnections != 106 || solo.ActiveConnections != 2 || solo.Errors != 1 {
+		t.Errorf("solo stats = %+v", solo)
+	}
+	if solo.InRate <= 0 || solo.OutRate != 0 {
+		t.Errorf("solo rates = %v in, %v out", solo.InRate, solo.OutRate)
+	}
+	if grouped := a.GetProfileStats(2); grouped.BytesIn != 50 || grouped.TotalConnections != 0 {
+		t.Errorf("grouped stats = %+v", grouped)
+	}
+	if history := a.GetProfileStatsHistory(1); len(history) != 2 {
+		t.Errorf("history has %d samples, want 2", len(history))
+	}
+
+	// A restarted process starts counting from zero again
+	restarted := *client
+	a.mutex.Lock()
+	a.processes[1].metrics = &restarted
+	delete(a.groups, "edge")
+	a.mutex.Unlock()
+	mu.Lock()
+	bytesIn = 100
+	mu.Unlock()
+	a.collectStats()
+
+	if solo := a.GetProfileStats(1); solo.BytesIn != 1700 {
+		t.Errorf("bytes in after restart = %d, want 1700", solo.BytesIn)
+	}
+	if grouped := a.GetProfileStats(2); grouped.BytesIn != 50 || grouped.InRate != 0 {
+		t.Errorf("stopped group stats = %+v", grouped)
+	}
+	if all := a.GetAllProfileStats(); len(all) != 2 || all[0].ProfileID != 1 {
+		t.Errorf("all stats = %+v", all)
+	}
+
+	a.mutex.Lock()
+	delete(a.processes, 1)
+	a.mutex.Unlock()
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	a := newTestAPI(t)
+
+	id, err := a.AddProfile(database.Profile{Name: `web "edge"`, Type: "http", Listen: ":18095"})
+	if err != nil {
+		t.Fatalf("AddProfile: %v", err)
+	}
+	a.routerMetrics.observe("app.local", http.StatusOK, 30*time.Millisecond)
+	a.routerMetrics.observe("app.local", http.StatusOK, 2*time.Second)
+	a.routerMetrics.observe("app.local", http.StatusBadGateway, time.Millisecond)
+
+	// GOST detection runs in the background while scrapes come in
+	detected := make(chan struct{})
+	go func() {
+		a.checkGostAvailability()
+		close(detected)
+	}()
+	a.writeMetrics(io.Discard)
+	<-detected
+
+	if err := a.StartMetricsServer("127.0.0.1:0"); err != nil {
+		t.Fatalf("StartMetricsServer: %v", err)
+	}
+	if err := a.StartMetricsServer("127.0.0.1:0"); err == nil {
+		t.Error("second StartMetricsServer should fail")
+	}
+	running, addr := a.IsMetricsServerRunning()
+	if !running {
+		t.Fatal("metrics endpoint not running")
+	}
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	for _, want := range []string{
+		fmt.Sprintf(`gostly_profile_state{id="%d",profile="web \"edge\"",state="stopped"} 1`, id),
+		fmt.Sprintf(`gostly_profile_state{id="%d",profile="web \"edge\"",state="running"} 0`, id),
+		fmt.Sprintf(`gostly_profile_restarts{id="%d",profile="web \"edge\""} 0`, id),
+		`gostly_host_router_running 0`,
+		`gostly_host_router_requests_total{host="app.local",code="200"} 2`,
+		`gostly_host_router_requests_total{host="app.local",code="502"} 1`,
+		`gostly_host_router_request_duration_seconds_bucket{host="app.local",le="0.05"} 2`,
+		`gostly_host_router_request_duration_seconds_bucket{host="app.local",le="+Inf"} 3`,
+		`gostly_host_router_request_duration_seconds_count{host="app.local"} 3`,
+		`gostly_log_messages_total{level="INFO"}`,
+		`gostly_log_messages_dropped_total 0`,
+		`# TYPE gostly_gost_available gauge`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+
+	if err := a.StopMetricsServer(); err != nil {
+		t.Fatalf("StopMetricsServer: %v", err)
+	}
+	if running, _ := a.IsMetricsServerRunning(); running {
+		t.Error("metrics endpoint still running")
+	}
+}
+
+func TestEventBus(t *testing.T) {
+	// No database or background startup work, so only the events below are published
+	a := &API{events: newEventBus(), logCounts: make(map[string]int64)}
+
+	sub := a.Subscribe(16)
+	a.addLog("WARN", "api", "something happened", nil, "")
+	a.addTimelineEvent("system", "Tested", "details", "success", "admin", "", "")
+	proc := newSupervisedProcess(&database.Profile{ID: 7, Name: "web"}, a.events)
+	a.mutex.Lock()
+	proc.setState(StateStarting, "")
+	a.mutex.Unlock()
+
+	batch, ok := sub.NextBatch(10, 50*time.Millisecond)
+	if !ok || len(batch) != 3 {
+		t.Fatalf("batch = %+v, ok = %v", batch, ok)
+	}
+	if entry, ok := batch[0].Data.(LogEntry); batch[0].Topic != TopicLog || !ok || entry.Message != "something happened" {
+		t.Errorf("first event = %+v", batch[0])
+	}
+	if batch[1].Topic != TopicTimeline {
+		t.Errorf("second event = %+v", batch[1])
+	}
+	if state, ok := batch[2].Data.(ProfileStateEvent); batch[2].Topic != TopicProfileState || !ok || state.ProfileID != 7 || state.State != "starting" {
+		t.Errorf("third event = %+v", batch[2])
+	}
+
+	// A full buffer drops events instead of blocking the publisher
+	for i := 0; i < 20; i++ {
+		a.addLog("INFO", "api", fmt.Sprintf("line %d", i), nil, "")
+	}
+	if sub.Dropped() != 4 {
+		t.Errorf("dropped = %d, want 4", sub.Dropped())
+	}
+	if batch, _ := sub.NextBatch(10, time.Second); len(batch) != 10 {
+		t.Errorf("batch of %d events, want it capped at 10", len(batch))
+	}
+
+	sub.Unsubscribe()
+	sub.Unsubscribe()
+	for range sub.Events() {
+	}
+	if _, ok := sub.NextBatch(10, time.Millisecond); ok {
+		t.Error("NextBatch should report a closed subscription")
+	}
+}
+
+func TestQueryLogs(t *testing.T) {
+	a := newTestAPI(t)
+
+	web := int64(42)
+	for i := 0; i < 5; i++ {
+		a.addLog("INFO", "gost", fmt.Sprintf("served request %d", i), &web, "web")
+	}
+	a.addLog("ERROR", "gost", "dial upstream: connection refused", &web, "web")
+
+	page, err := a.QueryLogs(LogQuery{ProfileID: &web, Limit: 4})
+	if err != nil {
+		t.Fatalf("QueryLogs: %v", err)
+	}
+	if len(page.Entries) != 4 || page.Entries[0].Level != "ERROR" || page.NextCursor == "" {
+		t.Fatalf("first page = %+v", page)
+	}
+	next, err := a.QueryLogs(LogQuery{ProfileID: &web, Limit: 4, Cursor: page.NextCursor})
+	if err != nil {
+		t.Fatalf("QueryLogs: %v", err)
+	}
+	if len(next.Entries) != 2 || next.Entries[1].Message != "served request 0" || next.NextCursor != "" {
+		t.Errorf("second page = %+v", next)
+	}
+	if page, _ := a.QueryLogs(LogQuery{Levels: []string{"error"}, Search: "REFUSED"}); len(page.Entries) != 1 {
+		t.Errorf("search found %+v", page.Entries)
+	}
+	a.addGostLog(parseGostLog(`{"level":"info","msg":"10.0.0.5:50312 <> example.com:443","remote":"10.0.0.5:50312","dst":"example.com:443"}`), &web, "web")
+	if page, _ := a.QueryLogs(LogQuery{Dst: "example.com", Src: "10.0.0.5"}); len(page.Entries) != 1 || page.Entries[0].Fields["dst"] != "example.com:443" {
+		t.Errorf("address filter found %+v", page.Entries)
+	}
+	if page, _ := a.QueryLogs(LogQuery{Dst: "example.org"}); len(page.Entries) != 0 {
+		t.Errorf("address filter for another host found %+v", page.Entries)
+	}
+	future := time.Now().Add(time.Hour).Format(time.RFC3339)
+	if page, _ := a.QueryLogs(LogQuery{Since: future}); len(page.Entries) != 0 {
+		t.Errorf("since %s found %d entries", future, len(page.Entries))
+	}
+	if _, err := a.QueryLogs(LogQuery{Cursor: "bogus"}); err == nil {
+		t.Error("bogus cursor should be rejected")
+	}
+	if err := a.SetLogRetention(LogRetention{MaxEntries: -1}); err == nil {
+		t.Error("negative retention should be rejected")
+	}
+	if err := a.SetLogRetention(LogRetention{MaxAgeDays: 30}); err != nil {
+		t.Fatalf("SetLogRetention: %v", err)
+	}
+
+	// Logs and the retention limits survive a restart
+	a.Close()
+	a = openTestAPI(t)
+	if page, _ := a.QueryLogs(LogQuery{ProfileID: &web}); len(page.Entries) != 7 {
+		t.Errorf("after restart found %d entries, want 7", len(page.Entries))
+	}
+	recent, _ := a.GetRecentLogs(1000)
+	found := false
+	for _, entry := range recent {
+		found = found || entry.Message == "dial upstream: connection refused"
+	}
+	if !found {
+		t.Error("recent logs weren't reloaded")
+	}
+	if got := a.GetLogRetention(); got != (LogRetention{MaxAgeDays: 30}) {
+		t.Errorf("retention after restart = %+v", got)
+	}
+
+	// Clearing the view keeps the history, purging deletes it
+	if err := a.ClearLogs(); err != nil {
+		t.Fatalf("ClearLogs: %v", err)
+	}
+	if recent, _ := a.GetRecentLogs(1000); len(recent) != 0 {
+		t.Errorf("ClearLogs left %d entries in memory", len(recent))
+	}
+	if page, _ := a.QueryLogs(LogQuery{ProfileID: &web}); len(page.Entries) != 7 {
+		t.Errorf("ClearLogs removed history, %d entries left", len(page.Entries))
+	}
+	if err := a.PurgeLogHistory(); err != nil {
+		t.Fatalf("PurgeLogHistory: %v", err)
+	}
+	if page, _ := a.QueryLogs(LogQuery{ProfileID: &web}); len(page.Entries) != 0 {
+		t.Errorf("PurgeLogHistory left %d entries", len(page.Entries))
+	}
+}
+
+func TestTailCursors(t *testing.T) {
+	a := newTestAPI(t)
+
+	start, err := a.GetLogsSince("", 1)
+	if err != nil || len(start.Entries) != 1 {
+		t.Fatalf("GetLogsSince without a cursor = %+v, %v", start, err)
+	}
+
+	// Log more than memory holds so the tail has to read back from the database
+	const lines = 1500
+	for i := 0; i < lines; i++ {
+		a.addLog("DEBUG", "tail", fmt.Sprintf("line %d", i), nil, "")
+	}
+	var got []string
+	lastID := start.Entries[0].ID
+	cursor := start.NextCursor
+	for {
+		tail, err := a.GetLogsSince(cursor, 300)
+		if err != nil {
+			t.Fatalf("GetLogsSince(%q): %v", cursor, err)
+		}
+		if tail.Skipped != 0 {
+			t.Errorf("GetLogsSince(%q) skipped %d entries", cursor, tail.Skipped)
+		}
+		for _, entry := range tail.Entries {
+			if entry.ID <= lastID {
+				t.Fatalf("entry %d after %d", entry.ID, lastID)
+			}
+			lastID = entry.ID
+			if entry.Source == "tail" {
+				got = append(got, entry.Message)
+			}
+		}
+		cursor = tail.NextCursor
+		if !tail.HasMore {
+			break
+		}
+	}
+	if len(got) != lines || got[0] != "line 0" || got[lines-1] != fmt.Sprintf("line %d", lines-1) {
+		t.Fatalf("tailed %d lines, want %d", len(got), lines)
+	}
+	caughtUp, _ := a.GetLogsSince(cursor, 10)
+	for _, entry := range caughtUp.Entries {
+		if entry.Source == "tail" {
+			t.Errorf("tail repeated %q", entry.Message)
+		}
+	}
+	if _, err := a.GetLogsSince("-1", 10); err == nil {
+		t.Error("negative cursor should be rejected")
+	}
+
+	// Entries that are gone from both memory and the database are counted
+	a.flushLogs()
+	if err := a.currentDB().ClearLogs(); err != nil {
+		t.Fatalf("ClearLogs: %v", err)
+	}
+	gap, _ := a.GetLogsSince(start.NextCursor, 10)
+	if len(gap.Entries) == 0 || gap.Skipped == 0 || gap.Skipped != gap.Entries[0].ID-start.Entries[0].ID-1 {
+		t.Errorf("tail over missing entries = %d entries from %d, skipped %d", len(gap.Entries), gap.Entries[0].ID, gap.Skipped)
+	}
+
+	// The sequence carries on across a restart
+	a.Close()
+	a = openTestAPI(t)
+	a.addLog("INFO", "tail", "after restart", nil, "")
+	tail, _ := a.GetLogsSince(strconv.FormatInt(lastID, 10), 1000)
+	if n := len(tail.Entries); n == 0 || tail.Entries[n-1].Message != "after restart" {
+		t.Errorf("tail after restart = %+v", tail.Entries)
+	}
+
+	for i := 0; i < 4; i++ {
+		a.addTimelineEvent("system", fmt.Sprintf("Event %d", i), "", "success", "system", "1s", "")
+	}
+	recent, err := a.GetTimelineEventsSince("", 2)
+	if err != nil || len(recent.Events) != 2 || recent.Events[1].Action != "Event 3" || recent.HasMore {
+		t.Errorf("newest timeline events = %+v, %v", recent, err)
+	}
+	all, _ := a.GetTimelineEventsSince("0", 3)
+	if len(all.Events) != 3 || !all.HasMore {
+		t.Errorf("first timeline events = %+v", all)
+	}
+	rest, _ := a.GetTimelineEventsSince(all.NextCursor, 10)
+	if len(rest.Events) != 2 || rest.Events[1].Action != "Event 3" || rest.NextCursor != recent.NextCursor {
+		t.Errorf("remaining timeline events = %+v", rest)
+	}
+	if none, _ := a.GetTimelineEventsSince(rest.NextCursor, 10); len(none.Events) != 0 || none.NextCursor != rest.NextCursor {
+		t.Errorf("caught-up timeline tail = %+v", none)
+	}
+}
+
+func TestParseGostLog(t *testing.T) {
+	open := parseGostLog(`{"dst":"example.com:443","handler":"http","kind":"handler","level":"info","local":"127.0.0.1:8080","msg":"10.0.0.5:50312 <> example.com:443","remote":"10.0.0.5:50312","service":"web","sid":"abc","time":"2026-01-02T03:04:05.000Z"}`)
+	if open.Level != "INFO" || open.Message != "10.0.0.5:50312 <> example.com:443" || open.Src != "10.0.0.5:50312" || open.Dst != "example.com:443" {
+		t.Errorf("open = %+v", open)
+	}
+	if open.Fields["service"] != "web" || open.Fields["handler"] != "http" || open.Fields["msg"] != "" || open.Fields["time"] != "" {
+		t.Errorf("fields = %v", open.Fields)
+	}
+
+	closed := parseGostLog(`{"dst":"example.com:443","duration":1500000000,"inputBytes":2048,"outputBytes":512,"level":"info","msg":"10.0.0.5:50312 >< example.com:443","remote":"10.0.0.5:50312","service":"web"}`)
+	if closed.DurationMs != 1500 || closed.Fields["inputBytes"] != "2048" {
+		t.Errorf("closed = %+v", closed)
+	}
+
+	failed := parseGostLog(`{"level":"error","error":"dial tcp: connection refused","service":"web"}`)
+	if failed.Level != "ERROR" || failed.Message != "dial tcp: connection refused" || failed.gostError() != "dial tcp: connection refused" {
+		t.Errorf("failed = %+v", failed)
+	}
+
+	plain := parseGostLog("panic: something broke")
+	if plain.Level != "ERROR" || plain.Message != "panic: something broke" || plain.Fields != nil {
+		t.Errorf("plain = %+v", plain)
+	}
+
+	// Profiles whose process has no metrics endpoint are counted from their logs
+	a := &API{
+		processes: map[int64]*supervisedProcess{1: {profileID: 1, state: StateRunning}},
+		stats:     make(map[int64]*statsTracker),
+	}
+	a.recordLogStats(1, open)
+	a.recordLogStats(1, open)
+	a.recordLogStats(1, closed)
+	a.recordLogStats(1, failed)
+	a.collectStats()
+	stats := a.GetProfileStats(1)
+	if stats.TotalConnections != 2 || stats.ActiveConnections != 1 || stats.BytesIn != 2048 || stats.BytesOut != 512 || stats.Errors != 1 || stats.InRate == 0 {
+		t.Errorf("stats = %+v", stats)
+	}
+	if history := a.GetProfileStatsHistory(1); len(history) != 1 {
+		t.Errorf("history = %+v", history)
+	}
+}
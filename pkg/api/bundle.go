@@ -0,0 +1,832 @@
+package api
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/imansprn/gostly/pkg/database"
+	"gopkg.in/yaml.v3"
+)
+
+// BundleVersion is the format version written by ExportBundle
+const BundleVersion = 1
+
+// Bundle formats
+const (
+	BundleFormatJSON = "json"
+	BundleFormatYAML = "yaml"
+)
+
+// How secrets are written to a bundle
+const (
+	SecretsInclude = "include" // plaintext
+	SecretsRedact  = "redact"  // left out
+	SecretsEncrypt = "encrypt" // encrypted with a passphrase
+)
+
+// What to do when an imported item has the same name as an existing one
+const (
+	ConflictSkip      = "skip"
+	ConflictOverwrite = "overwrite"
+	ConflictRename    = "rename"
+)
+
+// Import actions reported per item
+const (
+	ImportCreate    = "create"
+	ImportOverwrite = "overwrite"
+	ImportRename    = "rename"
+	ImportSkip      = "skip"
+	ImportError     = "error"
+)
+
+// bundleCheckValue is encrypted into encrypted bundles to verify the passphrase
+const bundleCheckValue = "gostly-bundle"
+
+// Bundle is a portable copy of a workspace's profiles, chains and host
+// mappings. Chains are referenced by name so bundles don't depend on IDs.
+// Raw GOST configs can embed credentials anywhere, so they are encrypted
+// whole with the other secrets, and left out when secrets are redacted.
+type Bundle struct {
+	Version      int                 `json:"version"`
+	ExportedAt   string              `json:"exported_at"`
+	Secrets      string              `json:"secrets"`
+	Encryption   *BundleEncryption   `json:"encryption,omitempty"`
+	Chains       []BundleChain       `json:"chains"`
+	Profiles     []BundleProfile     `json:"profiles"`
+	HostMappings []BundleHostMapping `json:"host_mappings"`
+	GostLogLevel string              `json:"gost_log_level,omitempty"` // the workspace default, when set
+	Omitted      []string            `json:"omitted,omitempty"`        // raw profiles left out of a redacted bundle
+}
+
+// BundleEncryption holds what is needed to decrypt an encrypted bundle's secrets
+type BundleEncryption struct {
+	KDF   string `json:"kdf"`   // always "scrypt"
+	Salt  string `json:"salt"`  // base64
+	Check string `json:"check"` // bundleCheckValue encrypted with the bundle key
+}
+
+// BundleProfile is a profile as stored in a bundle
+type BundleProfile struct {
+	Name      string               `json:"name"`
+	Type      string               `json:"type"`
+	Listener  string               `json:"listener,omitempty"`
+	Listen    string               `json:"listen"`
+	Remote    string               `json:"remote,omitempty"`
+	Username  string               `json:"username,omitempty"`
+	Password  string               `json:"password,omitempty"`
+	Autostart bool                 `json:"autostart,omitempty"`
+	Chain     string               `json:"chain,omitempty"`
+	Nodes     []BundleNode         `json:"nodes,omitempty"`
+	Selector  *database.Selector   `json:"selector,omitempty"`
+	TLS       *database.TLSOptions `json:"tls,omitempty"`
+	RawConfig string               `json:"raw_config,omitempty"`
+	Group     string               `json:"group,omitempty"`
+	LogLevel  string               `json:"log_level,omitempty"`
+}
+
+// BundleNode is an upstream node as stored in a bundle
+type BundleNode struct {
+	Name   string `json:"name,omitempty"`
+	Addr   string `json:"addr"`
+	Weight int    `json:"weight,omitempty"`
+}
+
+// BundleChain is a chain as stored in a bundle
+type BundleChain struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Hops        []BundleHop `json:"hops"`
+}
+
+// BundleHop is a chain hop as stored in a bundle
+type BundleHop struct {
+	Name          string `json:"name,omitempty"`
+	Addr          string `json:"addr"`
+	Connector     string `json:"connector"`
+	Dialer        string `json:"dialer"`
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	TLSServerName string `json:"tls_server_name,omitempty"`
+	TLSCAFile     string `json:"tls_ca_file,omitempty"`
+	TLSSecure     bool   `json:"tls_secure,omitempty"`
+	TLSCertFile   string `json:"tls_cert_file,omitempty"`
+	TLSKeyFile    string `json:"tls_key_file,omitempty"`
+}
+
+// BundleHostMapping is a host mapping as stored in a bundle
+type BundleHostMapping struct {
+	Hostname string `json:"hostname"`
+	IP       string `json:"ip"`
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+	Active   bool   `json:"active"`
+}
+
+// ExportOptions controls ExportBundle
+type ExportOptions struct {
+	Format     string `json:"format"`     // "json" (default) or "yaml"
+	Secrets    string `json:"secrets"`    // "include" (default), "redact" or "encrypt"
+	Passphrase string `json:"passphrase"` // required to encrypt secrets
+}
+
+// ImportOptions controls ImportBundle
+type ImportOptions struct {
+	Conflict   string `json:"conflict"`   // "skip" (default), "overwrite" or "rename"
+	DryRun     bool   `json:"dry_run"`    // report what would change without writing anything
+	Passphrase string `json:"passphrase"` // decrypts the secrets of encrypted bundles
+}
+
+// ImportItem reports what happened, or would happen, to one bundle item
+type ImportItem struct {
+	Kind    string `json:"kind"` // "chain", "profile", "host_mapping" or "setting"
+	Name    string `json:"name"`
+	Action  string `json:"action"`
+	NewName string `json:"new_name,omitempty"` // set when the item was renamed
+	Message string `json:"message,omitempty"`
+}
+
+// ImportReport lists the outcome of an import
+type ImportReport struct {
+	DryRun bool         `json:"dry_run"`
+	Items  []ImportItem `json:"items"`
+}
+
+// add records an item's outcome
+func (r *ImportReport) add(kind, name, action, newName, format string, args ...interface{}) {
+	item := ImportItem{Kind: kind, Name: name, Action: action}
+	if action == ImportRename {
+		item.NewName = newName
+	}
+	if format != "" {
+		item.Message = fmt.Sprintf(format, args...)
+	}
+	r.Items = append(r.Items, item)
+}
+
+// ExportBundle writes the open workspace's profiles, chains and host mappings as a bundle
+func (a *API) ExportBundle(opts ExportOptions) (string, error) {
+	if opts.Format == "" {
+		opts.Format = BundleFormatJSON
+	}
+	if opts.Format != BundleFormatJSON && opts.Format != BundleFormatYAML {
+		return "", fmt.Errorf("unsupported bundle format %q (use json or yaml)", opts.Format)
+	}
+	if opts.Secrets == "" {
+		opts.Secrets = SecretsInclude
+	}
+
+	bundle := &Bundle{
+		Version:      BundleVersion,
+		ExportedAt:   time.Now().Format(time.RFC3339),
+		Secrets:      opts.Secrets,
+		Chains:       []BundleChain{},
+		Profiles:     []BundleProfile{},
+		HostMappings: []BundleHostMapping{},
+	}
+
+	var seal func(string) (string, error)
+	switch opts.Secrets {
+	case SecretsInclude:
+		seal = func(s string) (string, error) { return s, nil }
+	case SecretsRedact:
+		seal = func(string) (string, error) { return "", nil }
+	case SecretsEncrypt:
+		if opts.Passphrase == "" {
+			return "", fmt.Errorf("a passphrase is required to encrypt secrets")
+		}
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		cipher, err := bundleCipher(opts.Passphrase, salt)
+		if err != nil {
+			return "", err
+		}
+		check, err := cipher.Encrypt(bundleCheckValue)
+		if err != nil {
+			return "", err
+		}
+		bundle.Encryption = &BundleEncryption{KDF: "scrypt", Salt: base64.StdEncoding.EncodeToString(salt), Check: check}
+		seal = cipher.Encrypt
+	default:
+		return "", fmt.Errorf("unsupported secrets mode %q (use include, redact or encrypt)", opts.Secrets)
+	}
+
+	chains, err := a.currentDB().GetChains()
+	if err != nil {
+		return "", err
+	}
+	chainNames := make(map[int64]string, len(chains))
+	for _, c := range chains {
+		chainNames[c.ID] = c.Name
+		bc := BundleChain{Name: c.Name, Description: c.Description}
+		for _, h := range c.Hops {
+			password, err := seal(h.Password)
+			if err != nil {
+				return "", err
+			}
+			bc.Hops = append(bc.Hops, BundleHop{
+				Name: h.Name, Addr: h.Addr, Connector: h.Connector, Dialer: h.Dialer,
+				Username: h.Username, Password: password,
+				TLSServerName: h.TLSServerName, TLSCAFile: h.TLSCAFile, TLSSecure: h.TLSSecure,
+				TLSCertFile: h.TLSCertFile, TLSKeyFile: h.TLSKeyFile,
+			})
+		}
+		bundle.Chains = append(bundle.Chains, bc)
+	}
+
+	profiles, err := a.currentDB().GetProfiles()
+	if err != nil {
+		return "", err
+	}
+	for _, p := range profiles {
+		if isRawProfile(&p) && opts.Secrets == SecretsRedact {
+			bundle.Omitted = append(bundle.Omitted, p.Name)
+			continue
+		}
+		password, err := seal(p.Password)
+		if err != nil {
+			return "", err
+		}
+		rawConfig, err := seal(p.RawConfig)
+		if err != nil {
+			return "", err
+		}
+		bp := BundleProfile{
+			Name: p.Name, Type: p.Type, Listener: p.Listener, Listen: p.Listen, Remote: p.Remote,
+			Username: p.Username, Password: password, Autostart: p.Autostart,
+			Chain: chainNames[p.ChainID], RawConfig: rawConfig, Group: p.Group, LogLevel: p.LogLevel,
+		}
+		if p.Selector != (database.Selector{}) {
+			selector := p.Selector
+			bp.Selector = &selector
+		}
+		if p.TLS != (database.TLSOptions{}) {
+			tls := p.TLS
+			bp.TLS = &tls
+		}
+		for _, n := range p.Nodes {
+			bp.Nodes = append(bp.Nodes, BundleNode{Name: n.Name, Addr: n.Addr, Weight: n.Weight})
+		}
+		bundle.Profiles = append(bundle.Profiles, bp)
+	}
+
+	if bundle.GostLogLevel, err = a.currentDB().GetSetting(gostLogLevelSetting); err != nil {
+		return "", err
+	}
+
+	mappings, err := a.currentDB().GetHostMappings()
+	if err != nil {
+		return "", err
+	}
+	for _, m := range mappings {
+		bundle.HostMappings = append(bundle.HostMappings, BundleHostMapping{
+			Hostname: m.Hostname, IP: m.IP, Port: m.Port, Protocol: m.Protocol, Active: m.Active,
+		})
+	}
+
+	data, err := encodeBundle(bundle, opts.Format)
+	if err != nil {
+		return "", err
+	}
+
+	a.addLog("INFO", "api", fmt.Sprintf("Exported %d profiles, %d chains and %d host mappings (secrets: %s)",
+		len(bundle.Profiles), len(bundle.Chains), len(bundle.HostMappings), opts.Secrets), nil, "")
+	if len(bundle.Omitted) > 0 {
+		a.addLog("WARN", "api", fmt.Sprintf("Left raw config profiles out of the redacted bundle: %s", strings.Join(bundle.Omitted, ", ")), nil, "")
+	}
+	return data, nil
+}
+
+// ImportBundle adds the contents of a JSON or YAML bundle to the open workspace
+func (a *API) ImportBundle(data string, opts ImportOptions) (*ImportReport, error) {
+	bundle, err := decodeBundle(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := openBundleSecrets(bundle, opts.Passphrase); err != nil {
+		return nil, err
+	}
+	return a.importBundle(bundle, opts, "Bundle Imported")
+}
+
+// importBundle adds a decoded bundle's contents to the open workspace.
+// action names the import in the timeline.
+func (a *API) importBundle(bundle *Bundle, opts ImportOptions, action string) (*ImportReport, error) {
+	if opts.Conflict == "" {
+		opts.Conflict = ConflictSkip
+	}
+	switch opts.Conflict {
+	case ConflictSkip, ConflictOverwrite, ConflictRename:
+	default:
+		return nil, fmt.Errorf("unsupported conflict mode %q (use skip, overwrite or rename)", opts.Conflict)
+	}
+
+	report := &ImportReport{DryRun: opts.DryRun}
+	chainIDs, err := a.importChains(bundle, opts, report)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.importProfiles(bundle, opts, chainIDs, report); err != nil {
+		return nil, err
+	}
+	if err := a.importHostMappings(bundle, opts, report); err != nil {
+		return nil, err
+	}
+	if err := a.importSettings(bundle, opts, report); err != nil {
+		return nil, err
+	}
+
+	if !opts.DryRun {
+		counts := map[string]int{}
+		for _, item := range report.Items {
+			counts[item.Action]++
+		}
+		details := fmt.Sprintf("%s: %d created, %d overwritten, %d renamed, %d skipped, %d failed",
+			action, counts[ImportCreate], counts[ImportOverwrite], counts[ImportRename], counts[ImportSkip], counts[ImportError])
+		status := "success"
+		if counts[ImportError] > 0 {
+			status = "warning"
+		}
+		a.addLog("INFO", "api", details, nil, "")
+		a.addTimelineEvent("configuration", action, details, status, "admin", "1s", "")
+	}
+	return report, nil
+}
+
+// importChains imports the bundle's chains and returns the IDs bundle chain
+// names resolve to. In a dry run new chains get negative placeholder IDs, so
+// profiles that need a chain still validate.
+func (a *API) importChains(bundle *Bundle, opts ImportOptions, report *ImportReport) (map[string]int64, error) {
+	existing, err := a.currentDB().GetChains()
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]int64, len(existing))
+	taken := make(map[string]bool, len(existing))
+	for _, c := range existing {
+		ids[c.Name] = c.ID
+		taken[c.Name] = true
+	}
+
+	var placeholder int64
+	for _, bc := range bundle.Chains {
+		chain := database.Chain{Name: bc.Name, Description: bc.Description}
+		for _, h := range bc.Hops {
+			chain.Hops = append(chain.Hops, database.Hop{
+				Name: h.Name, Addr: h.Addr, Connector: h.Connector, Dialer: h.Dialer,
+				Username: h.Username, Password: h.Password,
+				TLSServerName: h.TLSServerName, TLSCAFile: h.TLSCAFile, TLSSecure: h.TLSSecure,
+				TLSCertFile: h.TLSCertFile, TLSKeyFile: h.TLSKeyFile,
+			})
+		}
+
+		action, target := resolveImportName(bc.Name, taken, opts.Conflict)
+		if action == ImportSkip {
+			report.add("chain", bc.Name, ImportSkip, "", "a chain with this name already exists")
+			continue
+		}
+		chain.Name = target
+
+		if action == ImportOverwrite {
+			chain.ID = ids[bc.Name]
+			if bundle.Secrets == SecretsRedact {
+				if err := a.keepHopPasswords(&chain); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if opts.DryRun {
+			if err := validateChain(&chain).errOrNil(); err != nil {
+				report.add("chain", bc.Name, ImportError, "", "%v", err)
+				continue
+			}
+			if chain.ID == 0 {
+				placeholder--
+				chain.ID = placeholder
+			}
+		} else if action == ImportOverwrite {
+			if err := a.UpdateChain(chain); err != nil {
+				report.add("chain", bc.Name, ImportError, "", "%v", err)
+				continue
+			}
+		} else {
+			id, err := a.AddChain(chain)
+			if err != nil {
+				report.add("chain", bc.Name, ImportError, "", "%v", err)
+				continue
+			}
+			chain.ID = id
+		}
+
+		// Profiles in the bundle refer to the chain by its bundle name
+		ids[bc.Name] = chain.ID
+		taken[target] = true
+		report.add("chain", bc.Name, action, target, "")
+	}
+	return ids, nil
+}
+
+// keepHopPasswords fills the passwords a redacted bundle left out of an
+// overwritten chain from the stored chain's hops at the same address
+func (a *API) keepHopPasswords(chain *database.Chain) error {
+	stored, err := a.currentDB().GetChain(chain.ID)
+	if err != nil {
+		return err
+	}
+	for i := range chain.Hops {
+		for _, old := range stored.Hops {
+			if old.Addr == chain.Hops[i].Addr && old.Username == chain.Hops[i].Username {
+				chain.Hops[i].Password = old.Password
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// importProfiles imports the bundle's profiles
+func (a *API) importProfiles(bundle *Bundle, opts ImportOptions, chainIDs map[string]int64, report *ImportReport) error {
+	existing, err := a.currentDB().GetProfiles()
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]database.Profile, len(existing))
+	taken := make(map[string]bool, len(existing))
+	for _, p := range existing {
+		byName[p.Name] = p
+		taken[p.Name] = true
+	}
+
+	for _, name := range bundle.Omitted {
+		report.add("profile", name, ImportSkip, "", "left out of the bundle because its raw config can't be redacted")
+	}
+
+	// A dry run validates against the profiles the import would leave behind
+	planned := existing
+
+	for _, bp := range bundle.Profiles {
+		profile := database.Profile{
+			Name: bp.Name, Type: bp.Type, Listener: bp.Listener, Listen: bp.Listen, Remote: bp.Remote,
+			Username: bp.Username, Password: bp.Password, Autostart: bp.Autostart,
+			RawConfig: bp.RawConfig, Group: bp.Group,
+		}
+		if bp.LogLevel != "" {
+			level, err := normalizeGostLogLevel(bp.LogLevel)
+			if err != nil {
+				report.add("profile", bp.Name, ImportError, "", "%v", err)
+				continue
+			}
+			profile.LogLevel = level
+		}
+		if bp.Selector != nil {
+			profile.Selector = *bp.Selector
+		}
+		if bp.TLS != nil {
+			profile.TLS = *bp.TLS
+		}
+		for _, n := range bp.Nodes {
+			profile.Nodes = append(profile.Nodes, database.UpstreamNode{Name: n.Name, Addr: n.Addr, Weight: n.Weight})
+		}
+
+		if bp.Chain != "" {
+			id, ok := chainIDs[bp.Chain]
+			if !ok {
+				report.add("profile", bp.Name, ImportError, "", "chain %q is neither in the bundle nor in this workspace", bp.Chain)
+				continue
+			}
+			profile.ChainID = id
+		}
+
+		action, target := resolveImportName(bp.Name, taken, opts.Conflict)
+		if action == ImportSkip {
+			report.add("profile", bp.Name, ImportSkip, "", "a profile with this name already exists")
+			continue
+		}
+		profile.Name = target
+
+		var old database.Profile
+		if action == ImportOverwrite {
+			old = byName[bp.Name]
+			profile.ID = old.ID
+			if bundle.Secrets == SecretsRedact && profile.Password == "" && profile.Username == old.Username {
+				profile.Password = old.Password
+			}
+		}
+		if bundle.Secrets == SecretsRedact && profile.Username != "" && profile.Password == "" {
+			report.add("profile", bp.Name, ImportError, "", "the password was redacted from the bundle")
+			continue
+		}
+
+		note := ""
+		if opts.DryRun {
+			if action == ImportOverwrite {
+				if running, group := a.runningProfileGroup(profile.ID); running {
+					// UpdateProfile applies the changes live but won't move groups
+					if group != profile.Group {
+						report.add("profile", bp.Name, ImportError, "", "cannot move a running profile to another group, stop it first")
+						continue
+					}
+					note = "the profile is running, the changes are applied live and may restart it"
+				}
+			}
+			if err := validateProfile(&profile, planned).errOrNil(); err != nil {
+				report.add("profile", bp.Name, ImportError, "", "%v", err)
+				continue
+			}
+			planned = replaceProfile(planned, profile)
+		} else if action == ImportOverwrite {
+			if err := a.UpdateProfile(profile); err != nil {
+				report.add("profile", bp.Name, ImportError, "", "%v", err)
+				continue
+			}
+			// Updates leave the desired state alone
+			if profile.Autostart != old.Autostart {
+				if err := a.SetProfileAutostart(profile.ID, profile.Autostart); err != nil {
+					report.add("profile", bp.Name, ImportError, "", "%v", err)
+					continue
+				}
+			}
+			// and the log level; this also reloads a running profile at it
+			if profile.LogLevel != old.LogLevel {
+				if err := a.SetProfileGostLogLevel(profile.ID, profile.LogLevel); err != nil {
+					report.add("profile", bp.Name, ImportError, "", "%v", err)
+					continue
+				}
+			}
+		} else {
+			if _, err := a.AddProfile(profile); err != nil {
+				report.add("profile", bp.Name, ImportError, "", "%v", err)
+				continue
+			}
+		}
+
+		taken[target] = true
+		report.add("profile", bp.Name, action, target, "%s", note)
+	}
+	return nil
+}
+
+// runningProfileGroup reports whether a profile has a running process and
+// the group it runs in, "" for its own process
+func (a *API) runningProfileGroup(id int64) (bool, string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	proc, ok := a.processes[id]
+	if !ok || !proc.isActive() {
+		return false, ""
+	}
+	if proc.group != nil {
+		return true, proc.group.name
+	}
+	return true, ""
+}
+
+// replaceProfile returns profiles with p added, or replacing the profile with its ID
+func replaceProfile(profiles []database.Profile, p database.Profile) []database.Profile {
+	out := make([]database.Profile, 0, len(profiles)+1)
+	for _, other := range profiles {
+		if p.ID == 0 || other.ID != p.ID {
+			out = append(out, other)
+		}
+	}
+	return append(out, p)
+}
+
+// importHostMappings imports the bundle's host mappings. Mappings are keyed
+// by hostname, so "rename" keeps the existing mapping like "skip".
+func (a *API) importHostMappings(bundle *Bundle, opts ImportOptions, report *ImportReport) error {
+	existing, err := a.currentDB().GetHostMappings()
+	if err != nil {
+		return err
+	}
+	ids := make(map[string]int64, len(existing))
+	for _, m := range existing {
+		ids[m.Hostname] = m.ID
+	}
+
+	for _, bm := range bundle.HostMappings {
+		if strings.TrimSpace(bm.Hostname) == "" || bm.IP == "" || bm.Port <= 0 || bm.Port > 65535 {
+			report.add("host_mapping", bm.Hostname, ImportError, "", "hostname, ip and a port between 1 and 65535 are required")
+			continue
+		}
+
+		action := ImportCreate
+		id, exists := ids[bm.Hostname]
+		if exists {
+			if opts.Conflict != ConflictOverwrite {
+				report.add("host_mapping", bm.Hostname, ImportSkip, "", "a mapping for this hostname already exists")
+				continue
+			}
+			action = ImportOverwrite
+		}
+
+		if !opts.DryRun {
+			m := database.HostMapping{ID: id, Hostname: bm.Hostname, IP: bm.IP, Port: bm.Port, Protocol: bm.Protocol, Active: bm.Active}
+			if err := a.UpsertHostMapping(m); err != nil {
+				report.add("host_mapping", bm.Hostname, ImportError, "", "%v", err)
+				continue
+			}
+		}
+		ids[bm.Hostname] = id
+		report.add("host_mapping", bm.Hostname, action, "", "")
+	}
+	return nil
+}
+
+// importSettings imports the bundle's workspace settings. A setting the
+// workspace already has is only replaced by "overwrite".
+func (a *API) importSettings(bundle *Bundle, opts ImportOptions, report *ImportReport) error {
+	if bundle.GostLogLevel == "" {
+		return nil
+	}
+	level, err := normalizeGostLogLevel(bundle.GostLogLevel)
+	if err != nil {
+		report.add("setting", gostLogLevelSetting, ImportError, "", "%v", err)
+		return nil
+	}
+	current, err := a.currentDB().GetSetting(gostLogLevelSetting)
+	if err != nil {
+		return err
+	}
+
+	action := ImportCreate
+	if current != "" {
+		if current == level {
+			return nil
+		}
+		if opts.Conflict != ConflictOverwrite {
+			report.add("setting", gostLogLevelSetting, ImportSkip, "", "the workspace already logs at %s", current)
+			return nil
+		}
+		action = ImportOverwrite
+	}
+	if !opts.DryRun {
+		if err := a.SetGostLogLevel(level); err != nil {
+			report.add("setting", gostLogLevelSetting, ImportError, "", "%v", err)
+			return nil
+		}
+	}
+	report.add("setting", gostLogLevelSetting, action, "", "")
+	return nil
+}
+
+// resolveImportName decides what happens to an imported item called name
+// and returns the action and the name it is saved under
+func resolveImportName(name string, taken map[string]bool, conflict string) (string, string) {
+	if !taken[name] {
+		return ImportCreate, name
+	}
+	switch conflict {
+	case ConflictOverwrite:
+		return ImportOverwrite, name
+	case ConflictRename:
+		for i := 2; ; i++ {
+			candidate := fmt.Sprintf("%s (%d)", name, i)
+			if !taken[candidate] {
+				return ImportRename, candidate
+			}
+		}
+	}
+	return ImportSkip, name
+}
+
+// bundleCipher derives the cipher of an encrypted bundle
+func bundleCipher(passphrase string, salt []byte) (*database.Cipher, error) {
+	key, err := database.DeriveKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	return database.NewCipher(key)
+}
+
+// openBundleSecrets decrypts the secrets of an encrypted bundle in place
+func openBundleSecrets(bundle *Bundle, passphrase string) error {
+	if bundle.Secrets != SecretsEncrypt {
+		return nil
+	}
+	if bundle.Encryption == nil || bundle.Encryption.KDF != "scrypt" {
+		return fmt.Errorf("bundle is marked encrypted but has no supported encryption settings")
+	}
+	if passphrase == "" {
+		return fmt.Errorf("bundle secrets are encrypted, a passphrase is required")
+	}
+	salt, err := base64.StdEncoding.DecodeString(bundle.Encryption.Salt)
+	if err != nil {
+		return fmt.Errorf("invalid bundle salt: %w", err)
+	}
+	cipher, err := bundleCipher(passphrase, salt)
+	if err != nil {
+		return err
+	}
+	if check, err := cipher.Decrypt(bundle.Encryption.Check); err != nil || check != bundleCheckValue {
+		return fmt.Errorf("incorrect passphrase for bundle")
+	}
+
+	for i := range bundle.Profiles {
+		bp := &bundle.Profiles[i]
+		if bp.Password, err = cipher.Decrypt(bp.Password); err != nil {
+			return fmt.Errorf("profile %s: %w", bp.Name, err)
+		}
+		if bp.RawConfig, err = cipher.Decrypt(bp.RawConfig); err != nil {
+			return fmt.Errorf("profile %s: %w", bp.Name, err)
+		}
+	}
+	for i := range bundle.Chains {
+		for j := range bundle.Chains[i].Hops {
+			hop := &bundle.Chains[i].Hops[j]
+			if hop.Password, err = cipher.Decrypt(hop.Password); err != nil {
+				return fmt.Errorf("chain %s: %w", bundle.Chains[i].Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// encodeBundle writes a bundle as JSON or YAML
+func encodeBundle(bundle *Bundle, format string) (string, error) {
+	return encodeDocument(bundle, format)
+}
+
+// encodeDocument writes v as indented JSON or YAML. YAML output keeps the
+// JSON field names and order by going through a yaml.Node.
+func encodeDocument(v interface{}, format string) (string, error) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if format == BundleFormatJSON {
+		return string(data) + "\n", nil
+	}
+
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return "", err
+	}
+	clearYAMLStyle(&node)
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&node); err != nil {
+		return "", err
+	}
+	if err := enc.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// clearYAMLStyle switches nodes parsed from JSON to block style and plain
+// scalars; the encoder still quotes strings that would otherwise change type
+func clearYAMLStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		clearYAMLStyle(child)
+	}
+}
+
+// decodeBundle reads a JSON or YAML bundle
+func decodeBundle(data string) (*Bundle, error) {
+	trimmed := strings.TrimSpace(data)
+	if trimmed == "" {
+		return nil, fmt.Errorf("bundle is empty")
+	}
+
+	raw := []byte(trimmed)
+	if !strings.HasPrefix(trimmed, "{") {
+		// Decode YAML generically and re-encode it so the JSON field names apply
+		var doc interface{}
+		if err := yaml.Unmarshal(raw, &doc); err != nil {
+			return nil, fmt.Errorf("invalid YAML: %w", err)
+		}
+		var err error
+		if raw, err = json.Marshal(doc); err != nil {
+			return nil, fmt.Errorf("invalid bundle: %w", err)
+		}
+	}
+
+	var bundle Bundle
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&bundle); err != nil {
+		return nil, fmt.Errorf("invalid bundle: %w", err)
+	}
+	if bundle.Version < 1 || bundle.Version > BundleVersion {
+		return nil, fmt.Errorf("unsupported bundle version %d (this build reads up to %d)", bundle.Version, BundleVersion)
+	}
+	switch bundle.Secrets {
+	case SecretsInclude, SecretsRedact, SecretsEncrypt:
+	case "":
+		bundle.Secrets = SecretsInclude
+	default:
+		return nil, fmt.Errorf("unsupported secrets mode %q in bundle", bundle.Secrets)
+	}
+	return &bundle, nil
+}
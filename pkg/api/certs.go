@@ -0,0 +1,233 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/imansprn/gostly/pkg/database"
+)
+
+// selfSignedValidity is how long generated test certificates are valid
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// tlsVersions maps the accepted min_version values to GOST's names
+var tlsVersions = map[string]string{
+	"1.0": "VersionTLS10",
+	"1.1": "VersionTLS11",
+	"1.2": "VersionTLS12",
+	"1.3": "VersionTLS13",
+}
+
+// certNamePattern restricts generated certificate names to safe file names
+var certNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// CertificateFiles describes a certificate keypair on disk
+type CertificateFiles struct {
+	CertFile string    `json:"cert_file"`
+	KeyFile  string    `json:"key_file"`
+	Hosts    []string  `json:"hosts"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+// validateProfileTLS checks a profile's TLS settings against its listener and
+// makes sure the referenced files can be loaded
+func validateProfileTLS(verr *ValidationError, p *database.Profile) {
+	opts := p.TLS
+	if opts == (database.TLSOptions{}) {
+		return
+	}
+
+	if listener, err := profileListener(p); err == nil && !listener.supports(OptionTLS) {
+		verr.add("tls", CodeUnsupported, "%s listeners do not use TLS", listener.Type)
+		return
+	}
+
+	validateKeyPair(verr, "tls.cert_file", "tls.key_file", opts.CertFile, opts.KeyFile)
+
+	if opts.ClientAuth && opts.CAFile == "" {
+		verr.add("tls.ca_file", CodeRequired, "a CA file is required to verify client certificates")
+	}
+	validateCAFile(verr, "tls.ca_file", opts.CAFile)
+
+	if opts.ServerName != "" && !isValidHostname(opts.ServerName) {
+		verr.add("tls.server_name", CodeInvalid, "%q is not a valid server name", opts.ServerName)
+	}
+	if _, ok := tlsVersions[opts.MinVersion]; opts.MinVersion != "" && !ok {
+		verr.add("tls.min_version", CodeUnsupported, "unsupported TLS version %q (use 1.0, 1.1, 1.2 or 1.3)", opts.MinVersion)
+	}
+}
+
+// validateKeyPair checks that a certificate and key are set together and match
+func validateKeyPair(verr *ValidationError, certField, keyField, certFile, keyFile string) {
+	switch {
+	case certFile == "" && keyFile == "":
+		return
+	case certFile == "":
+		verr.add(certField, CodeRequired, "certificate and key must be set together")
+		return
+	case keyFile == "":
+		verr.add(keyField, CodeRequired, "certificate and key must be set together")
+		return
+	}
+
+	if _, err := os.Stat(certFile); err != nil {
+		verr.add(certField, CodeNotFound, "cannot read certificate: %v", err)
+		return
+	}
+	if _, err := os.Stat(keyFile); err != nil {
+		verr.add(keyField, CodeNotFound, "cannot read key: %v", err)
+		return
+	}
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		verr.add(certField, CodeInvalid, "certificate and key do not form a valid pair: %v", err)
+	}
+}
+
+// validateCAFile checks that a CA file holds at least one PEM certificate
+func validateCAFile(verr *ValidationError, field, caFile string) {
+	if caFile == "" {
+		return
+	}
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		verr.add(field, CodeNotFound, "cannot read CA file: %v", err)
+		return
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(data) {
+		verr.add(field, CodeInvalid, "CA file contains no PEM certificates")
+	}
+}
+
+// renderListenerTLS builds the listener tls block from a profile's settings.
+// GOST generates a throwaway certificate when no cert/key is given.
+func renderListenerTLS(opts database.TLSOptions) *GostTLS {
+	if opts == (database.TLSOptions{}) {
+		return nil
+	}
+
+	gt := &GostTLS{
+		CertFile:   opts.CertFile,
+		KeyFile:    opts.KeyFile,
+		ServerName: opts.ServerName,
+	}
+	// A CA on a listener turns on client certificate verification
+	if opts.ClientAuth {
+		gt.CAFile = opts.CAFile
+	}
+	if version, ok := tlsVersions[opts.MinVersion]; ok {
+		gt.Options = &GostTLSOptions{MinVersion: version}
+	}
+	return gt
+}
+
+// certsDir returns the directory generated certificates are stored in
+func certsDir() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "gostly", "certs"), nil
+}
+
+// GenerateSelfSignedCert creates a self-signed certificate for local testing
+// and stores it as <name>.crt / <name>.key under the gostly config dir
+func (a *API) GenerateSelfSignedCert(name string, hosts []string) (*CertificateFiles, error) {
+	if !certNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid certificate name %q", name)
+	}
+	if len(hosts) == 0 {
+		hosts = []string{"localhost", "127.0.0.1"}
+	}
+
+	dir, err := certsDir()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	files := &CertificateFiles{
+		CertFile: filepath.Join(dir, name+".crt"),
+		KeyFile:  filepath.Join(dir, name+".key"),
+		Hosts:    hosts,
+	}
+	if err := writeSelfSignedCert(files); err != nil {
+		a.addLog("ERROR", "api", fmt.Sprintf("Failed to generate certificate %s: %v", name, err), nil, "")
+		return nil, err
+	}
+
+	a.addLog("INFO", "api", fmt.Sprintf("Generated self-signed certificate %s for %v (expires %s)", files.CertFile, hosts, files.NotAfter.Format("2006-01-02")), nil, "")
+
+	a.addTimelineEvent("configuration", "Certificate Generated",
+		fmt.Sprintf("Self-signed certificate '%s' generated for local testing", name),
+		"success", "admin", "1s", "")
+
+	return files, nil
+}
+
+// writeSelfSignedCert generates an ECDSA P-256 keypair and writes the PEM
+// files named in files, filling in NotAfter
+func writeSelfSignedCert(files *CertificateFiles) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	notBefore := time.Now().Add(-time.Hour)
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: files.Hosts[0], Organization: []string{"Gostly self-signed"}},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, h := range files.Hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(files.KeyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(files.CertFile, certPEM, 0644); err != nil {
+		return err
+	}
+
+	files.NotAfter = template.NotAfter
+	return nil
+}
@@ -0,0 +1,189 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/imansprn/gostly/pkg/database"
+)
+
+// chainConnectorTypes are the GOST connector types a hop can speak
+var chainConnectorTypes = map[string]bool{
+	"http":    true,
+	"http2":   true,
+	"socks4":  true,
+	"socks5":  true,
+	"ss":      true,
+	"relay":   true,
+	"sshd":    true,
+	"sni":     true,
+	"forward": true,
+}
+
+// chainDialerTypes are the GOST dialer types used to reach a hop
+var chainDialerTypes = map[string]bool{
+	"tcp":   true,
+	"udp":   true,
+	"tls":   true,
+	"mtls":  true,
+	"ws":    true,
+	"wss":   true,
+	"mws":   true,
+	"mwss":  true,
+	"http2": true,
+	"h2":    true,
+	"h2c":   true,
+	"grpc":  true,
+	"quic":  true,
+	"kcp":   true,
+	"ssh":   true,
+	"sshd":  true,
+}
+
+// dialerUsesTLS reports whether a dialer type runs over TLS
+func dialerUsesTLS(dialer string) bool {
+	switch dialer {
+	case "tls", "mtls", "wss", "mwss", "http2", "h2", "grpc", "quic":
+		return true
+	}
+	return false
+}
+
+// validateChain checks a chain's fields and hops
+func validateChain(c *database.Chain) *ValidationError {
+	verr := &ValidationError{}
+
+	if strings.TrimSpace(c.Name) == "" {
+		verr.add("name", CodeRequired, "name is required")
+	}
+	if len(c.Hops) == 0 {
+		verr.add("hops", CodeRequired, "a chain needs at least one hop")
+	}
+
+	for i, hop := range c.Hops {
+		prefix := fmt.Sprintf("hops[%d].", i)
+		hopErr := &ValidationError{}
+		validateHostPort(hopErr, "addr", hop.Addr, false)
+
+		switch {
+		case hop.Connector == "":
+			hopErr.add("connector", CodeRequired, "connector is required")
+		case !chainConnectorTypes[hop.Connector]:
+			hopErr.add("connector", CodeUnsupported, "unsupported connector type %q", hop.Connector)
+		}
+
+		switch {
+		case hop.Dialer == "":
+			hopErr.add("dialer", CodeRequired, "dialer is required")
+		case !chainDialerTypes[hop.Dialer]:
+			hopErr.add("dialer", CodeUnsupported, "unsupported dialer type %q", hop.Dialer)
+		}
+
+		if hop.TLSCertFile != "" || hop.TLSKeyFile != "" || hop.TLSCAFile != "" {
+			if !dialerUsesTLS(hop.Dialer) {
+				hopErr.add("dialer", CodeUnsupported, "%s dialers do not use TLS", hop.Dialer)
+			}
+			validateKeyPair(hopErr, "tls_cert_file", "tls_key_file", hop.TLSCertFile, hop.TLSKeyFile)
+			validateCAFile(hopErr, "tls_ca_file", hop.TLSCAFile)
+		}
+
+		for _, fe := range hopErr.Errors {
+			fe.Field = prefix + fe.Field
+			verr.Errors = append(verr.Errors, fe)
+		}
+	}
+
+	return verr
+}
+
+// GetChains returns all chains
+func (a *API) GetChains() ([]database.Chain, error) {
+	return a.currentDB().GetChains()
+}
+
+// GetChain returns a chain by ID
+func (a *API) GetChain(id int64) (*database.Chain, error) {
+	return a.currentDB().GetChain(id)
+}
+
+// AddChain adds a new chain
+func (a *API) AddChain(chain database.Chain) (int64, error) {
+	if err := validateChain(&chain).errOrNil(); err != nil {
+		a.addLog("WARN", "api", fmt.Sprintf("Rejected chain %s: %v", chain.Name, err), nil, "")
+		return 0, err
+	}
+
+	if err := a.currentDB().AddChain(&chain); err != nil {
+		a.addLog("ERROR", "api", fmt.Sprintf("Failed to add chain %s: %v", chain.Name, err), nil, "")
+		return 0, err
+	}
+
+	a.addLog("INFO", "api", fmt.Sprintf("Chain created successfully: %s (ID: %d, %d hops)", chain.Name, chain.ID, len(chain.Hops)), nil, "")
+
+	a.addTimelineEvent("configuration", "Chain Created",
+		fmt.Sprintf("Proxy chain '%s' created: %s", chain.Name, describeChain(&chain)),
+		"success", "admin", "1s", "")
+
+	return chain.ID, nil
+}
+
+// UpdateChain updates an existing chain. Running profiles pick up the change on their next start.
+func (a *API) UpdateChain(chain database.Chain) error {
+	if err := validateChain(&chain).errOrNil(); err != nil {
+		a.addLog("WARN", "api", fmt.Sprintf("Rejected update of chain %s: %v", chain.Name, err), nil, "")
+		return err
+	}
+
+	if err := a.currentDB().UpdateChain(&chain); err != nil {
+		a.addLog("ERROR", "api", fmt.Sprintf("Failed to update chain %s: %v", chain.Name, err), nil, "")
+		return err
+	}
+
+	a.addLog("INFO", "api", fmt.Sprintf("Chain updated successfully: %s (ID: %d)", chain.Name, chain.ID), nil, "")
+
+	a.addTimelineEvent("configuration", "Chain Updated",
+		fmt.Sprintf("Proxy chain '%s' updated: %s", chain.Name, describeChain(&chain)),
+		"success", "admin", "1s", "")
+
+	return nil
+}
+
+// DeleteChain deletes a chain that no profile references
+func (a *API) DeleteChain(id int64) error {
+	chain, err := a.currentDB().GetChain(id)
+	if err != nil {
+		a.addLog("ERROR", "api", fmt.Sprintf("Failed to get chain for deletion (ID: %d): %v", id, err), nil, "")
+		return err
+	}
+
+	users, err := a.currentDB().GetProfilesUsingChain(id)
+	if err != nil {
+		return err
+	}
+	if len(users) > 0 {
+		a.addLog("WARN", "api", fmt.Sprintf("Cannot delete chain %s: used by %s", chain.Name, strings.Join(users, ", ")), nil, "")
+		return fmt.Errorf("chain is used by profiles: %s", strings.Join(users, ", "))
+	}
+
+	if err := a.currentDB().DeleteChain(id); err != nil {
+		a.addLog("ERROR", "api", fmt.Sprintf("Failed to delete chain %s: %v", chain.Name, err), nil, "")
+		return err
+	}
+
+	a.addLog("INFO", "api", fmt.Sprintf("Chain deleted successfully: %s (ID: %d)", chain.Name, id), nil, "")
+
+	a.addTimelineEvent("configuration", "Chain Deleted",
+		fmt.Sprintf("Proxy chain '%s' deleted", chain.Name),
+		"success", "admin", "1s", "")
+
+	return nil
+}
+
+// describeChain summarises a chain as "socks5+tcp://a:1 -> http+tls://b:2"
+func describeChain(c *database.Chain) string {
+	parts := make([]string, 0, len(c.Hops))
+	for _, hop := range c.Hops {
+		parts = append(parts, fmt.Sprintf("%s+%s://%s", hop.Connector, hop.Dialer, hop.Addr))
+	}
+	return strings.Join(parts, " -> ")
+}
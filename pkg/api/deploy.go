@@ -0,0 +1,475 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/imansprn/gostly/pkg/database"
+)
+
+// Service managers a deployment can generate a unit for
+const (
+	DeployTargetNone    = ""
+	DeployTargetSystemd = "systemd"
+	DeployTargetLaunchd = "launchd"
+	DeployTargetCompose = "docker-compose"
+)
+
+// Defaults used when DeployOptions leaves a field empty
+const (
+	defaultDeployBinary = "/usr/local/bin/gost"
+	defaultDeployImage  = "gogost/gost"
+)
+
+// DeployOptions controls how profiles are rendered for a server
+type DeployOptions struct {
+	Format     string `json:"format"`      // config format: "json" or "yaml" (default)
+	Target     string `json:"target"`      // "", "systemd", "launchd" or "docker-compose"
+	Name       string `json:"name"`        // service name, derived from the profile by default
+	ConfigPath string `json:"config_path"` // where the config is installed on the server
+	GostBinary string `json:"gost_binary"` // gost executable used by systemd and launchd
+	Image      string `json:"image"`       // docker image used by docker-compose
+	OutputDir  string `json:"output_dir"`  // also write the files here when set
+}
+
+// DeployFile is a generated file and the name it is meant to be saved as
+type DeployFile struct {
+	Name    string `json:"name"`
+	Content string `json:"content"`
+}
+
+// Deployment is a standalone GOST config and, optionally, a unit that runs it
+type Deployment struct {
+	Name     string      `json:"name"`
+	Config   DeployFile  `json:"config"`
+	Unit     *DeployFile `json:"unit,omitempty"`
+	Warnings []string    `json:"warnings"`
+	Written  []string    `json:"written,omitempty"` // paths written under OutputDir
+}
+
+var deployNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// ExportDeployment renders profiles into one standalone GOST v3 config that
+// runs without Gostly, plus a systemd unit, launchd plist or docker-compose
+// service for it. The config carries the profiles' credentials in plain text.
+func (a *API) ExportDeployment(ids []int64, opts DeployOptions) (*Deployment, error) {
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("select at least one profile to export")
+	}
+	if opts.Format == "" {
+		opts.Format = BundleFormatYAML
+	}
+	if opts.Format != BundleFormatJSON && opts.Format != BundleFormatYAML {
+		return nil, fmt.Errorf("unsupported config format %q (use json or yaml)", opts.Format)
+	}
+	switch opts.Target {
+	case DeployTargetNone, DeployTargetSystemd, DeployTargetLaunchd, DeployTargetCompose:
+	default:
+		return nil, fmt.Errorf("unsupported target %q (use systemd, launchd or docker-compose)", opts.Target)
+	}
+
+	profiles := make([]*database.Profile, 0, len(ids))
+	for _, id := range ids {
+		profile, err := a.currentDB().GetProfile(id)
+		if err != nil {
+			return nil, fmt.Errorf("profile %d: %w", id, err)
+		}
+		profiles = append(profiles, profile)
+	}
+
+	if opts.Name == "" {
+		opts.Name = "gost"
+		if len(profiles) == 1 {
+			opts.Name = deploySlug(profiles[0].Name)
+		}
+	}
+	if !deployNamePattern.MatchString(opts.Name) {
+		return nil, fmt.Errorf("invalid service name %q: use letters, digits, '.', '-' or '_'", opts.Name)
+	}
+
+	config, _, warnings, err := a.mergeProfileConfigs(profiles)
+	if err != nil {
+		return nil, err
+	}
+	for _, profile := range profiles {
+		if strings.HasPrefix(profile.Listen, "127.") || strings.HasPrefix(profile.Listen, "localhost:") || strings.HasPrefix(profile.Listen, "[::1]:") {
+			warnings = append(warnings, fmt.Sprintf("profile %s listens on %s, which is only reachable from the server itself", profile.Name, profile.Listen))
+		}
+	}
+	content, err := encodeDocument(config, opts.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	configFile := opts.Name + "." + opts.Format
+	if opts.ConfigPath == "" {
+		switch opts.Target {
+		case DeployTargetLaunchd:
+			opts.ConfigPath = "/usr/local/etc/gost/" + configFile
+		case DeployTargetCompose:
+			opts.ConfigPath = "./" + configFile
+		default:
+			opts.ConfigPath = "/etc/gost/" + configFile
+		}
+	}
+	if opts.GostBinary == "" {
+		opts.GostBinary = defaultDeployBinary
+	}
+	if opts.Image == "" {
+		opts.Image = defaultDeployImage
+	}
+
+	deployment := &Deployment{
+		Name:     opts.Name,
+		Config:   DeployFile{Name: configFile, Content: content},
+		Warnings: warnings,
+	}
+
+	files := referencedFiles(config)
+	if len(files) > 0 {
+		deployment.Warnings = append(deployment.Warnings, fmt.Sprintf("copy the referenced certificate files to the server: %s", strings.Join(files, ", ")))
+	}
+	if containsCredentials(config) {
+		deployment.Warnings = append(deployment.Warnings, "the config contains credentials in plain text; keep it readable only by the service user")
+	}
+
+	if opts.Target != DeployTargetNone {
+		unit, err := renderDeployUnit(opts, configFile, files)
+		if err != nil {
+			return nil, err
+		}
+		deployment.Unit = unit
+	}
+
+	if opts.OutputDir != "" {
+		written, err := writeDeployment(opts.OutputDir, deployment)
+		if err != nil {
+			return nil, err
+		}
+		deployment.Written = written
+	}
+
+	names := make([]string, len(profiles))
+	for i, p := range profiles {
+		names[i] = p.Name
+	}
+	details := fmt.Sprintf("Exported %s as deployment %s", strings.Join(names, ", "), opts.Name)
+	if opts.Target != DeployTargetNone {
+		details += " for " + opts.Target
+	}
+	a.addLog("INFO", "api", details, nil, "")
+	a.addTimelineEvent("configuration", "Deployment Exported", details, "success", "admin", "1s", "")
+
+	return deployment, nil
+}
+
+// mergeProfileConfigs renders each profile and merges the results into one
+// multi-service config without a log block. It also returns which profile
+// each service belongs to; clashing service names are renamed.
+func (a *API) mergeProfileConfigs(profiles []*database.Profile) (map[string]interface{}, map[string]int64, []string, error) {
+	merged := map[string]interface{}{}
+	owners := map[string]int64{}
+	var warnings []string
+	listNames := map[string]map[string]string{} // section -> name -> rendered item
+
+	for _, profile := range profiles {
+		var cfg map[string]interface{}
+		if isRawProfile(profile) {
+			raw, err := parseRawConfig(profile.RawConfig)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("profile %s: %w", profile.Name, err)
+			}
+			cfg = raw
+		} else {
+			built, err := a.buildGostConfig(profile)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("profile %s: %w", profile.Name, err)
+			}
+			built.Log = nil
+			if cfg, err = toGenericMap(built); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+		delete(cfg, "log")
+
+		keys := make([]string, 0, len(cfg))
+		for key := range cfg {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			value := cfg[key]
+			items, isList := value.([]interface{})
+			if !isList {
+				if existing, ok := merged[key]; ok {
+					if !sameJSON(existing, value) {
+						warnings = append(warnings, fmt.Sprintf("profile %s: kept the %s section of an earlier profile", profile.Name, key))
+					}
+					continue
+				}
+				merged[key] = value
+				continue
+			}
+
+			section, _ := merged[key].([]interface{})
+			if listNames[key] == nil {
+				listNames[key] = map[string]string{}
+			}
+			for _, item := range items {
+				obj, ok := item.(map[string]interface{})
+				name, _ := obj["name"].(string)
+				if !ok || name == "" {
+					section = append(section, item)
+					continue
+				}
+				rendered, _ := json.Marshal(obj)
+				if previous, seen := listNames[key][name]; seen {
+					// Profiles sharing a chain render it identically
+					if previous == string(rendered) {
+						continue
+					}
+					if key != "services" {
+						return nil, nil, nil, fmt.Errorf("profile %s: %s %q is defined differently by another profile", profile.Name, strings.TrimSuffix(key, "s"), name)
+					}
+					renamed := uniqueDeployName(listNames[key], name)
+					warnings = append(warnings, fmt.Sprintf("profile %s: service %q renamed to %q", profile.Name, name, renamed))
+					obj["name"] = renamed
+					name = renamed
+					rendered, _ = json.Marshal(obj)
+				}
+				listNames[key][name] = string(rendered)
+				if key == "services" {
+					owners[name] = profile.ID
+				}
+				section = append(section, obj)
+			}
+			merged[key] = section
+		}
+	}
+
+	return merged, owners, warnings, nil
+}
+
+// toGenericMap converts a rendered config to the map form raw configs use
+func toGenericMap(v interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// sameJSON reports whether two values encode identically
+func sameJSON(a, b interface{}) bool {
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(ja) == string(jb)
+}
+
+// uniqueDeployName appends -2, -3... to name until it is unused
+func uniqueDeployName(used map[string]string, name string) string {
+	for n := 2; ; n++ {
+		candidate := fmt.Sprintf("%s-%d", name, n)
+		if _, taken := used[candidate]; !taken {
+			return candidate
+		}
+	}
+}
+
+// deploySlug turns a profile name into a service name
+func deploySlug(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	slug := strings.TrimSuffix(b.String(), "-")
+	if slug == "" {
+		return "gost"
+	}
+	if len(slug) > 64 {
+		slug = strings.TrimSuffix(slug[:64], "-")
+	}
+	return slug
+}
+
+// referencedFiles returns the certificate and key files a config points to
+func referencedFiles(config interface{}) []string {
+	seen := map[string]bool{}
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			for key, child := range t {
+				if s, ok := child.(string); ok && s != "" && (key == "certFile" || key == "keyFile" || key == "caFile") {
+					seen[s] = true
+					continue
+				}
+				walk(child)
+			}
+		case []interface{}:
+			for _, child := range t {
+				walk(child)
+			}
+		}
+	}
+	walk(config)
+
+	files := make([]string, 0, len(seen))
+	for f := range seen {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// containsCredentials reports whether a config holds a password
+func containsCredentials(config interface{}) bool {
+	switch t := config.(type) {
+	case map[string]interface{}:
+		for key, child := range t {
+			if s, ok := child.(string); ok && s != "" && key == "password" {
+				return true
+			}
+			if containsCredentials(child) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, child := range t {
+			if containsCredentials(child) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var systemdTemplate = template.Must(template.New("systemd").Parse(`[Unit]
+Description=GOST tunnel {{.Name}}
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=simple
+ExecStart={{.Binary}} -C {{.ConfigPath}}
+Restart=on-failure
+RestartSec=5s
+NoNewPrivileges=true
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+var launchdTemplate = template.Must(template.New("launchd").Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>{{.Label}}</string>
+	<key>ProgramArguments</key>
+	<array>
+		<string>{{html .Binary}}</string>
+		<string>-C</string>
+		<string>{{html .ConfigPath}}</string>
+	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<true/>
+	<key>StandardErrorPath</key>
+	<string>/usr/local/var/log/{{.Name}}.log</string>
+</dict>
+</plist>
+`))
+
+var composeTemplate = template.Must(template.New("compose").Parse(`services:
+  {{.Name}}:
+    image: {{printf "%q" .Image}}
+    restart: unless-stopped
+    network_mode: host
+    command: ["-C", "/etc/gost/{{.ConfigFile}}"]
+    volumes:
+      - {{printf "%q" (print .ConfigPath ":/etc/gost/" .ConfigFile ":ro")}}
+{{- range .Files}}
+      - {{printf "%q" (print . ":" . ":ro")}}
+{{- end}}
+`))
+
+// renderDeployUnit renders the service definition for the chosen target
+func renderDeployUnit(opts DeployOptions, configFile string, files []string) (*DeployFile, error) {
+	data := struct {
+		Name, Label, Binary, ConfigPath, ConfigFile, Image string
+		Files                                              []string
+	}{
+		Name:       opts.Name,
+		Label:      "com.gostly." + opts.Name,
+		Binary:     opts.GostBinary,
+		ConfigPath: opts.ConfigPath,
+		ConfigFile: configFile,
+		Image:      opts.Image,
+		Files:      files,
+	}
+
+	var tmpl *template.Template
+	var name string
+	switch opts.Target {
+	case DeployTargetSystemd:
+		if strings.ContainsAny(opts.GostBinary+opts.ConfigPath, " \t\n") {
+			return nil, fmt.Errorf("systemd paths must not contain whitespace")
+		}
+		tmpl, name = systemdTemplate, opts.Name+".service"
+	case DeployTargetLaunchd:
+		tmpl, name = launchdTemplate, data.Label+".plist"
+	case DeployTargetCompose:
+		tmpl, name = composeTemplate, "docker-compose.yml"
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return nil, err
+	}
+	return &DeployFile{Name: name, Content: b.String()}, nil
+}
+
+// writeDeployment saves the generated files in dir. The config holds
+// credentials, so it is only readable by the current user.
+func writeDeployment(dir string, deployment *Deployment) ([]string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	configPath := filepath.Join(dir, deployment.Config.Name)
+	if err := os.WriteFile(configPath, []byte(deployment.Config.Content), 0600); err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(configPath, 0600); err != nil {
+		return nil, err
+	}
+	written := []string{configPath}
+
+	if deployment.Unit != nil {
+		unitPath := filepath.Join(dir, deployment.Unit.Name)
+		if err := os.WriteFile(unitPath, []byte(deployment.Unit.Content), 0644); err != nil {
+			return nil, err
+		}
+		written = append(written, unitPath)
+	}
+	return written, nil
+}
@@ -0,0 +1,128 @@
+package api
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event topics published on the API's event bus
+const (
+	TopicLog          = "log"           // Data is a LogEntry
+	TopicTimeline     = "timeline"      // Data is a TimelineEvent
+	TopicProfileState = "profile_state" // Data is a ProfileStateEvent
+	TopicHostRouter   = "host_router"   // Data is a HostRouterEvent
+)
+
+// Event is a change published to subscribers of the API
+type Event struct {
+	Topic string      `json:"topic"`
+	Data  interface{} `json:"data"`
+}
+
+// ProfileStateEvent reports a profile's lifecycle transition
+type ProfileStateEvent struct {
+	ProfileID    int64  `json:"profile_id"`
+	ProfileName  string `json:"profile_name"`
+	State        string `json:"state"`
+	LastError    string `json:"last_error,omitempty"`
+	RestartCount int    `json:"restart_count"`
+}
+
+// HostRouterEvent reports the host router starting or stopping
+type HostRouterEvent struct {
+	Running bool   `json:"running"`
+	Addr    string `json:"addr"`
+}
+
+// eventBus fans events out to subscribers without ever blocking the publisher
+type eventBus struct {
+	mu          sync.Mutex
+	subscribers map[*Subscription]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subscribers: make(map[*Subscription]struct{})}
+}
+
+// Subscription receives the API's events. A subscriber that falls behind
+// loses events rather than stalling the API; Dropped reports how many.
+type Subscription struct {
+	bus     *eventBus
+	events  chan Event
+	dropped atomic.Int64
+}
+
+// publish delivers an event to every subscriber with room for it
+func (b *eventBus) publish(topic string, data interface{}) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subscribers {
+		select {
+		case s.events <- Event{Topic: topic, Data: data}:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// Subscribe starts receiving events, buffering up to buffer of them
+func (a *API) Subscribe(buffer int) *Subscription {
+	if buffer < 1 {
+		buffer = 1
+	}
+	s := &Subscription{bus: a.events, events: make(chan Event, buffer)}
+	a.events.mu.Lock()
+	a.events.subscribers[s] = struct{}{}
+	a.events.mu.Unlock()
+	return s
+}
+
+// Events returns the subscription's channel, closed by Unsubscribe
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Dropped returns how many events were lost because the buffer was full
+func (s *Subscription) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// Unsubscribe stops delivery and closes the channel
+func (s *Subscription) Unsubscribe() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	if _, ok := s.bus.subscribers[s]; ok {
+		delete(s.bus.subscribers, s)
+		close(s.events)
+	}
+}
+
+// NextBatch waits for an event, then keeps collecting until max events are
+// gathered or window has passed since the first one. It returns false once
+// the subscription is closed and drained.
+func (s *Subscription) NextBatch(max int, window time.Duration) ([]Event, bool) {
+	first, ok := <-s.events
+	if !ok {
+		return nil, false
+	}
+	batch := []Event{first}
+
+	timer := time.NewTimer(window)
+	defer timer.Stop()
+	for len(batch) < max {
+		select {
+		case e, ok := <-s.events:
+			if !ok {
+				return batch, true
+			}
+			batch = append(batch, e)
+		case <-timer.C:
+			return batch, true
+		}
+	}
+	return batch, true
+}
@@ -0,0 +1,240 @@
+package api
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/imansprn/gostly/pkg/database"
+)
+
+// gostAPIPathPrefix is where the GOST Web API is served in generated configs
+const gostAPIPathPrefix = "/api"
+
+// GostAPIConfig enables GOST's Web API, used to reconfigure a running process
+type GostAPIConfig struct {
+	Addr       string    `json:"addr"`
+	PathPrefix string    `json:"pathPrefix,omitempty"`
+	AccessLog  bool      `json:"accesslog"`
+	Auth       *GostAuth `json:"auth,omitempty"`
+}
+
+// gostAPIClient talks to the Web API of a GOST process started by Gostly
+type gostAPIClient struct {
+	addr     string
+	username string
+	password string
+	http     *http.Client
+}
+
+// gostAPIError is an error response from the GOST Web API
+type gostAPIError struct {
+	Status  int
+	Code    int    `json:"code"`
+	Message string `json:"msg"`
+}
+
+func (e *gostAPIError) Error() string {
+	return fmt.Sprintf("GOST API returned %d: %s", e.Status, e.Message)
+}
+
+// newGostAPIClient picks a free loopback port and random credentials for a
+// process's Web API
+func newGostAPIClient() (*gostAPIClient, error) {
+	addr, password, err := loopbackEndpoint()
+	if err != nil {
+		return nil, err
+	}
+	return &gostAPIClient{
+		addr:     addr,
+		username: "gostly",
+		password: password,
+		http:     &http.Client{Timeout: 5 * time.Second},
+	}, nil
+}
+
+// loopbackEndpoint returns a free loopback address and a random password for
+// an endpoint served by a GOST process
+func loopbackEndpoint() (string, string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", "", err
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	return addr, hex.EncodeToString(secret), nil
+}
+
+// config returns the api block that makes GOST serve this client
+func (c *gostAPIClient) config() *GostAPIConfig {
+	return &GostAPIConfig{
+		Addr:       c.addr,
+		PathPrefix: gostAPIPathPrefix,
+		Auth:       &GostAuth{Username: c.username, Password: c.password},
+	}
+}
+
+// do sends a request to the API and decodes error responses
+func (c *gostAPIClient) do(method, path string, body interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, "http://"+c.addr+gostAPIPathPrefix+path, reader)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.username, c.password)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	apiErr := &gostAPIError{Status: resp.StatusCode}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err := json.Unmarshal(data, apiErr); err != nil || apiErr.Message == "" {
+		apiErr.Message = string(bytes.TrimSpace(data))
+	}
+	return apiErr
+}
+
+// updateService replaces a running service
+func (c *gostAPIClient) updateService(service GostService) error {
+	return c.do(http.MethodPut, "/config/services/"+url.PathEscape(service.Name), service)
+}
+
+// createChain adds a chain to the running config
+func (c *gostAPIClient) createChain(chain GostChain) error {
+	return c.do(http.MethodPost, "/config/chains", chain)
+}
+
+// updateChain replaces a chain in the running config
+func (c *gostAPIClient) updateChain(chain GostChain) error {
+	return c.do(http.MethodPut, "/config/chains/"+url.PathEscape(chain.Name), chain)
+}
+
+// deleteChain removes a chain from the running config
+func (c *gostAPIClient) deleteChain(name string) error {
+	return c.do(http.MethodDelete, "/config/chains/"+url.PathEscape(name), nil)
+}
+
+// applyLiveUpdate applies a saved profile change to its running process
+// through the GOST Web API. Changes the API can't swap in place (renames,
+// raw configs, processes without the API) fall back to a restart.
+func (a *API) applyLiveUpdate(proc *supervisedProcess, old, profile *database.Profile) error {
+	id := profile.ID
+
+	err := a.updateViaGostAPI(proc, old, profile)
+	if err == nil {
+		a.addLog("INFO", "api", fmt.Sprintf("Applied changes to running profile %s through the GOST API", profile.Name), &id, profile.Name)
+		a.addTimelineEvent("proxy_action", "Profile Reconfigured",
+			fmt.Sprintf("Running proxy profile '%s' reconfigured without a restart", profile.Name),
+			"success", "admin", "", profile.Name)
+		return nil
+	}
+
+	a.addLog("INFO", "api", fmt.Sprintf("Restarting profile %s to apply changes: %v", profile.Name, err), &id, profile.Name)
+	return a.restartProfile(proc)
+}
+
+// updateViaGostAPI swaps the profile's service and chain in the running process
+func (a *API) updateViaGostAPI(proc *supervisedProcess, old, profile *database.Profile) error {
+	a.mutex.Lock()
+	client := proc.api
+	state := proc.state
+	a.mutex.Unlock()
+
+	switch {
+	case client == nil:
+		return fmt.Errorf("the process was started without the GOST API")
+	case state != StateRunning:
+		return fmt.Errorf("the process is %s", state)
+	case isRawProfile(old) || isRawProfile(profile):
+		return fmt.Errorf("raw configs are applied by restarting")
+	case old.Name != profile.Name:
+		return fmt.Errorf("renamed services are applied by restarting")
+	}
+
+	config, err := a.buildGostConfig(profile)
+	if err != nil {
+		return err
+	}
+
+	oldChain := ""
+	if old.ChainID != 0 {
+		oldChain = chainName(&database.Chain{ID: old.ChainID})
+	}
+	newChain := ""
+	if len(config.Chains) > 0 {
+		chain := config.Chains[0]
+		newChain = chain.Name
+		if newChain == oldChain {
+			err = client.updateChain(chain)
+		} else {
+			err = client.createChain(chain)
+		}
+		if err != nil {
+			return fmt.Errorf("update chain %s: %w", chain.Name, err)
+		}
+	}
+
+	// Keep logging through the logger the process was started with
+	service := config.Services[0]
+	service.Logger = loggerName(profile.ID)
+	if err := client.updateService(service); err != nil {
+		return fmt.Errorf("update service %s: %w", profile.Name, err)
+	}
+
+	if oldChain != "" && oldChain != newChain {
+		if err := client.deleteChain(oldChain); err != nil {
+			a.addLog("WARN", "api", fmt.Sprintf("Failed to remove unused chain %s from profile %s: %v", oldChain, profile.Name, err), &profile.ID, profile.Name)
+		}
+	}
+
+	a.mutex.Lock()
+	proc.listen = profile.Listen
+	a.mutex.Unlock()
+	return nil
+}
+
+// restartProfile stops a running profile's process and starts it again with
+// its saved settings, keeping its desired state
+func (a *API) restartProfile(proc *supervisedProcess) error {
+	id := proc.profileID
+
+	a.terminate(proc, a.stopTimeoutDuration())
+
+	a.mutex.Lock()
+	if a.processes[id] == proc {
+		delete(a.processes, id)
+	}
+	a.mutex.Unlock()
+
+	return a.StartProfile(id)
+}
@@ -0,0 +1,398 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/imansprn/gostly/pkg/database"
+)
+
+// GostConfig represents a GOST v3 configuration file
+type GostConfig struct {
+	Services []GostService      `json:"services"`
+	Chains   []GostChain        `json:"chains,omitempty"`
+	Log      *GostLogConfig     `json:"log,omitempty"`
+	Loggers  []GostLogger       `json:"loggers,omitempty"`
+	API      *GostAPIConfig     `json:"api,omitempty"`
+	Metrics  *GostMetricsConfig `json:"metrics,omitempty"`
+}
+
+// GostService is a GOST service: a listener, a handler and an optional forwarder
+type GostService struct {
+	Name      string         `json:"name"`
+	Addr      string         `json:"addr"`
+	Handler   GostHandler    `json:"handler"`
+	Listener  *GostListener  `json:"listener,omitempty"`
+	Forwarder *GostForwarder `json:"forwarder,omitempty"`
+	Logger    string         `json:"logger,omitempty"`
+}
+
+// GostHandler configures how a service handles accepted connections
+type GostHandler struct {
+	Type     string                 `json:"type"`
+	Chain    string                 `json:"chain,omitempty"`
+	Auth     *GostAuth              `json:"auth,omitempty"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// GostListener configures how a service accepts connections
+type GostListener struct {
+	Type     string                 `json:"type"`
+	TLS      *GostTLS               `json:"tls,omitempty"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// GostForwarder lists the upstream nodes of a forwarding service
+type GostForwarder struct {
+	Nodes    []GostNode    `json:"nodes"`
+	Selector *GostSelector `json:"selector,omitempty"`
+}
+
+// GostSelector configures load balancing between forwarder nodes
+type GostSelector struct {
+	Strategy    string `json:"strategy"`
+	MaxFails    int    `json:"maxFails,omitempty"`
+	FailTimeout string `json:"failTimeout,omitempty"`
+}
+
+// GostChain is a named chain of hops
+type GostChain struct {
+	Name string    `json:"name"`
+	Hops []GostHop `json:"hops"`
+}
+
+// GostHop is a single hop of a chain
+type GostHop struct {
+	Name  string     `json:"name"`
+	Nodes []GostNode `json:"nodes"`
+}
+
+// GostNode is an upstream node of a forwarder or hop
+type GostNode struct {
+	Name      string                 `json:"name,omitempty"`
+	Addr      string                 `json:"addr"`
+	Connector *GostConnector         `json:"connector,omitempty"`
+	Dialer    *GostDialer            `json:"dialer,omitempty"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// GostConnector configures the proxy protocol spoken to a node
+type GostConnector struct {
+	Type     string                 `json:"type"`
+	Auth     *GostAuth              `json:"auth,omitempty"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// GostDialer configures the transport used to reach a node
+type GostDialer struct {
+	Type     string                 `json:"type"`
+	Auth     *GostAuth              `json:"auth,omitempty"`
+	TLS      *GostTLS               `json:"tls,omitempty"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// GostAuth holds username/password credentials
+type GostAuth struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// GostTLS holds TLS settings for listeners and dialers
+type GostTLS struct {
+	CertFile   string          `json:"certFile,omitempty"`
+	KeyFile    string          `json:"keyFile,omitempty"`
+	CAFile     string          `json:"caFile,omitempty"`
+	Secure     bool            `json:"secure,omitempty"`
+	ServerName string          `json:"serverName,omitempty"`
+	Options    *GostTLSOptions `json:"options,omitempty"`
+}
+
+// GostTLSOptions holds protocol-level TLS settings
+type GostTLSOptions struct {
+	MinVersion string `json:"minVersion,omitempty"`
+}
+
+// GostLogConfig configures GOST's own logging
+type GostLogConfig struct {
+	Level  string `json:"level"`
+	Format string `json:"format"`
+	Output string `json:"output"`
+}
+
+// GostLogger is a named logger that services can log through instead of
+// the process-wide log
+type GostLogger struct {
+	Name string         `json:"name"`
+	Log  *GostLogConfig `json:"log"`
+}
+
+// gostLogConfig is the log block injected into every generated config so
+// parseGostLog can parse GOST's output
+func gostLogConfig(level string) *GostLogConfig {
+	return &GostLogConfig{
+		Level:  level,
+		Format: "json",
+		Output: "stderr",
+	}
+}
+
+// chainName is the name a chain is given inside a generated config
+func chainName(chain *database.Chain) string {
+	return fmt.Sprintf("chain-%d", chain.ID)
+}
+
+// loggerName is the name of a profile's logger inside a generated config
+func loggerName(profileID int64) string {
+	return fmt.Sprintf("logger-%d", profileID)
+}
+
+// buildGostConfig renders a profile into a GOST config
+func (a *API) buildGostConfig(profile *database.Profile) (*GostConfig, error) {
+	handler, listener, err := resolveProtocols(profile)
+	if err != nil {
+		return nil, err
+	}
+
+	service := GostService{
+		Name: profile.Name,
+		Addr: profile.Listen,
+		Handler: GostHandler{
+			Type: handler.Type,
+		},
+		Listener: &GostListener{
+			Type: listener.Type,
+		},
+	}
+
+	if listener.supports(OptionTLS) {
+		service.Listener.TLS = renderListenerTLS(profile.TLS)
+	}
+
+	if profile.Username != "" && profile.Password != "" {
+		auth := &GostAuth{
+			Username: profile.Username,
+			Password: profile.Password,
+		}
+		if handler.supports(OptionAuth) {
+			service.Handler.Auth = auth
+		} else if listener.supports(OptionAuth) {
+			service.Listener.Metadata = map[string]interface{}{"username": auth.Username, "password": auth.Password}
+		}
+	}
+
+	if handler.supports(OptionRemote) {
+		service.Forwarder = renderForwarder(profile)
+	}
+
+	config := &GostConfig{
+		Services: []GostService{service},
+		Log:      gostLogConfig(defaultGostLogLevel),
+	}
+
+	if profile.ChainID != 0 {
+		chain, err := a.currentDB().GetChain(profile.ChainID)
+		if err != nil {
+			return nil, fmt.Errorf("load chain %d: %w", profile.ChainID, err)
+		}
+		config.Chains = append(config.Chains, renderChain(chain))
+		config.Services[0].Handler.Chain = chainName(chain)
+	}
+
+	return config, nil
+}
+
+// renderForwarder builds the forwarder block from the profile's upstream
+// nodes, falling back to the single Remote address
+func renderForwarder(profile *database.Profile) *GostForwarder {
+	if len(profile.Nodes) == 0 {
+		if profile.Remote == "" {
+			return nil
+		}
+		return &GostForwarder{
+			Nodes: []GostNode{{Name: "target-0", Addr: profile.Remote}},
+		}
+	}
+
+	forwarder := &GostForwarder{}
+	for i, n := range profile.Nodes {
+		name := n.Name
+		if name == "" {
+			name = fmt.Sprintf("target-%d", i)
+		}
+		node := GostNode{Name: name, Addr: n.Addr}
+		if n.Weight > 0 {
+			node.Metadata = map[string]interface{}{"weight": n.Weight}
+		}
+		forwarder.Nodes = append(forwarder.Nodes, node)
+	}
+
+	sel := profile.Selector
+	if sel.Strategy != "" || sel.MaxFails > 0 || sel.FailTimeout > 0 {
+		strategy := normalizeSelectorStrategy(sel.Strategy)
+		if strategy == "" {
+			strategy = "round"
+		}
+		forwarder.Selector = &GostSelector{
+			Strategy: strategy,
+			MaxFails: sel.MaxFails,
+		}
+		if sel.FailTimeout > 0 {
+			forwarder.Selector.FailTimeout = fmt.Sprintf("%ds", sel.FailTimeout)
+		}
+	}
+	return forwarder
+}
+
+// normalizeSelectorStrategy maps accepted strategy spellings to GOST's names
+func normalizeSelectorStrategy(strategy string) string {
+	switch strings.ToLower(strategy) {
+	case "round", "roundrobin", "round-robin":
+		return "round"
+	case "rand", "random":
+		return "rand"
+	case "fifo", "ha":
+		return "fifo"
+	case "hash":
+		return "hash"
+	case "":
+		return ""
+	}
+	return strategy
+}
+
+// renderChain converts a stored chain into its GOST representation
+func renderChain(chain *database.Chain) GostChain {
+	gc := GostChain{Name: chainName(chain)}
+	for i, hop := range chain.Hops {
+		name := hop.Name
+		if name == "" {
+			name = fmt.Sprintf("hop-%d", i)
+		}
+
+		node := GostNode{
+			Name:      name,
+			Addr:      hop.Addr,
+			Connector: &GostConnector{Type: hop.Connector},
+			Dialer:    &GostDialer{Type: hop.Dialer},
+		}
+		if hop.Username != "" || hop.Password != "" {
+			auth := &GostAuth{Username: hop.Username, Password: hop.Password}
+			// SSH hops authenticate at the transport level
+			if hop.Dialer == "ssh" || hop.Dialer == "sshd" {
+				node.Dialer.Auth = auth
+			} else {
+				node.Connector.Auth = auth
+			}
+		}
+		if dialerUsesTLS(hop.Dialer) {
+			node.Dialer.TLS = &GostTLS{
+				ServerName: hop.TLSServerName,
+				CAFile:     hop.TLSCAFile,
+				Secure:     hop.TLSSecure,
+				CertFile:   hop.TLSCertFile,
+				KeyFile:    hop.TLSKeyFile,
+			}
+		}
+
+		gc.Hops = append(gc.Hops, GostHop{Name: name, Nodes: []GostNode{node}})
+	}
+	return gc
+}
+
+// writeGostConfig writes a config to the cache dir and returns its path
+// The file holds credentials, so it is only readable by the current user.
+func writeGostConfig(name string, config interface{}) (string, error) {
+	configDir, err := gostConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	configPath := filepath.Join(configDir, name)
+
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	// Write to a private temp file and rename it into place so a
+	// pre-existing file never keeps looser permissions
+	tmp, err := os.CreateTemp(configDir, name+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), configPath); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	return configPath, nil
+}
+
+// gostConfigDir returns the private directory generated configs are written to
+func gostConfigDir() (string, error) {
+	configDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	configDir = filepath.Join(configDir, "gostly")
+	if err := os.MkdirAll(configDir, 0700); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(configDir, 0700); err != nil {
+		return "", err
+	}
+	return configDir, nil
+}
+
+// removeGostConfigs deletes generated configs left behind by a previous run
+// that did not shut down cleanly
+func removeGostConfigs() {
+	configDir, err := gostConfigDir()
+	if err != nil {
+		return
+	}
+	for _, pattern := range []string{"config_*.json", "config_*.json.*.tmp"} {
+		matches, _ := filepath.Glob(filepath.Join(configDir, pattern))
+		for _, path := range matches {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				fmt.Printf("API: failed to remove stale config %s: %v\n", path, err)
+			}
+		}
+	}
+}
+
+// createGostConfigWithLogging creates a GOST config with proper logging
+// configuration, serving the Web API and metrics for the clients that are set
+func (a *API) createGostConfigWithLogging(profile *database.Profile, client *gostAPIClient, metrics *gostMetricsClient) (string, error) {
+	if isRawProfile(profile) {
+		return createRawGostConfig(profile, a.gostLogLevelFor(profile), metrics)
+	}
+
+	config, err := a.buildGostConfig(profile)
+	if err != nil {
+		return "", err
+	}
+	level := a.gostLogLevelFor(profile)
+	config.Log = gostLogConfig(level)
+	config.Loggers = []GostLogger{{Name: loggerName(profile.ID), Log: gostLogConfig(level)}}
+	config.Services[0].Logger = loggerName(profile.ID)
+	if client != nil {
+		config.API = client.config()
+	}
+	if metrics != nil {
+		config.Metrics = metrics.config()
+	}
+	return writeGostConfig(fmt.Sprintf("config_%d.json", profile.ID), config)
+}
@@ -0,0 +1,705 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/imansprn/gostly/pkg/database"
+)
+
+// GostImportIssue describes a part of a native GOST config that could not be
+// mapped onto a profile or chain
+type GostImportIssue struct {
+	Path    string `json:"path"` // e.g. "services[0].handler.metadata" or "-L[1]"
+	Message string `json:"message"`
+}
+
+// GostImportReport is the result of ImportGostConfig
+type GostImportReport struct {
+	ImportReport
+	Unmapped []GostImportIssue `json:"unmapped"`
+}
+
+// ImportGostConfig imports a native GOST v3 config (JSON or YAML) or a v2
+// style "gost -L ... -F ..." command line as profiles and chains. Imported
+// items go through the same conflict handling and dry run as bundles.
+func (a *API) ImportGostConfig(text string, opts ImportOptions) (*GostImportReport, error) {
+	var bundle *Bundle
+	var issues []GostImportIssue
+	var err error
+	if looksLikeGostArgs(text) {
+		bundle, issues, err = parseGostArgs(text)
+	} else {
+		bundle, issues, err = parseGostConfig(text)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	report, err := a.importBundle(bundle, opts, "GOST Config Imported")
+	if err != nil {
+		return nil, err
+	}
+	if issues == nil {
+		issues = []GostImportIssue{}
+	}
+	for _, issue := range issues {
+		a.addLog("WARN", "api", fmt.Sprintf("GOST import: %s: %s", issue.Path, issue.Message), nil, "")
+	}
+	return &GostImportReport{ImportReport: *report, Unmapped: issues}, nil
+}
+
+// looksLikeGostArgs reports whether text is a command line rather than a config file
+func looksLikeGostArgs(text string) bool {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return false
+	}
+	first := fields[0]
+	return first == "gost" || strings.HasSuffix(first, "/gost") || strings.HasPrefix(first, "-L") || strings.HasPrefix(first, "-F")
+}
+
+// gostImporter collects the constructs an import could not map
+type gostImporter struct {
+	issues []GostImportIssue
+}
+
+// note records an unmapped construct
+func (im *gostImporter) note(path, format string, args ...interface{}) {
+	im.issues = append(im.issues, GostImportIssue{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// gostObject walks an object of a decoded GOST config and remembers which
+// keys were read, so everything else can be reported as unmapped. Methods
+// are safe to call on a nil object.
+type gostObject struct {
+	path   string
+	fields map[string]interface{}
+	used   map[string]bool
+}
+
+// newGostObject wraps v if it is an object
+func newGostObject(path string, v interface{}) *gostObject {
+	fields, ok := v.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	return &gostObject{path: path, fields: fields, used: map[string]bool{}}
+}
+
+// child returns the path of a key below this object
+func (o *gostObject) child(key string) string {
+	if o.path == "" {
+		return key
+	}
+	return o.path + "." + key
+}
+
+func (o *gostObject) value(key string) interface{} {
+	if o == nil {
+		return nil
+	}
+	o.used[key] = true
+	return o.fields[key]
+}
+
+func (o *gostObject) str(key string) string {
+	switch v := o.value(key).(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func (o *gostObject) integer(key string) int {
+	switch v := o.value(key).(type) {
+	case int:
+		return v
+	case float64:
+		return int(v)
+	case json.Number:
+		n, _ := v.Int64()
+		return int(n)
+	case string:
+		n, _ := strconv.Atoi(v)
+		return n
+	}
+	return 0
+}
+
+func (o *gostObject) boolean(key string) bool {
+	switch v := o.value(key).(type) {
+	case bool:
+		return v
+	case string:
+		b, _ := strconv.ParseBool(v)
+		return b
+	}
+	return false
+}
+
+func (o *gostObject) object(key string) *gostObject {
+	if o == nil {
+		return nil
+	}
+	return newGostObject(o.child(key), o.value(key))
+}
+
+func (o *gostObject) list(key string) []*gostObject {
+	if o == nil {
+		return nil
+	}
+	items, _ := o.value(key).([]interface{})
+	out := make([]*gostObject, 0, len(items))
+	for i, item := range items {
+		if obj := newGostObject(fmt.Sprintf("%s[%d]", o.child(key), i), item); obj != nil {
+			out = append(out, obj)
+		}
+	}
+	return out
+}
+
+// unmapped reports the keys that were never read
+func (o *gostObject) unmapped(im *gostImporter) {
+	if o == nil {
+		return
+	}
+	var keys []string
+	for key := range o.fields {
+		if !o.used[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		im.note(o.child(key), "not supported by Gostly profiles, ignored")
+	}
+}
+
+// newImportBundle returns an empty bundle for parsed native configs
+func newImportBundle() *Bundle {
+	return &Bundle{
+		Version:      BundleVersion,
+		ExportedAt:   time.Now().Format(time.RFC3339),
+		Secrets:      SecretsInclude,
+		Chains:       []BundleChain{},
+		Profiles:     []BundleProfile{},
+		HostMappings: []BundleHostMapping{},
+	}
+}
+
+// parseGostConfig maps the services and chains of a GOST v3 config onto
+// profiles and chains
+func parseGostConfig(text string) (*Bundle, []GostImportIssue, error) {
+	cfg, err := parseRawConfig(text)
+	if err != nil {
+		return nil, nil, err
+	}
+	im := &gostImporter{}
+	root := newGostObject("", cfg)
+	bundle := newImportBundle()
+
+	// Gostly generates its own log settings
+	root.value("log")
+
+	// Hops and authers can be defined at the top level and referenced by name
+	topHops := root.list("hops")
+	namedHops := map[string]*gostObject{}
+	for _, h := range topHops {
+		namedHops[h.str("name")] = h
+	}
+	authers := map[string]*gostObject{}
+	for _, a := range root.list("authers") {
+		authers[a.str("name")] = a
+	}
+
+	chains := map[string]bool{}
+	for i, c := range root.list("chains") {
+		chain := BundleChain{Name: c.str("name")}
+		if chain.Name == "" {
+			chain.Name = fmt.Sprintf("chain-%d", i)
+		}
+		for _, h := range c.list("hops") {
+			if named, ok := namedHops[h.str("name")]; ok && len(h.fields) == 1 {
+				h = named
+			}
+			nodes := h.list("nodes")
+			if len(nodes) == 0 {
+				im.note(h.path, "hop has no nodes, skipped")
+				continue
+			}
+			if len(nodes) > 1 {
+				im.note(h.child("nodes"), "only the first of %d nodes is imported, Gostly hops have a single node", len(nodes))
+			}
+			hop := gostHopFromNode(im, nodes[0])
+			if hop.Name == "" {
+				hop.Name = h.str("name")
+			}
+			chain.Hops = append(chain.Hops, hop)
+			h.unmapped(im)
+		}
+		c.unmapped(im)
+		chains[chain.Name] = true
+		bundle.Chains = append(bundle.Chains, chain)
+	}
+
+	for _, h := range topHops {
+		if len(h.used) == 1 {
+			im.note(h.path, "hop %q is not used by any chain, ignored", h.str("name"))
+		}
+	}
+
+	for i, svc := range root.list("services") {
+		if p, ok := gostProfileFromService(im, svc, i, chains, authers); ok {
+			bundle.Profiles = append(bundle.Profiles, p)
+		}
+	}
+	if len(bundle.Profiles) == 0 {
+		return nil, nil, fmt.Errorf("config has no services that can be imported")
+	}
+
+	root.unmapped(im)
+	return bundle, im.issues, nil
+}
+
+// gostProfileFromService maps a v3 service onto a profile
+func gostProfileFromService(im *gostImporter, svc *gostObject, index int, chains map[string]bool, authers map[string]*gostObject) (BundleProfile, bool) {
+	p := BundleProfile{Name: svc.str("name"), Listen: svc.str("addr")}
+	if p.Name == "" {
+		p.Name = fmt.Sprintf("service-%d", index)
+	}
+
+	h := svc.object("handler")
+	p.Type = h.str("type")
+	if p.Type == "" {
+		im.note(svc.child("handler.type"), "service has no handler type, skipped")
+		return p, false
+	}
+
+	p.Chain = h.str("chain")
+	p.Username, p.Password = gostAuth(im, h.object("auth"))
+	if name := h.str("auther"); name != "" {
+		auths := authers[name].list("auths")
+		if len(auths) == 1 {
+			p.Username, p.Password = gostAuth(im, auths[0])
+		} else {
+			im.note(h.child("auther"), "auther %q has %d users, a profile takes a single username and password", name, len(auths))
+		}
+	}
+	h.unmapped(im)
+
+	network := "tcp"
+	if spec, ok := handlerSpec(p.Type); ok {
+		network = spec.Network
+	}
+	if l := svc.object("listener"); l != nil {
+		if t := l.str("type"); t != network {
+			p.Listener = t
+		}
+		if chain := l.str("chain"); chain != "" && p.Chain == "" {
+			p.Chain = chain
+		}
+		if t := l.object("tls"); t != nil {
+			opts := database.TLSOptions{
+				CertFile:   t.str("certFile"),
+				KeyFile:    t.str("keyFile"),
+				CAFile:     t.str("caFile"),
+				ServerName: t.str("serverName"),
+			}
+			opts.ClientAuth = opts.CAFile != ""
+			if o := t.object("options"); o != nil {
+				version := o.str("minVersion")
+				for short, name := range tlsVersions {
+					if name == version {
+						opts.MinVersion = short
+					}
+				}
+				if opts.MinVersion == "" && version != "" {
+					im.note(o.child("minVersion"), "unknown TLS version %q", version)
+				}
+				o.unmapped(im)
+			}
+			p.TLS = &opts
+			t.unmapped(im)
+		}
+		l.unmapped(im)
+	}
+
+	if p.Chain != "" && !chains[p.Chain] {
+		im.note(svc.child("handler.chain"), "chain %q is not defined in the config", p.Chain)
+		p.Chain = ""
+	}
+
+	if f := svc.object("forwarder"); f != nil {
+		for _, n := range f.list("nodes") {
+			node := BundleNode{Name: n.str("name"), Addr: n.str("addr")}
+			if md := n.object("metadata"); md != nil {
+				node.Weight = md.integer("weight")
+				md.unmapped(im)
+			}
+			n.unmapped(im)
+			p.Nodes = append(p.Nodes, node)
+		}
+		if s := f.object("selector"); s != nil {
+			sel := database.Selector{Strategy: s.str("strategy"), MaxFails: s.integer("maxFails")}
+			if timeout := s.str("failTimeout"); timeout != "" {
+				if d, err := time.ParseDuration(timeout); err == nil {
+					sel.FailTimeout = int(d.Seconds())
+				} else if n, err := strconv.Atoi(timeout); err == nil {
+					sel.FailTimeout = n
+				} else {
+					im.note(s.child("failTimeout"), "invalid duration %q", timeout)
+				}
+			}
+			p.Selector = &sel
+			s.unmapped(im)
+		}
+		f.unmapped(im)
+	}
+
+	// A single plain node is what the Remote field renders to
+	if len(p.Nodes) == 1 && p.Selector == nil && p.Nodes[0].Weight == 0 {
+		p.Remote = p.Nodes[0].Addr
+		p.Nodes = nil
+	}
+
+	svc.unmapped(im)
+	return p, true
+}
+
+// gostHopFromNode maps a v3 chain node onto a hop
+func gostHopFromNode(im *gostImporter, n *gostObject) BundleHop {
+	hop := BundleHop{Name: n.str("name"), Addr: n.str("addr"), Connector: "http", Dialer: "tcp"}
+	if c := n.object("connector"); c != nil {
+		if t := c.str("type"); t != "" {
+			hop.Connector = t
+		}
+		hop.Username, hop.Password = gostAuth(im, c.object("auth"))
+		c.unmapped(im)
+	}
+	if d := n.object("dialer"); d != nil {
+		if t := d.str("type"); t != "" {
+			hop.Dialer = t
+		}
+		if user, pass := gostAuth(im, d.object("auth")); user != "" {
+			hop.Username, hop.Password = user, pass
+		}
+		if t := d.object("tls"); t != nil {
+			hop.TLSServerName = t.str("serverName")
+			hop.TLSCAFile = t.str("caFile")
+			hop.TLSSecure = t.boolean("secure")
+			hop.TLSCertFile = t.str("certFile")
+			hop.TLSKeyFile = t.str("keyFile")
+			t.unmapped(im)
+		}
+		d.unmapped(im)
+	}
+	n.unmapped(im)
+	return hop
+}
+
+// gostAuth reads a username/password auth object
+func gostAuth(im *gostImporter, auth *gostObject) (string, string) {
+	username, password := auth.str("username"), auth.str("password")
+	auth.unmapped(im)
+	return username, password
+}
+
+// v2HandlerAliases maps GOST v2 scheme protocols to v3 handler types
+var v2HandlerAliases = map[string]string{
+	"":         "auto",
+	"socks":    "socks5",
+	"socks4a":  "socks4",
+	"redirect": "red",
+}
+
+// v2ImpliedListeners are v2 protocols whose v3 handler needs a matching listener
+var v2ImpliedListeners = map[string]string{
+	"rtcp":  "rtcp",
+	"rudp":  "rudp",
+	"red":   "red",
+	"redu":  "redu",
+	"dns":   "dns",
+	"sshd":  "sshd",
+	"http2": "http2",
+}
+
+// v2URL is a parsed v2 node string: [protocol+transport://][user:pass@]host:port[/remote][?params]
+type v2URL struct {
+	protocol  string
+	transport string
+	username  string
+	password  string
+	addr      string
+	remote    string
+	params    url.Values
+}
+
+// parseV2URL splits a v2 -L or -F value
+func parseV2URL(raw string) (*v2URL, error) {
+	u := &v2URL{}
+	scheme, rest, ok := strings.Cut(raw, "://")
+	if !ok {
+		scheme, rest = "", raw
+	}
+	u.protocol, u.transport, _ = strings.Cut(strings.ToLower(scheme), "+")
+
+	rest, query, _ := strings.Cut(rest, "?")
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid parameters: %w", err)
+	}
+	u.params = params
+
+	if at := strings.LastIndex(rest, "@"); at >= 0 {
+		userinfo := rest[:at]
+		rest = rest[at+1:]
+		user, pass, _ := strings.Cut(userinfo, ":")
+		if u.username, err = url.PathUnescape(user); err != nil {
+			return nil, fmt.Errorf("invalid username: %w", err)
+		}
+		if u.password, err = url.PathUnescape(pass); err != nil {
+			return nil, fmt.Errorf("invalid password: %w", err)
+		}
+	}
+
+	u.addr, u.remote, _ = strings.Cut(rest, "/")
+	if u.addr == "" {
+		return nil, fmt.Errorf("missing address")
+	}
+	return u, nil
+}
+
+// parseGostArgs maps a v2 style command line onto profiles: one per -L,
+// with all -F nodes forming a chain in front of them
+func parseGostArgs(line string) (*Bundle, []GostImportIssue, error) {
+	args, err := splitCommandLine(line)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(args) > 0 && (args[0] == "gost" || strings.HasSuffix(args[0], "/gost")) {
+		args = args[1:]
+	}
+
+	im := &gostImporter{}
+	var listeners, forwards []string
+	for i := 0; i < len(args); i++ {
+		flagName, value, hasValue := strings.Cut(args[i], "=")
+		switch flagName {
+		case "-L", "-F":
+			if !hasValue {
+				if i+1 >= len(args) {
+					return nil, nil, fmt.Errorf("%s needs a value", flagName)
+				}
+				i++
+				value = args[i]
+			}
+			if flagName == "-L" {
+				listeners = append(listeners, value)
+			} else {
+				forwards = append(forwards, value)
+			}
+		case "-C":
+			if !hasValue && i+1 < len(args) {
+				i++
+			}
+			im.note("-C", "import the config file itself instead")
+		default:
+			im.note(args[i], "flag is not supported, ignored")
+		}
+	}
+	if len(listeners) == 0 {
+		return nil, nil, fmt.Errorf("command line has no -L listeners")
+	}
+
+	bundle := newImportBundle()
+	chainName := ""
+	if len(forwards) > 0 {
+		chain := BundleChain{}
+		var addrs []string
+		for i, raw := range forwards {
+			path := fmt.Sprintf("-F[%d]", i)
+			u, err := parseV2URL(raw)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s %q: %w", path, raw, err)
+			}
+			chain.Hops = append(chain.Hops, v2Hop(im, path, u))
+			addrs = append(addrs, u.addr)
+		}
+		chain.Name = "via " + strings.Join(addrs, " -> ")
+		chainName = chain.Name
+		bundle.Chains = append(bundle.Chains, chain)
+	}
+
+	for i, raw := range listeners {
+		path := fmt.Sprintf("-L[%d]", i)
+		u, err := parseV2URL(raw)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s %q: %w", path, raw, err)
+		}
+		bundle.Profiles = append(bundle.Profiles, v2Profile(im, path, u, chainName))
+	}
+	return bundle, im.issues, nil
+}
+
+// v2Profile maps a v2 -L value onto a profile
+func v2Profile(im *gostImporter, path string, u *v2URL, chain string) BundleProfile {
+	handler := u.protocol
+	listener := u.transport
+	if _, ok := handlerSpecs[handler]; !ok {
+		if alias, ok := v2HandlerAliases[handler]; ok {
+			handler = alias
+		} else if _, isListener := listenerSpecs[handler]; isListener && listener == "" {
+			// "tls://:443" is an auto proxy over TLS
+			handler, listener = "auto", handler
+		}
+	}
+	if listener == "" {
+		listener = v2ImpliedListeners[handler]
+	}
+	if listener == "tcp" || listener == "udp" {
+		listener = ""
+	}
+
+	p := BundleProfile{
+		Name:     fmt.Sprintf("%s %s", handler, u.addr),
+		Type:     handler,
+		Listener: listener,
+		Listen:   u.addr,
+		Username: u.username,
+		Password: u.password,
+		Chain:    chain,
+	}
+
+	if u.remote != "" {
+		targets := strings.Split(u.remote, ",")
+		if len(targets) == 1 {
+			p.Remote = targets[0]
+		} else {
+			for _, t := range targets {
+				p.Nodes = append(p.Nodes, BundleNode{Addr: t})
+			}
+		}
+	}
+
+	tls := database.TLSOptions{
+		CertFile: u.params.Get("cert"),
+		KeyFile:  u.params.Get("key"),
+		CAFile:   u.params.Get("ca"),
+	}
+	tls.ClientAuth = tls.CAFile != ""
+	if tls != (database.TLSOptions{}) {
+		p.TLS = &tls
+	}
+	noteV2Params(im, path, u.params, "cert", "key", "ca")
+	return p
+}
+
+// v2Hop maps a v2 -F value onto a chain hop
+func v2Hop(im *gostImporter, path string, u *v2URL) BundleHop {
+	connector := u.protocol
+	dialer := u.transport
+	if alias, ok := v2HandlerAliases[connector]; ok {
+		connector = alias
+	}
+	if connector == "auto" {
+		connector = "http"
+	}
+	if _, isConnector := chainConnectorTypes[connector]; !isConnector && dialer == "" && chainDialerTypes[connector] {
+		// "tls://host:443" is an HTTP proxy reached over TLS
+		connector, dialer = "http", connector
+	}
+	if dialer == "" {
+		dialer = "tcp"
+	}
+	if u.remote != "" {
+		im.note(path, "path %q is ignored on -F nodes", u.remote)
+	}
+
+	hop := BundleHop{
+		Addr:          u.addr,
+		Connector:     connector,
+		Dialer:        dialer,
+		Username:      u.username,
+		Password:      u.password,
+		TLSServerName: u.params.Get("serverName"),
+		TLSCAFile:     u.params.Get("ca"),
+		TLSCertFile:   u.params.Get("cert"),
+		TLSKeyFile:    u.params.Get("key"),
+	}
+	hop.TLSSecure, _ = strconv.ParseBool(u.params.Get("secure"))
+	noteV2Params(im, path, u.params, "serverName", "ca", "cert", "key", "secure")
+	return hop
+}
+
+// noteV2Params reports the query parameters that were not mapped
+func noteV2Params(im *gostImporter, path string, params url.Values, mapped ...string) {
+	var keys []string
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		known := false
+		for _, m := range mapped {
+			known = known || key == m
+		}
+		if !known {
+			im.note(path+"?"+key, "parameter is not supported by Gostly profiles, ignored")
+		}
+	}
+}
+
+// splitCommandLine splits a shell-like command line on whitespace, honouring
+// single and double quotes and backslash line continuations
+func splitCommandLine(line string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	var quote rune
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == '\\' && i+1 < len(runes):
+			i++
+			if runes[i] != '\n' {
+				current.WriteRune(runes[i])
+				inArg = true
+			}
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in command line")
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GOST log fields promoted to first-class LogEntry fields, in order of preference
+var (
+	gostSrcFields = []string{"remote", "client", "src"}
+	gostDstFields = []string{"dst", "host"}
+)
+
+// parseGostLog turns a line of GOST output into a log entry. JSON lines get
+// their level, message and fields; anything else is kept as written with a
+// level guessed from its text.
+func parseGostLog(line string) LogEntry {
+	entry := LogEntry{Source: "gost", Message: line}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &data); err != nil {
+		entry.Level = detectLogLevelFromText(line)
+		return entry
+	}
+
+	if _, ok := data["level"].(string); ok {
+		entry.Level = gostLevel(data["level"])
+	} else {
+		entry.Level = detectLogLevelFromText(line)
+	}
+	entry.Fields = make(map[string]string, len(data))
+	for key, value := range data {
+		switch key {
+		case "level", "time", "msg":
+			continue
+		}
+		entry.Fields[key] = logFieldString(value)
+	}
+
+	if msg, _ := data["msg"].(string); msg != "" {
+		entry.Message = msg
+	} else if err := entry.Fields["error"]; err != "" {
+		entry.Message = err
+	}
+	for _, key := range gostSrcFields {
+		if entry.Src = entry.Fields[key]; entry.Src != "" {
+			break
+		}
+	}
+	for _, key := range gostDstFields {
+		if entry.Dst = entry.Fields[key]; entry.Dst != "" {
+			break
+		}
+	}
+	switch d := data["duration"].(type) {
+	case float64:
+		// Durations are encoded as nanoseconds
+		entry.DurationMs = d / float64(time.Millisecond)
+	case string:
+		if parsed, err := time.ParseDuration(d); err == nil {
+			entry.DurationMs = float64(parsed) / float64(time.Millisecond)
+		}
+	}
+	return entry
+}
+
+// gostLevel converts a GOST log level to ours
+func gostLevel(level interface{}) string {
+	s, _ := level.(string)
+	switch strings.ToLower(s) {
+	case "debug", "trace":
+		return "DEBUG"
+	case "warn", "warning":
+		return "WARN"
+	case "error", "fatal", "panic":
+		return "ERROR"
+	default:
+		return "INFO" // Default to INFO for unknown levels
+	}
+}
+
+// logFieldString renders a JSON log field value as text
+func logFieldString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return ""
+	default:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+}
+
+// gostError returns the most specific error text of a GOST log entry
+func (e LogEntry) gostError() string {
+	if err := e.Fields["error"]; err != "" {
+		return err
+	}
+	return e.Message
+}
+
+// gostBytes returns the bytes a GOST connection log entry reports moving
+func (e LogEntry) gostBytes() (in, out int64) {
+	in, _ = strconv.ParseInt(e.Fields["inputBytes"], 10, 64)
+	out, _ = strconv.ParseInt(e.Fields["outputBytes"], 10, 64)
+	return in, out
+}
+
+// addGostLog records a parsed line of GOST output against a profile
+func (a *API) addGostLog(entry LogEntry, profileID *int64, profileName string) {
+	entry.ProfileID = profileID
+	entry.ProfileName = profileName
+	a.appendLog(entry)
+	if profileID != nil {
+		a.recordLogStats(*profileID, entry)
+	}
+}
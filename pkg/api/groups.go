@@ -0,0 +1,616 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/imansprn/gostly/pkg/database"
+)
+
+var groupNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9 ._-]{0,63}$`)
+
+// processGroup is a single GOST process running the services of every
+// started profile in a group. Members keep their own supervisedProcess so
+// their status is tracked individually; the group owns the command and
+// restarts it as a whole. All mutable fields are guarded by API.mutex.
+type processGroup struct {
+	name       string
+	configName string
+	members    map[int64]*supervisedProcess
+	services   map[string]int64 // GOST service name -> member profile ID
+
+	lastGostError string // most recent ERROR line not attributed to a member
+
+	metrics *gostMetricsClient // metrics endpoint of the current process, nil when not enabled
+
+	cmd        *exec.Cmd
+	output     *sync.WaitGroup
+	configPath string
+	startedAt  time.Time
+
+	stopCh        chan struct{} // closed when the last member leaves
+	done          chan struct{} // closed when the supervisor goroutine returns
+	stopRequested bool
+	relaunch      bool // the process was killed to apply a config it can't reload
+
+	// SIGHUP kills a process that hasn't installed its handler yet, so
+	// reloads wait until the process has brought up a listener
+	ready         bool
+	pendingReload bool
+
+	restarts     int
+	failures     int
+	lastExitCode int
+
+	reloadMu sync.Mutex // serializes config rewrites and reloads
+}
+
+// startGroupMember starts a profile inside its group's GOST process,
+// launching the process for the first member and reloading it otherwise
+func (a *API) startGroupMember(profile *database.Profile) error {
+	id := profile.ID
+	proc := newSupervisedProcess(profile, a.events)
+
+	a.mutex.Lock()
+	g := a.groups[profile.Group]
+	if g == nil {
+		a.groupSeq++
+		g = &processGroup{
+			name:       profile.Group,
+			configName: fmt.Sprintf("config_group_%d.json", a.groupSeq),
+			members:    map[int64]*supervisedProcess{},
+			stopCh:     make(chan struct{}),
+			done:       make(chan struct{}),
+		}
+		proc.group = g
+		g.members[id] = proc
+		a.groups[g.name] = g
+		a.processes[id] = proc
+		a.mutex.Unlock()
+
+		if err := a.launchGroupProcess(g); err != nil {
+			a.mutex.Lock()
+			delete(g.members, id)
+			if a.processes[id] == proc {
+				delete(a.processes, id)
+			}
+			a.mutex.Unlock()
+			// Profiles that joined while the process was being launched fail with it
+			a.failGroup(g, err.Error(), a.markFailed)
+			return err
+		}
+		go a.superviseGroup(g)
+		return nil
+	}
+
+	proc.group = g
+	proc.setState(StateStarting, "")
+	proc.startedAt = time.Now()
+	g.members[id] = proc
+	a.processes[id] = proc
+	a.mutex.Unlock()
+
+	reloaded, err := a.reloadGroup(g)
+	if err != nil {
+		a.mutex.Lock()
+		delete(g.members, id)
+		if a.processes[id] == proc {
+			delete(a.processes, id)
+		}
+		a.mutex.Unlock()
+		a.addLog("ERROR", "api", fmt.Sprintf("Failed to add profile %s to group %s: %v", profile.Name, g.name, err), &id, profile.Name)
+		return err
+	}
+	// Otherwise the member is picked up when the group's process is next launched
+	if reloaded {
+		go a.awaitListener(proc, profile)
+	}
+	return nil
+}
+
+// leaveGroup removes a member from its group. The group's process is
+// reloaded without the member, or stopped when it was the last one.
+func (a *API) leaveGroup(proc *supervisedProcess, timeout time.Duration) (int, bool) {
+	g := proc.group
+
+	a.mutex.Lock()
+	proc.requestStop()
+	active := a.groups[g.name] == g
+	delete(g.members, proc.profileID)
+	last := active && len(g.members) == 0
+	if last {
+		g.stopRequested = true
+		close(g.stopCh)
+		delete(a.groups, g.name)
+	}
+	a.mutex.Unlock()
+
+	exitCode, killed := 0, false
+	if last {
+		exitCode, killed = a.terminateGroup(g, timeout)
+	} else if active {
+		if _, err := a.reloadGroup(g); err != nil {
+			a.addLog("WARN", "api", fmt.Sprintf("Failed to reload group %s without profile %s: %v", g.name, proc.profileName, err), &proc.profileID, proc.profileName)
+		}
+	}
+
+	a.mutex.Lock()
+	proc.lastExitCode = exitCode
+	proc.setState(StateStopped, "")
+	a.mutex.Unlock()
+	return exitCode, killed
+}
+
+// terminateGroup stops a group's process like terminate stops a profile's
+func (a *API) terminateGroup(g *processGroup, timeout time.Duration) (int, bool) {
+	a.mutex.Lock()
+	cmd := g.cmd
+	a.mutex.Unlock()
+
+	forced := false
+	if cmd != nil && cmd.Process != nil {
+		if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+			cmd.Process.Kill()
+			forced = true
+		}
+	}
+
+	killed := false
+	select {
+	case <-g.done:
+	case <-time.After(timeout):
+		killed = true
+		a.addLog("WARN", "api", fmt.Sprintf("Group %s didn't stop within %s, killing it", g.name, timeout), nil, "")
+		if cmd != nil && cmd.Process != nil {
+			cmd.Process.Kill()
+		}
+		<-g.done
+	}
+
+	a.mutex.Lock()
+	exitCode := g.lastExitCode
+	a.mutex.Unlock()
+	if forced {
+		exitCode = -1
+	}
+	return exitCode, killed
+}
+
+// reloadGroup rewrites a running group's config and has GOST reload it with
+// SIGHUP. Where signals are unsupported the process is restarted instead. It
+// reports whether the running process will pick up the new config.
+func (a *API) reloadGroup(g *processGroup) (bool, error) {
+	g.reloadMu.Lock()
+	defer g.reloadMu.Unlock()
+
+	a.mutex.Lock()
+	cmd := g.cmd
+	stopping := g.stopRequested
+	ready := g.ready
+	if !ready {
+		g.pendingReload = true
+	}
+	a.mutex.Unlock()
+	if cmd == nil || cmd.Process == nil || stopping {
+		return false, nil
+	}
+	if !ready {
+		return true, nil
+	}
+
+	config, services, _, err := a.buildGroupConfig(g)
+	if err != nil {
+		return false, err
+	}
+	if _, err := writeGostConfig(g.configName, config); err != nil {
+		return false, err
+	}
+
+	a.mutex.Lock()
+	g.services = services
+	a.mutex.Unlock()
+
+	if err := cmd.Process.Signal(syscall.SIGHUP); err != nil {
+		a.addLog("DEBUG", "api", fmt.Sprintf("Failed to send SIGHUP to group %s, restarting it: %v", g.name, err), nil, "")
+		a.mutex.Lock()
+		g.relaunch = true
+		a.mutex.Unlock()
+		cmd.Process.Kill()
+		return false, nil
+	}
+
+	a.addLog("INFO", "api", fmt.Sprintf("Reloaded group %s with %d profiles", g.name, len(services)), nil, "")
+	return true, nil
+}
+
+// reloadGroupMember applies the saved changes of a running member by
+// reloading its group's process
+func (a *API) reloadGroupMember(g *processGroup, profile *database.Profile) {
+	a.mutex.Lock()
+	if proc, ok := g.members[profile.ID]; ok {
+		proc.listen = profile.Listen
+	}
+	a.mutex.Unlock()
+
+	if _, err := a.reloadGroup(g); err != nil {
+		a.addLog("ERROR", "api", fmt.Sprintf("Failed to reload group %s with the changes to profile %s: %v", g.name, profile.Name, err), &profile.ID, profile.Name)
+		return
+	}
+	a.addTimelineEvent("proxy_action", "Group Reloaded",
+		fmt.Sprintf("Group %s reloaded to apply changes to proxy profile '%s'", g.name, profile.Name),
+		"success", "admin", "", profile.Name)
+}
+
+// buildGroupConfig renders the group's members into one multi-service config
+func (a *API) buildGroupConfig(g *processGroup) (map[string]interface{}, map[string]int64, []*database.Profile, error) {
+	a.mutex.Lock()
+	ids := make([]int64, 0, len(g.members))
+	for id := range g.members {
+		ids = append(ids, id)
+	}
+	a.mutex.Unlock()
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	profiles := make([]*database.Profile, 0, len(ids))
+	for _, id := range ids {
+		profile, err := a.currentDB().GetProfile(id)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("load profile %d: %w", id, err)
+		}
+		profiles = append(profiles, profile)
+	}
+
+	config, services, warnings, err := a.mergeProfileConfigs(profiles)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, w := range warnings {
+		a.addLog("WARN", "api", fmt.Sprintf("Group %s: %s", g.name, w), nil, "")
+	}
+	config["log"] = gostLogConfig(a.GetGostLogLevel())
+	attachProfileLoggers(config, services, profiles, a.gostLogLevelFor)
+
+	a.mutex.Lock()
+	if g.metrics != nil {
+		config["metrics"] = g.metrics.config()
+	}
+	a.mutex.Unlock()
+	return config, services, profiles, nil
+}
+
+// attachProfileLoggers gives every service in a merged config the logger of
+// the profile it belongs to, so each member logs at its own level. Services
+// of raw configs that pick their own logger keep it.
+func attachProfileLoggers(config map[string]interface{}, owners map[string]int64, profiles []*database.Profile, levelFor func(*database.Profile) string) {
+	used := map[int64]bool{}
+	services, _ := config["services"].([]interface{})
+	for _, item := range services {
+		service, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _ := service["name"].(string)
+		id, owned := owners[name]
+		_, hasLogger := service["logger"]
+		_, hasLoggers := service["loggers"]
+		if !owned || hasLogger || hasLoggers {
+			continue
+		}
+		service["logger"] = loggerName(id)
+		used[id] = true
+	}
+
+	loggers, _ := config["loggers"].([]interface{})
+	for _, profile := range profiles {
+		if used[profile.ID] {
+			loggers = append(loggers, GostLogger{Name: loggerName(profile.ID), Log: gostLogConfig(levelFor(profile))})
+		}
+	}
+	if len(loggers) > 0 {
+		config["loggers"] = loggers
+	}
+}
+
+// launchGroupProcess writes the group's config and starts its GOST process
+func (a *API) launchGroupProcess(g *processGroup) error {
+	g.reloadMu.Lock()
+	defer g.reloadMu.Unlock()
+
+	// Each process gets its own metrics endpoint so its counters are told
+	// apart from the previous one's
+	metrics, err := newGostMetricsClient()
+	if err != nil {
+		metrics = nil
+	}
+	a.mutex.Lock()
+	g.metrics = metrics
+	a.mutex.Unlock()
+
+	config, services, profiles, err := a.buildGroupConfig(g)
+	if err != nil {
+		a.addLog("ERROR", "api", fmt.Sprintf("Failed to create config for group %s: %v", g.name, err), nil, "")
+		return err
+	}
+	configPath, err := writeGostConfig(g.configName, config)
+	if err != nil {
+		a.addLog("ERROR", "api", fmt.Sprintf("Failed to create config for group %s: %v", g.name, err), nil, "")
+		return err
+	}
+
+	cmd := exec.Command(a.getGostPath(), "-C", configPath)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		os.Remove(configPath)
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		os.Remove(configPath)
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		a.addLog("ERROR", "api", fmt.Sprintf("Failed to start GOST process for group %s: %v", g.name, err), nil, "")
+		os.Remove(configPath)
+		return err
+	}
+
+	output := &sync.WaitGroup{}
+	output.Add(2)
+
+	now := time.Now()
+	a.mutex.Lock()
+	g.cmd = cmd
+	g.output = output
+	g.configPath = configPath
+	g.startedAt = now
+	g.services = services
+	g.lastGostError = ""
+	g.ready = false
+	g.pendingReload = false
+	for _, m := range g.members {
+		m.startedAt = now
+		m.lastGostError = ""
+		m.setState(StateStarting, "")
+	}
+	a.mutex.Unlock()
+
+	a.addLog("INFO", "gost", fmt.Sprintf("GOST process started for group %s with %d profiles (PID: %d)", g.name, len(profiles), cmd.Process.Pid), nil, "")
+
+	go func() {
+		defer output.Done()
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			line := scanner.Text()
+			entry := parseGostLog(line)
+			entry.Level = "INFO"
+			a.handleGroupOutput(g, line, entry)
+		}
+	}()
+
+	go func() {
+		defer output.Done()
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			line := scanner.Text()
+			a.handleGroupOutput(g, line, parseGostLog(line))
+		}
+	}()
+
+	a.mutex.Lock()
+	for _, profile := range profiles {
+		if proc, ok := g.members[profile.ID]; ok {
+			go a.awaitListener(proc, profile)
+		}
+	}
+	a.mutex.Unlock()
+	return nil
+}
+
+// groupReady records that a group's process is up and applies any reload
+// that was held back while it started
+func (a *API) groupReady(g *processGroup) {
+	a.mutex.Lock()
+	pending := !g.ready && g.pendingReload
+	g.ready = true
+	g.pendingReload = false
+	a.mutex.Unlock()
+
+	if pending {
+		if _, err := a.reloadGroup(g); err != nil {
+			a.addLog("ERROR", "api", fmt.Sprintf("Failed to reload group %s: %v", g.name, err), nil, "")
+		}
+	}
+}
+
+// handleGroupOutput logs a line of a group's GOST output against the member
+// whose service produced it
+func (a *API) handleGroupOutput(g *processGroup, line string, entry LogEntry) {
+	a.mutex.Lock()
+	id, owned := g.services[entry.Fields["service"]]
+	proc := g.members[id]
+	if entry.Level == "ERROR" {
+		if proc != nil {
+			proc.lastGostError = entry.gostError()
+		} else {
+			g.lastGostError = entry.gostError()
+		}
+	}
+	a.mutex.Unlock()
+
+	if !owned || proc == nil {
+		entry.Message = fmt.Sprintf("[group %s] %s", g.name, entry.Message)
+		a.addGostLog(entry, nil, "")
+		return
+	}
+	a.addGostLog(entry, &id, proc.profileName)
+	if entry.Level != "ERROR" && isGostListeningLine(line) {
+		a.markRunning(proc, "GOST log")
+	}
+}
+
+// superviseGroup waits for the group's GOST process and restarts it with
+// exponential backoff when it exits while the group still has members
+func (a *API) superviseGroup(g *processGroup) {
+	defer close(g.done)
+
+	for {
+		a.mutex.Lock()
+		cmd := g.cmd
+		output := g.output
+		a.mutex.Unlock()
+
+		output.Wait()
+		exitCode := waitExitCode(cmd)
+
+		a.mutex.Lock()
+		os.Remove(g.configPath)
+		g.cmd = nil
+		g.lastExitCode = exitCode
+		stopping := g.stopRequested
+		relaunch := g.relaunch
+		g.relaunch = false
+		// Nothing ever came up: the config is broken, restarting won't help
+		neverStarted := g.restarts == 0
+		for _, m := range g.members {
+			m.lastExitCode = exitCode
+			if m.state == StateRunning {
+				neverStarted = false
+			}
+		}
+		if !stopping && !relaunch {
+			if time.Since(g.startedAt) >= supervisorStableAfter {
+				g.failures = 0
+			}
+			g.failures++
+		}
+		failures := g.failures
+		lastErr := g.lastGostError
+		a.mutex.Unlock()
+
+		if stopping {
+			a.addLog("INFO", "gost", fmt.Sprintf("GOST process exited for group %s (exit code %d)", g.name, exitCode), nil, "")
+			return
+		}
+
+		if relaunch {
+			if err := a.launchGroupProcess(g); err == nil {
+				continue
+			}
+			a.mutex.Lock()
+			g.failures++
+			failures = g.failures
+			a.mutex.Unlock()
+		}
+
+		if lastErr == "" {
+			lastErr = fmt.Sprintf("GOST exited with code %d", exitCode)
+		}
+
+		if neverStarted && !relaunch {
+			a.failGroup(g, lastErr, a.markFailed)
+			return
+		}
+
+		a.addLog("ERROR", "gost", fmt.Sprintf("GOST process for group %s exited unexpectedly (exit code %d)", g.name, exitCode), nil, "")
+
+		if failures > supervisorMaxRestarts {
+			a.failGroup(g, lastErr, a.markCrashLooping)
+			return
+		}
+
+		if !a.restartGroupAfterBackoff(g, failures) {
+			return
+		}
+	}
+}
+
+// restartGroupAfterBackoff sleeps for the backoff period and relaunches the
+// group, retrying launch failures within the same restart budget. It returns
+// false when the supervisor should exit.
+func (a *API) restartGroupAfterBackoff(g *processGroup, failures int) bool {
+	for {
+		backoff := supervisorBackoff(failures)
+
+		a.mutex.Lock()
+		for _, m := range g.members {
+			m.setState(StateRestarting, "")
+		}
+		a.mutex.Unlock()
+
+		a.addLog("WARN", "api", fmt.Sprintf("Restarting group %s in %s (attempt %d/%d)", g.name, backoff, failures, supervisorMaxRestarts), nil, "")
+
+		select {
+		case <-g.stopCh:
+			a.addLog("INFO", "api", fmt.Sprintf("Restart of group %s cancelled", g.name), nil, "")
+			return false
+		case <-time.After(backoff):
+		}
+
+		err := a.launchGroupProcess(g)
+		if err == nil {
+			a.mutex.Lock()
+			g.restarts++
+			restarts := g.restarts
+			members := make([]*supervisedProcess, 0, len(g.members))
+			for _, m := range g.members {
+				m.restarts++
+				members = append(members, m)
+			}
+			// The last member may have left during the relaunch
+			if g.stopRequested && g.cmd != nil && g.cmd.Process != nil {
+				g.cmd.Process.Kill()
+			}
+			a.mutex.Unlock()
+
+			for _, m := range members {
+				a.addTimelineEvent("proxy_action", "Profile Restarted",
+					fmt.Sprintf("Proxy profile '%s' restarted with group %s after unexpected exit (restart #%d)", m.profileName, g.name, restarts),
+					"warning", "system", backoff.String(), m.profileName)
+			}
+			return true
+		}
+
+		a.addLog("ERROR", "api", fmt.Sprintf("Failed to restart group %s: %v", g.name, err), nil, "")
+
+		a.mutex.Lock()
+		g.failures++
+		failures = g.failures
+		a.mutex.Unlock()
+
+		if failures > supervisorMaxRestarts {
+			a.failGroup(g, err.Error(), a.markCrashLooping)
+			return false
+		}
+	}
+}
+
+// failGroup gives up on a group, recording the failure on every member. A
+// member's own GOST error is reported in preference to the group's.
+func (a *API) failGroup(g *processGroup, lastErr string, mark func(*supervisedProcess, string)) {
+	a.mutex.Lock()
+	if a.groups[g.name] == g {
+		delete(a.groups, g.name)
+	}
+	members := make([]*supervisedProcess, 0, len(g.members))
+	errs := make([]string, 0, len(g.members))
+	for _, m := range g.members {
+		members = append(members, m)
+		if m.lastGostError != "" {
+			errs = append(errs, m.lastGostError)
+		} else {
+			errs = append(errs, lastErr)
+		}
+	}
+	a.mutex.Unlock()
+
+	for i, m := range members {
+		mark(m, errs[i])
+	}
+}
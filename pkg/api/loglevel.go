@@ -0,0 +1,170 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/imansprn/gostly/pkg/database"
+)
+
+const (
+	defaultGostLogLevel = "info"
+	gostLogLevelSetting = "gost_log_level" // workspace setting holding the default level
+)
+
+// gostLogLevels are the GOST log levels profiles can be set to
+var gostLogLevels = map[string]bool{
+	"debug": true,
+	"info":  true,
+	"warn":  true,
+	"error": true,
+}
+
+// normalizeGostLogLevel validates a GOST log level, ignoring case
+func normalizeGostLogLevel(level string) (string, error) {
+	normalized := strings.ToLower(strings.TrimSpace(level))
+	if !gostLogLevels[normalized] {
+		return "", fmt.Errorf("invalid GOST log level %q: use debug, info, warn or error", level)
+	}
+	return normalized, nil
+}
+
+// GetGostLogLevel returns the workspace's default GOST log level
+func (a *API) GetGostLogLevel() string {
+	level, err := a.currentDB().GetSetting(gostLogLevelSetting)
+	if err != nil || !gostLogLevels[level] {
+		return defaultGostLogLevel
+	}
+	return level
+}
+
+// gostLogLevelFor returns the level a profile's GOST services log at
+func (a *API) gostLogLevelFor(profile *database.Profile) string {
+	if gostLogLevels[profile.LogLevel] {
+		return profile.LogLevel
+	}
+	return a.GetGostLogLevel()
+}
+
+// SetGostLogLevel sets the workspace's default GOST log level and applies it
+// to the running profiles that don't override it
+func (a *API) SetGostLogLevel(level string) error {
+	level, err := normalizeGostLogLevel(level)
+	if err != nil {
+		return err
+	}
+	if err := a.currentDB().SetSetting(gostLogLevelSetting, level); err != nil {
+		a.addLog("ERROR", "api", fmt.Sprintf("Failed to save GOST log level: %v", err), nil, "")
+		return err
+	}
+
+	a.addLog("INFO", "api", fmt.Sprintf("GOST log level set to: %s", level), nil, "")
+	a.addTimelineEvent("configuration", "Log Level Changed",
+		fmt.Sprintf("Default GOST log level set to %s", level),
+		"success", "admin", "", "")
+
+	a.applyGostLogLevels(func(p *database.Profile) bool { return p.LogLevel == "" })
+	return nil
+}
+
+// SetProfileGostLogLevel overrides the GOST log level of one profile, or
+// goes back to the workspace default when level is empty. A running profile
+// is reloaded at the new level; other profiles are left alone.
+func (a *API) SetProfileGostLogLevel(id int64, level string) error {
+	profile, err := a.currentDB().GetProfile(id)
+	if err != nil {
+		a.addLog("ERROR", "api", fmt.Sprintf("Failed to get profile %d: %v", id, err), &id, "")
+		return err
+	}
+	if level != "" {
+		if level, err = normalizeGostLogLevel(level); err != nil {
+			return err
+		}
+	}
+
+	if err := a.currentDB().SetProfileLogLevel(id, level); err != nil {
+		a.addLog("ERROR", "api", fmt.Sprintf("Failed to save GOST log level for profile %s: %v", profile.Name, err), &id, profile.Name)
+		return err
+	}
+
+	details := fmt.Sprintf("GOST log level of proxy profile '%s' set to %s", profile.Name, level)
+	if level == "" {
+		details = fmt.Sprintf("GOST log level of proxy profile '%s' reset to the default (%s)", profile.Name, a.GetGostLogLevel())
+	}
+	a.addLog("INFO", "api", details, &id, profile.Name)
+	a.addTimelineEvent("configuration", "Log Level Changed", details, "success", "admin", "", profile.Name)
+
+	a.applyGostLogLevels(func(p *database.Profile) bool { return p.ID == id })
+	return nil
+}
+
+// applyGostLogLevels brings the running processes of the affected profiles
+// up to their current log levels. Groups are reloaded once each.
+func (a *API) applyGostLogLevels(affected func(*database.Profile) bool) {
+	type running struct {
+		proc  *supervisedProcess
+		group *processGroup
+	}
+	a.mutex.Lock()
+	var procs []running
+	for _, proc := range a.processes {
+		if proc.isActive() {
+			procs = append(procs, running{proc, proc.group})
+		}
+	}
+	a.mutex.Unlock()
+
+	groups := map[*processGroup]bool{}
+	for _, r := range procs {
+		profile, err := a.currentDB().GetProfile(r.proc.profileID)
+		if err != nil || !affected(profile) {
+			continue
+		}
+		if r.group != nil {
+			groups[r.group] = true
+			continue
+		}
+		if err := a.reloadProfileLogLevel(r.proc, profile); err != nil {
+			a.addLog("ERROR", "api", fmt.Sprintf("Failed to apply the GOST log level to profile %s: %v", profile.Name, err), &profile.ID, profile.Name)
+		}
+	}
+
+	for g := range groups {
+		if _, err := a.reloadGroup(g); err != nil {
+			a.addLog("ERROR", "api", fmt.Sprintf("Failed to reload group %s with the new GOST log levels: %v", g.name, err), nil, "")
+		}
+	}
+}
+
+// reloadProfileLogLevel rewrites a running profile's config at its current
+// log level and has GOST reload it with SIGHUP, keeping the process and its
+// API and metrics endpoints. Raw configs, processes still starting and
+// platforms without signals get a restart instead.
+func (a *API) reloadProfileLogLevel(proc *supervisedProcess, profile *database.Profile) error {
+	a.mutex.Lock()
+	state := proc.state
+	cmd := proc.cmd
+	client := proc.api
+	metrics := proc.metrics
+	a.mutex.Unlock()
+
+	switch {
+	case state == StateStarting || (state == StateRunning && isRawProfile(profile)):
+		return a.restartProfile(proc)
+	case state != StateRunning || cmd == nil || cmd.Process == nil:
+		// The next launch picks up the level
+		return nil
+	}
+
+	if _, err := a.createGostConfigWithLogging(profile, client, metrics); err != nil {
+		return err
+	}
+	if err := cmd.Process.Signal(syscall.SIGHUP); err != nil {
+		a.addLog("DEBUG", "api", fmt.Sprintf("Failed to send SIGHUP to profile %s, restarting it: %v", profile.Name, err), &profile.ID, profile.Name)
+		return a.restartProfile(proc)
+	}
+
+	a.addLog("INFO", "api", fmt.Sprintf("Reloaded profile %s at GOST log level %s", profile.Name, a.gostLogLevelFor(profile)), &profile.ID, profile.Name)
+	return nil
+}
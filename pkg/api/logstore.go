@@ -0,0 +1,319 @@
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/imansprn/gostly/pkg/database"
+)
+
+// Log persistence tuning
+const (
+	logQueueSize         = 10000
+	logBatchSize         = 500
+	logFlushInterval     = time.Second
+	logPruneInterval     = 10 * time.Minute
+	defaultLogMaxAge     = 7 * 24 * time.Hour
+	defaultLogMaxEntries = 100000
+	maxLogQueryLimit     = 1000
+
+	logMaxAgeSetting     = "log_max_age_days" // workspace settings overriding the retention defaults
+	logMaxEntriesSetting = "log_max_entries"
+)
+
+// LogQuery filters the persisted logs. Empty fields don't filter.
+type LogQuery struct {
+	Since     string   `json:"since"` // RFC 3339, inclusive
+	Until     string   `json:"until"` // RFC 3339, exclusive
+	Levels    []string `json:"levels"`
+	Source    string   `json:"source"`
+	ProfileID *int64   `json:"profile_id,omitempty"`
+	Search    string   `json:"search"` // case-insensitive text in the message
+	Src       string   `json:"src"`    // client address or IP
+	Dst       string   `json:"dst"`    // destination address or host
+	Cursor    string   `json:"cursor"` // NextCursor of the previous page
+	Limit     int      `json:"limit"`  // page size, 100 when unset
+}
+
+// LogPage is one page of QueryLogs results, newest first
+type LogPage struct {
+	Entries    []LogEntry `json:"entries"`
+	NextCursor string     `json:"next_cursor,omitempty"` // empty on the last page
+}
+
+// LogRetention bounds how much log history is kept
+type LogRetention struct {
+	MaxAgeDays int `json:"max_age_days"` // 0 keeps entries of any age
+	MaxEntries int `json:"max_entries"`  // 0 keeps any number of entries
+}
+
+// logWriter batches log entries into the database off the logging path
+type logWriter struct {
+	queue   chan database.LogRecord
+	flush   chan chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+	dropped atomic.Int64
+}
+
+func newLogWriter() *logWriter {
+	return &logWriter{
+		queue: make(chan database.LogRecord, logQueueSize),
+		flush: make(chan chan struct{}),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// persistLog queues an entry for the database. When the queue is full the
+// entry is only kept in memory. Caller must hold logMutex.
+func (a *API) persistLog(entry LogEntry, at time.Time) {
+	if a.logWriter == nil {
+		return
+	}
+	select {
+	case a.logWriter.queue <- logRecord(entry, at):
+	default:
+		a.logWriter.dropped.Add(1)
+	}
+}
+
+// logRecord converts a log entry for the database
+func logRecord(entry LogEntry, at time.Time) database.LogRecord {
+	return database.LogRecord{
+		ID:          entry.ID,
+		Time:        at,
+		Level:       entry.Level,
+		Source:      entry.Source,
+		Message:     entry.Message,
+		ProfileID:   entry.ProfileID,
+		ProfileName: entry.ProfileName,
+		Src:         entry.Src,
+		Dst:         entry.Dst,
+		DurationMs:  entry.DurationMs,
+		Fields:      entry.Fields,
+	}
+}
+
+// logEntryFromRecord converts a persisted log record back to an entry
+func logEntryFromRecord(r database.LogRecord) LogEntry {
+	return LogEntry{
+		ID:          r.ID,
+		Timestamp:   r.Time.Format(time.RFC3339),
+		Level:       r.Level,
+		Source:      r.Source,
+		Message:     r.Message,
+		ProfileID:   r.ProfileID,
+		ProfileName: r.ProfileName,
+		Src:         r.Src,
+		Dst:         r.Dst,
+		DurationMs:  r.DurationMs,
+		Fields:      r.Fields,
+	}
+}
+
+// runLogWriter writes queued entries in batches and applies the retention
+// limits until Close
+func (a *API) runLogWriter() {
+	w := a.logWriter
+	defer close(w.done)
+
+	var batch []database.LogRecord
+	write := func() {
+		if len(batch) == 0 {
+			return
+		}
+		// Logging a failure here would queue another entry, so print it instead
+		if err := a.currentDB().AddLogs(batch); err != nil {
+			fmt.Printf("API: failed to persist %d log entries: %v\n", len(batch), err)
+		}
+		batch = nil
+	}
+	drain := func() {
+		for {
+			select {
+			case r := <-w.queue:
+				batch = append(batch, r)
+			default:
+				write()
+				return
+			}
+		}
+	}
+
+	a.pruneLogs()
+	ticker := time.NewTicker(logFlushInterval)
+	defer ticker.Stop()
+	lastPrune := time.Now()
+	for {
+		select {
+		case r := <-w.queue:
+			batch = append(batch, r)
+			if len(batch) >= logBatchSize {
+				write()
+			}
+		case <-ticker.C:
+			write()
+			if time.Since(lastPrune) >= logPruneInterval {
+				a.pruneLogs()
+				lastPrune = time.Now()
+			}
+		case reply := <-w.flush:
+			drain()
+			close(reply)
+		case <-w.stop:
+			drain()
+			return
+		}
+	}
+}
+
+// flushLogs waits until every entry logged so far is in the database
+func (a *API) flushLogs() {
+	reply := make(chan struct{})
+	select {
+	case a.logWriter.flush <- reply:
+		<-reply
+	case <-a.logWriter.done:
+	}
+}
+
+// stopLogWriter writes the remaining entries and stops the writer
+func (a *API) stopLogWriter() {
+	close(a.logWriter.stop)
+	<-a.logWriter.done
+}
+
+// currentDB returns the open workspace's database. Every access goes
+// through here because SwitchWorkspace replaces it.
+func (a *API) currentDB() *database.DB {
+	a.dbMutex.RLock()
+	defer a.dbMutex.RUnlock()
+	return a.db
+}
+
+// pruneLogs deletes entries outside the retention limits
+func (a *API) pruneLogs() {
+	retention := a.GetLogRetention()
+	maxAge := time.Duration(retention.MaxAgeDays) * 24 * time.Hour
+	if _, err := a.currentDB().PruneLogs(maxAge, retention.MaxEntries); err != nil {
+		fmt.Printf("API: failed to prune logs: %v\n", err)
+	}
+}
+
+// QueryLogs searches the persisted logs, newest first, a page at a time
+func (a *API) QueryLogs(q LogQuery) (*LogPage, error) {
+	filter := database.LogFilter{
+		Levels:    q.Levels,
+		Source:    q.Source,
+		ProfileID: q.ProfileID,
+		Search:    q.Search,
+		Src:       q.Src,
+		Dst:       q.Dst,
+		Limit:     q.Limit,
+	}
+	if filter.Limit <= 0 {
+		filter.Limit = 100
+	}
+	if filter.Limit > maxLogQueryLimit {
+		filter.Limit = maxLogQueryLimit
+	}
+
+	var err error
+	if q.Since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, q.Since); err != nil {
+			return nil, fmt.Errorf("invalid since time %q: %w", q.Since, err)
+		}
+	}
+	if q.Until != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, q.Until); err != nil {
+			return nil, fmt.Errorf("invalid until time %q: %w", q.Until, err)
+		}
+	}
+	if q.Cursor != "" {
+		if filter.BeforeID, err = strconv.ParseInt(q.Cursor, 10, 64); err != nil || filter.BeforeID <= 0 {
+			return nil, fmt.Errorf("invalid cursor %q", q.Cursor)
+		}
+	}
+
+	a.flushLogs()
+	// Fetch one extra record to learn whether another page follows
+	filter.Limit++
+	records, err := a.currentDB().QueryLogs(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &LogPage{Entries: []LogEntry{}}
+	for i, r := range records {
+		if i == filter.Limit-1 {
+			page.NextCursor = strconv.FormatInt(page.Entries[i-1].ID, 10)
+			break
+		}
+		page.Entries = append(page.Entries, logEntryFromRecord(r))
+	}
+	return page, nil
+}
+
+// SetLogRetention sets how much log history is kept, saves it with the
+// workspace settings and prunes to it
+func (a *API) SetLogRetention(retention LogRetention) error {
+	if retention.MaxAgeDays < 0 || retention.MaxEntries < 0 {
+		return fmt.Errorf("log retention limits can't be negative")
+	}
+
+	db := a.currentDB()
+	if err := db.SetSetting(logMaxAgeSetting, strconv.Itoa(retention.MaxAgeDays)); err != nil {
+		a.addLog("ERROR", "api", fmt.Sprintf("Failed to save log retention: %v", err), nil, "")
+		return err
+	}
+	if err := db.SetSetting(logMaxEntriesSetting, strconv.Itoa(retention.MaxEntries)); err != nil {
+		a.addLog("ERROR", "api", fmt.Sprintf("Failed to save log retention: %v", err), nil, "")
+		return err
+	}
+
+	a.pruneLogs()
+	a.addLog("INFO", "api", fmt.Sprintf("Log retention set to %d days, %d entries", retention.MaxAgeDays, retention.MaxEntries), nil, "")
+	return nil
+}
+
+// GetLogRetention returns how much log history the workspace keeps
+func (a *API) GetLogRetention() LogRetention {
+	return LogRetention{
+		MaxAgeDays: a.retentionSetting(logMaxAgeSetting, int(defaultLogMaxAge/(24*time.Hour))),
+		MaxEntries: a.retentionSetting(logMaxEntriesSetting, defaultLogMaxEntries),
+	}
+}
+
+// retentionSetting reads a retention limit, or def when it isn't set
+func (a *API) retentionSetting(key string, def int) int {
+	value, err := a.currentDB().GetSetting(key)
+	if err != nil || value == "" {
+		return def
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		return def
+	}
+	return limit
+}
+
+// PurgeLogHistory deletes every persisted log entry of the workspace along
+// with the ones still shown in memory
+func (a *API) PurgeLogHistory() error {
+	a.flushLogs()
+	if err := a.currentDB().ClearLogs(); err != nil {
+		a.addLog("ERROR", "api", fmt.Sprintf("Failed to purge the log history: %v", err), nil, "")
+		return err
+	}
+
+	a.logMutex.Lock()
+	a.logs = []LogEntry{}
+	a.logMutex.Unlock()
+
+	a.addTimelineEvent("configuration", "Log History Purged",
+		"Persisted log history deleted", "success", "admin", "", "")
+	return nil
+}
@@ -0,0 +1,305 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricsAddrEnv starts Gostly's metrics endpoint on this address at launch
+const MetricsAddrEnv = "GOSTLY_METRICS_ADDR"
+
+// latencyBuckets are the upper bounds, in seconds, of the host router latency histogram
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// profileStates are exported for every profile so alerts can match on any of them
+var profileStates = []ProfileState{
+	StateStopped, StateStarting, StateRunning, StateStopping,
+	StateRestarting, StateFailed, StateCrashLooping,
+}
+
+// routerRequestKey identifies a host router request counter
+type routerRequestKey struct {
+	host string
+	code int
+}
+
+// latencyHistogram is a cumulative latency histogram over latencyBuckets
+type latencyHistogram struct {
+	buckets []int64
+	count   int64
+	sum     float64
+}
+
+// routerMetrics counts the requests served by the host router
+type routerMetrics struct {
+	mu       sync.Mutex
+	requests map[routerRequestKey]int64
+	latency  map[string]*latencyHistogram
+}
+
+func newRouterMetrics() *routerMetrics {
+	return &routerMetrics{
+		requests: make(map[routerRequestKey]int64),
+		latency:  make(map[string]*latencyHistogram),
+	}
+}
+
+// observe records a request to host that was answered with code
+func (m *routerMetrics) observe(host string, code int, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[routerRequestKey{host, code}]++
+	h := m.latency[host]
+	if h == nil {
+		h = &latencyHistogram{buckets: make([]int64, len(latencyBuckets))}
+		m.latency[host] = h
+	}
+	seconds := elapsed.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// statusRecorder remembers the status code written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, which the
+// reverse proxy needs for flushing and protocol upgrades
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// StartMetricsServer serves Gostly's Prometheus metrics on addr
+func (a *API) StartMetricsServer(addr string) error {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("invalid metrics address %q: %w", addr, err)
+	}
+
+	a.metricsMutex.Lock()
+	defer a.metricsMutex.Unlock()
+	if a.metricsServer != nil {
+		return fmt.Errorf("metrics endpoint already running on %s", a.metricsServer.Addr)
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		a.addLog("ERROR", "api", fmt.Sprintf("Failed to start metrics endpoint on %s: %v", addr, err), nil, "")
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		a.writeMetrics(w)
+	})
+	server := &http.Server{Addr: listener.Addr().String(), Handler: mux}
+	a.metricsServer = server
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			a.addLog("ERROR", "api", fmt.Sprintf("Metrics endpoint error: %v", err), nil, "")
+		}
+	}()
+
+	a.addLog("INFO", "api", fmt.Sprintf("Metrics endpoint started on http://%s/metrics", server.Addr), nil, "")
+	a.addTimelineEvent("system", "Metrics Endpoint Started",
+		fmt.Sprintf("Prometheus metrics served on %s", server.Addr),
+		"success", "admin", "1s", "")
+	return nil
+}
+
+// StopMetricsServer stops the metrics endpoint
+func (a *API) StopMetricsServer() error {
+	a.metricsMutex.Lock()
+	server := a.metricsServer
+	a.metricsServer = nil
+	a.metricsMutex.Unlock()
+	if server == nil {
+		return fmt.Errorf("metrics endpoint not running")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		a.addLog("ERROR", "api", fmt.Sprintf("Failed stopping metrics endpoint: %v", err), nil, "")
+		return err
+	}
+
+	a.addLog("INFO", "api", "Metrics endpoint stopped", nil, "")
+	a.addTimelineEvent("system", "Metrics Endpoint Stopped",
+		"Prometheus metrics endpoint stopped",
+		"success", "admin", "1s", "")
+	return nil
+}
+
+// IsMetricsServerRunning returns whether the metrics endpoint is running and its addr
+func (a *API) IsMetricsServerRunning() (bool, string) {
+	a.metricsMutex.Lock()
+	defer a.metricsMutex.Unlock()
+	if a.metricsServer == nil {
+		return false, ""
+	}
+	return true, a.metricsServer.Addr
+}
+
+// startMetricsFromEnv starts the metrics endpoint when MetricsAddrEnv is set
+func (a *API) startMetricsFromEnv() {
+	if addr := os.Getenv(MetricsAddrEnv); addr != "" {
+		if err := a.StartMetricsServer(addr); err != nil {
+			fmt.Printf("API: failed to start metrics endpoint from %s: %v\n", MetricsAddrEnv, err)
+		}
+	}
+}
+
+// writeMetrics renders every metric in the Prometheus text format
+func (a *API) writeMetrics(w io.Writer) {
+	a.gostMu.RLock()
+	gostAvailable, gostVersion := a.gostAvailable, a.gostVersion
+	a.gostMu.RUnlock()
+
+	available := 0
+	if gostAvailable {
+		available = 1
+	}
+	writeMetricHeader(w, "gostly_gost_available", "gauge", "Whether the GOST binary was found.")
+	fmt.Fprintf(w, "gostly_gost_available %d\n", available)
+	if gostAvailable {
+		writeMetricHeader(w, "gostly_gost_info", "gauge", "Version of the GOST binary in use.")
+		fmt.Fprintf(w, "gostly_gost_info{version=%s} 1\n", metricLabel(gostVersion))
+	}
+
+	a.writeProfileMetrics(w)
+	a.writeRouterMetrics(w)
+
+	a.logMutex.RLock()
+	levels := make([]string, 0, len(a.logCounts))
+	for level := range a.logCounts {
+		levels = append(levels, level)
+	}
+	sort.Strings(levels)
+	writeMetricHeader(w, "gostly_log_messages_total", "counter", "Log messages recorded, by level.")
+	for _, level := range levels {
+		fmt.Fprintf(w, "gostly_log_messages_total{level=%s} %d\n", metricLabel(level), a.logCounts[level])
+	}
+	a.logMutex.RUnlock()
+
+	if a.logWriter != nil {
+		writeMetricHeader(w, "gostly_log_messages_dropped_total", "counter", "Log messages not persisted because the database queue was full.")
+		fmt.Fprintf(w, "gostly_log_messages_dropped_total %d\n", a.logWriter.dropped.Load())
+	}
+}
+
+// writeProfileMetrics renders the state and restart count of every profile
+func (a *API) writeProfileMetrics(w io.Writer) {
+	profiles, err := a.currentDB().GetProfiles()
+	if err != nil {
+		return
+	}
+	a.mutex.Lock()
+	for i := range profiles {
+		a.applyProcessStatus(&profiles[i])
+	}
+	a.mutex.Unlock()
+
+	writeMetricHeader(w, "gostly_profile_state", "gauge", "Lifecycle state of each profile's GOST process, 1 for the current state.")
+	for _, p := range profiles {
+		for _, state := range profileStates {
+			value := 0
+			if p.Status == string(state) {
+				value = 1
+			}
+			fmt.Fprintf(w, "gostly_profile_state{id=\"%d\",profile=%s,state=%s} %d\n", p.ID, metricLabel(p.Name), metricLabel(string(state)), value)
+		}
+	}
+	writeMetricHeader(w, "gostly_profile_restarts", "gauge", "Restarts of each profile's GOST process since it was started.")
+	for _, p := range profiles {
+		fmt.Fprintf(w, "gostly_profile_restarts{id=\"%d\",profile=%s} %d\n", p.ID, metricLabel(p.Name), p.RestartCount)
+	}
+}
+
+// writeRouterMetrics renders the host router's request counters and latencies
+func (a *API) writeRouterMetrics(w io.Writer) {
+	running, _ := a.IsHostRouterRunning()
+	value := 0
+	if running {
+		value = 1
+	}
+	writeMetricHeader(w, "gostly_host_router_running", "gauge", "Whether the host router is running.")
+	fmt.Fprintf(w, "gostly_host_router_running %d\n", value)
+
+	m := a.routerMetrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]routerRequestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].host != keys[j].host {
+			return keys[i].host < keys[j].host
+		}
+		return keys[i].code < keys[j].code
+	})
+	writeMetricHeader(w, "gostly_host_router_requests_total", "counter", "Requests served by the host router, by mapped hostname and status code.")
+	for _, key := range keys {
+		fmt.Fprintf(w, "gostly_host_router_requests_total{host=%s,code=\"%d\"} %d\n", metricLabel(key.host), key.code, m.requests[key])
+	}
+
+	hosts := make([]string, 0, len(m.latency))
+	for host := range m.latency {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	writeMetricHeader(w, "gostly_host_router_request_duration_seconds", "histogram", "Time to serve host router requests, by mapped hostname.")
+	for _, host := range hosts {
+		h := m.latency[host]
+		label := metricLabel(host)
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "gostly_host_router_request_duration_seconds_bucket{host=%s,le=\"%s\"} %d\n", label, strconv.FormatFloat(bound, 'g', -1, 64), h.buckets[i])
+		}
+		fmt.Fprintf(w, "gostly_host_router_request_duration_seconds_bucket{host=%s,le=\"+Inf\"} %d\n", label, h.count)
+		fmt.Fprintf(w, "gostly_host_router_request_duration_seconds_sum{host=%s} %s\n", label, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "gostly_host_router_request_duration_seconds_count{host=%s} %d\n", label, h.count)
+	}
+}
+
+func writeMetricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// metricLabel quotes a label value for the Prometheus text format
+func metricLabel(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
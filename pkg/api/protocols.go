@@ -0,0 +1,260 @@
+package api
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/imansprn/gostly/pkg/database"
+)
+
+// ProtocolOption is a profile setting a protocol can use
+type ProtocolOption string
+
+// Profile settings referenced by protocol specs
+const (
+	OptionRemote ProtocolOption = "remote" // forwarder target (Remote or Nodes)
+	OptionAuth   ProtocolOption = "auth"   // username/password
+	OptionTLS    ProtocolOption = "tls"    // certificate settings
+	OptionChain  ProtocolOption = "chain"  // upstream chain
+)
+
+// Protocol kinds
+const (
+	KindHandler  = "handler"
+	KindListener = "listener"
+)
+
+// ProtocolSpec describes a GOST handler or listener type and the profile
+// settings it needs. Adding a protocol is a matter of adding a spec.
+type ProtocolSpec struct {
+	Type        string           `json:"type"`
+	Kind        string           `json:"kind"`
+	Description string           `json:"description"`
+	Network     string           `json:"network"` // "tcp" for stream protocols, "udp" for packet protocols
+	Required    []ProtocolOption `json:"required"`
+	Optional    []ProtocolOption `json:"optional"`
+
+	// Carries is what a listener hands its handler when that differs from
+	// the socket it binds, such as the streams QUIC and KCP carry over UDP
+	Carries string `json:"carries,omitempty"`
+
+	// ReverseListener listeners bind on the far end of the chain, not locally
+	ReverseListener bool `json:"reverse_listener,omitempty"`
+}
+
+// carried returns the network a listener offers its handler
+func (s ProtocolSpec) carried() string {
+	if s.Carries != "" {
+		return s.Carries
+	}
+	return s.Network
+}
+
+// supports reports whether the spec uses the option at all
+func (s ProtocolSpec) supports(opt ProtocolOption) bool {
+	return s.requires(opt) || containsOption(s.Optional, opt)
+}
+
+// requires reports whether the spec needs the option
+func (s ProtocolSpec) requires(opt ProtocolOption) bool {
+	return containsOption(s.Required, opt)
+}
+
+func containsOption(opts []ProtocolOption, opt ProtocolOption) bool {
+	for _, o := range opts {
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
+
+// handlerSpecs lists the GOST v3 handler types Gostly can configure
+var handlerSpecs = map[string]ProtocolSpec{
+	"http":   {Description: "HTTP proxy", Network: "tcp", Optional: []ProtocolOption{OptionAuth, OptionRemote, OptionChain}},
+	"http2":  {Description: "HTTP/2 proxy", Network: "tcp", Optional: []ProtocolOption{OptionAuth, OptionRemote, OptionChain}},
+	"socks4": {Description: "SOCKS4/4a proxy", Network: "tcp", Optional: []ProtocolOption{OptionAuth, OptionRemote, OptionChain}},
+	"socks5": {Description: "SOCKS5 proxy", Network: "tcp", Optional: []ProtocolOption{OptionAuth, OptionRemote, OptionChain}},
+	"auto":   {Description: "Auto-detecting HTTP/SOCKS proxy", Network: "tcp", Optional: []ProtocolOption{OptionAuth, OptionRemote, OptionChain}},
+	"relay":  {Description: "GOST relay protocol", Network: "tcp", Optional: []ProtocolOption{OptionAuth, OptionRemote, OptionChain}},
+	"ss":     {Description: "Shadowsocks (username is the cipher method)", Network: "tcp", Required: []ProtocolOption{OptionAuth}, Optional: []ProtocolOption{OptionRemote, OptionChain}},
+	"ssu":    {Description: "Shadowsocks UDP relay (username is the cipher method)", Network: "udp", Required: []ProtocolOption{OptionAuth}, Optional: []ProtocolOption{OptionChain}},
+	"sni":    {Description: "SNI proxy", Network: "tcp", Optional: []ProtocolOption{OptionRemote, OptionChain}},
+	"sshd":   {Description: "SSH port forwarding server", Network: "tcp", Optional: []ProtocolOption{OptionAuth, OptionRemote, OptionChain}},
+	"tcp":    {Description: "TCP port forwarding", Network: "tcp", Required: []ProtocolOption{OptionRemote}, Optional: []ProtocolOption{OptionChain}},
+	"udp":    {Description: "UDP port forwarding", Network: "udp", Required: []ProtocolOption{OptionRemote}, Optional: []ProtocolOption{OptionChain}},
+	"rtcp":   {Description: "Reverse TCP port forwarding", Network: "tcp", Required: []ProtocolOption{OptionRemote}, Optional: []ProtocolOption{OptionChain}},
+	"rudp":   {Description: "Reverse UDP port forwarding", Network: "udp", Required: []ProtocolOption{OptionRemote}, Optional: []ProtocolOption{OptionChain}},
+	"red":    {Description: "Transparent TCP proxy (iptables REDIRECT/TPROXY)", Network: "tcp", Optional: []ProtocolOption{OptionChain}},
+	"redu":   {Description: "Transparent UDP proxy (TPROXY)", Network: "udp", Optional: []ProtocolOption{OptionChain}},
+	"dns":    {Description: "DNS proxy", Network: "udp", Required: []ProtocolOption{OptionRemote}, Optional: []ProtocolOption{OptionChain}},
+}
+
+// listenerSpecs lists the GOST v3 listener types Gostly can configure
+var listenerSpecs = map[string]ProtocolSpec{
+	"tcp":   {Description: "Plain TCP", Network: "tcp"},
+	"udp":   {Description: "Plain UDP", Network: "udp"},
+	"tls":   {Description: "TLS", Network: "tcp", Optional: []ProtocolOption{OptionTLS}},
+	"mtls":  {Description: "Multiplexed TLS", Network: "tcp", Optional: []ProtocolOption{OptionTLS}},
+	"ws":    {Description: "WebSocket", Network: "tcp"},
+	"wss":   {Description: "WebSocket over TLS", Network: "tcp", Optional: []ProtocolOption{OptionTLS}},
+	"mws":   {Description: "Multiplexed WebSocket", Network: "tcp"},
+	"mwss":  {Description: "Multiplexed WebSocket over TLS", Network: "tcp", Optional: []ProtocolOption{OptionTLS}},
+	"http2": {Description: "HTTP/2 transport", Network: "tcp", Optional: []ProtocolOption{OptionTLS}},
+	"h2":    {Description: "HTTP/2 tunnel over TLS", Network: "tcp", Optional: []ProtocolOption{OptionTLS}},
+	"h2c":   {Description: "HTTP/2 tunnel over cleartext", Network: "tcp"},
+	"grpc":  {Description: "gRPC tunnel", Network: "tcp", Optional: []ProtocolOption{OptionTLS}},
+	"quic":  {Description: "QUIC", Network: "udp", Carries: "tcp", Optional: []ProtocolOption{OptionTLS}},
+	"kcp":   {Description: "KCP", Network: "udp", Carries: "tcp"},
+	"ssh":   {Description: "SSH tunnel", Network: "tcp", Optional: []ProtocolOption{OptionAuth}},
+	"sshd":  {Description: "SSH server for port forwarding", Network: "tcp", Optional: []ProtocolOption{OptionAuth}},
+	"red":   {Description: "Transparent TCP (REDIRECT/TPROXY)", Network: "tcp"},
+	"redu":  {Description: "Transparent UDP (TPROXY)", Network: "udp"},
+	"rtcp":  {Description: "Reverse TCP, bound on the chain's last hop", Network: "tcp", Required: []ProtocolOption{OptionChain}, ReverseListener: true},
+	"rudp":  {Description: "Reverse UDP, bound on the chain's last hop", Network: "udp", Required: []ProtocolOption{OptionChain}, ReverseListener: true},
+	"dns":   {Description: "DNS server", Network: "udp"},
+}
+
+// profileTypeAliases maps legacy profile types to GOST handler types
+var profileTypeAliases = map[string]string{
+	"forward":     "socks5",
+	"reverse":     "tcp",
+	"socks":       "socks5",
+	"shadowsocks": "ss",
+}
+
+// unsupportedProfileTypes are protocols the frontend knows about that GOST v3 does not implement
+var unsupportedProfileTypes = map[string]string{
+	"vmess":  "VMess is not supported by GOST v3",
+	"trojan": "Trojan is not supported by GOST v3",
+}
+
+// handlerSpec looks up the handler for a profile type, resolving legacy aliases
+func handlerSpec(profileType string) (ProtocolSpec, bool) {
+	handlerType := profileType
+	if alias, ok := profileTypeAliases[profileType]; ok {
+		handlerType = alias
+	}
+	spec, ok := handlerSpecs[handlerType]
+	if ok {
+		spec.Type = handlerType
+		spec.Kind = KindHandler
+	}
+	return spec, ok
+}
+
+// listenerSpec looks up a listener type. An empty type defaults to plain
+// TCP or UDP depending on the handler's network.
+func listenerSpec(listenerType string, handler ProtocolSpec) (ProtocolSpec, bool) {
+	if listenerType == "" {
+		listenerType = handler.Network
+	}
+	spec, ok := listenerSpecs[listenerType]
+	if ok {
+		spec.Type = listenerType
+		spec.Kind = KindListener
+	}
+	return spec, ok
+}
+
+// resolveProtocols returns the handler and listener specs for a profile
+func resolveProtocols(p *database.Profile) (ProtocolSpec, ProtocolSpec, error) {
+	if reason, ok := unsupportedProfileTypes[strings.ToLower(p.Type)]; ok {
+		return ProtocolSpec{}, ProtocolSpec{}, fmt.Errorf("%s", reason)
+	}
+
+	handler, ok := handlerSpec(p.Type)
+	if !ok {
+		return ProtocolSpec{}, ProtocolSpec{}, fmt.Errorf("unsupported profile type %q", p.Type)
+	}
+
+	listener, ok := listenerSpec(p.Listener, handler)
+	if !ok {
+		return handler, ProtocolSpec{}, fmt.Errorf("unsupported listener type %q", p.Listener)
+	}
+
+	if handler.Network != listener.carried() {
+		return handler, listener, fmt.Errorf("%s handler needs a %s listener, %s is %s", handler.Type, handler.Network, listener.Type, listener.carried())
+	}
+
+	return handler, listener, nil
+}
+
+// profileListener returns the listener spec of a profile. Raw profiles are
+// treated as plain TCP on their first service's address.
+func profileListener(p *database.Profile) (ProtocolSpec, error) {
+	if isRawProfile(p) {
+		spec := listenerSpecs["tcp"]
+		spec.Type = "tcp"
+		spec.Kind = KindListener
+		return spec, nil
+	}
+	_, listener, err := resolveProtocols(p)
+	return listener, err
+}
+
+// validateProtocols checks the profile's type, listener and the options they need
+func validateProtocols(verr *ValidationError, p *database.Profile) {
+	if p.Type == "" {
+		verr.add("type", CodeRequired, "type is required")
+		return
+	}
+
+	handler, listener, err := resolveProtocols(p)
+	if err != nil {
+		field := "type"
+		if handler.Type != "" {
+			field = "listener"
+		}
+		verr.add(field, CodeUnsupported, "%v", err)
+		return
+	}
+
+	hasRemote := p.Remote != "" || len(p.Nodes) > 0
+	hasAuth := p.Username != "" || p.Password != ""
+
+	for _, spec := range []ProtocolSpec{handler, listener} {
+		if spec.requires(OptionRemote) && !hasRemote {
+			verr.add("remote", CodeRequired, "remote or upstream nodes are required for %s %s", spec.Type, spec.Kind)
+		}
+		if spec.requires(OptionAuth) && !hasAuth {
+			verr.add("username", CodeRequired, "credentials are required for %s %s", spec.Type, spec.Kind)
+		}
+		if spec.requires(OptionChain) && p.ChainID == 0 {
+			verr.add("chain_id", CodeRequired, "a chain is required for %s %s", spec.Type, spec.Kind)
+		}
+	}
+
+	if hasRemote && !handler.supports(OptionRemote) {
+		verr.add("remote", CodeUnsupported, "%s does not forward to a remote", handler.Type)
+	}
+	if hasAuth && !handler.supports(OptionAuth) && !listener.supports(OptionAuth) {
+		verr.add("username", CodeUnsupported, "%s does not support authentication", handler.Type)
+	}
+	if p.ChainID != 0 && !handler.supports(OptionChain) {
+		verr.add("chain_id", CodeUnsupported, "%s does not support chains", handler.Type)
+	}
+}
+
+// GetProtocols returns the handler and listener types Gostly can configure
+func (a *API) GetProtocols() []ProtocolSpec {
+	specs := make([]ProtocolSpec, 0, len(handlerSpecs)+len(listenerSpecs))
+	for t, spec := range handlerSpecs {
+		spec.Type = t
+		spec.Kind = KindHandler
+		specs = append(specs, spec)
+	}
+	for t, spec := range listenerSpecs {
+		spec.Type = t
+		spec.Kind = KindListener
+		specs = append(specs, spec)
+	}
+	sort.Slice(specs, func(i, j int) bool {
+		if specs[i].Kind != specs[j].Kind {
+			return specs[i].Kind < specs[j].Kind
+		}
+		return specs[i].Type < specs[j].Type
+	})
+	return specs
+}
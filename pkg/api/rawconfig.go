@@ -0,0 +1,210 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/imansprn/gostly/pkg/database"
+	"gopkg.in/yaml.v3"
+)
+
+// ProfileTypeRaw marks a profile whose GOST config is the user-supplied
+// RawConfig body instead of being generated from the structured fields
+const ProfileTypeRaw = "raw"
+
+// rawListSections are the top-level GOST v3 config sections holding lists of named objects
+var rawListSections = map[string]bool{
+	"services":   true,
+	"chains":     true,
+	"hops":       true,
+	"authers":    true,
+	"admissions": true,
+	"bypasses":   true,
+	"resolvers":  true,
+	"hosts":      true,
+	"ingresses":  true,
+	"routers":    true,
+	"sds":        true,
+	"recorders":  true,
+	"limiters":   true,
+	"climiters":  true,
+	"rlimiters":  true,
+	"observers":  true,
+	"loggers":    true,
+}
+
+// rawObjectSections are the top-level GOST v3 config sections holding a single object
+var rawObjectSections = map[string]bool{
+	"tls":       true,
+	"log":       true,
+	"profiling": true,
+	"api":       true,
+	"metrics":   true,
+}
+
+// isRawProfile reports whether the profile carries its own GOST config
+func isRawProfile(p *database.Profile) bool {
+	return p.Type == ProfileTypeRaw
+}
+
+// parseRawConfig decodes a raw config body written as JSON or YAML
+func parseRawConfig(body string) (map[string]interface{}, error) {
+	trimmed := strings.TrimSpace(body)
+	if trimmed == "" {
+		return nil, fmt.Errorf("config is empty")
+	}
+
+	var cfg map[string]interface{}
+	if strings.HasPrefix(trimmed, "{") {
+		dec := json.NewDecoder(bytes.NewReader([]byte(trimmed)))
+		dec.UseNumber()
+		if err := dec.Decode(&cfg); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+		return cfg, nil
+	}
+
+	if err := yaml.Unmarshal([]byte(trimmed), &cfg); err != nil {
+		return nil, fmt.Errorf("invalid YAML: %w", err)
+	}
+	if cfg == nil {
+		return nil, fmt.Errorf("config is not an object")
+	}
+	return cfg, nil
+}
+
+// validateRawConfig checks a raw config body against the structure of a GOST
+// v3 config. It returns the address of the first service, which raw profiles
+// use as their listen address.
+func validateRawConfig(verr *ValidationError, body string) string {
+	cfg, err := parseRawConfig(body)
+	if err != nil {
+		verr.add("raw_config", CodeInvalid, "%v", err)
+		return ""
+	}
+
+	for key, value := range cfg {
+		field := "raw_config." + key
+		switch {
+		case rawListSections[key]:
+			if _, ok := value.([]interface{}); !ok {
+				verr.add(field, CodeInvalid, "%s must be a list", key)
+			}
+		case rawObjectSections[key]:
+			if _, ok := value.(map[string]interface{}); !ok {
+				verr.add(field, CodeInvalid, "%s must be an object", key)
+			}
+		default:
+			verr.add(field, CodeUnsupported, "unknown GOST config section %q", key)
+		}
+	}
+
+	chains := map[string]bool{}
+	for i, chain := range rawList(cfg, "chains") {
+		field := fmt.Sprintf("raw_config.chains[%d]", i)
+		name := rawName(verr, field, chain)
+		chains[name] = true
+		hops := rawList(chain, "hops")
+		if len(hops) == 0 {
+			verr.add(field+".hops", CodeRequired, "a chain needs at least one hop")
+		}
+		for j, hop := range hops {
+			rawName(verr, fmt.Sprintf("%s.hops[%d]", field, j), hop)
+		}
+	}
+
+	services := rawList(cfg, "services")
+	if len(services) == 0 {
+		verr.add("raw_config.services", CodeRequired, "at least one service is required")
+		return ""
+	}
+
+	listen := ""
+	for i, svc := range services {
+		field := fmt.Sprintf("raw_config.services[%d]", i)
+		rawName(verr, field, svc)
+
+		addr, _ := svc["addr"].(string)
+		validateHostPort(verr, field+".addr", addr, true)
+		if i == 0 {
+			listen = addr
+		}
+
+		handler, ok := svc["handler"].(map[string]interface{})
+		if !ok {
+			verr.add(field+".handler", CodeRequired, "handler is required")
+		} else {
+			if t, _ := handler["type"].(string); t == "" {
+				verr.add(field+".handler.type", CodeRequired, "handler type is required")
+			}
+			if chain, ok := handler["chain"].(string); ok && chain != "" && !chains[chain] {
+				verr.add(field+".handler.chain", CodeNotFound, "chain %q is not defined", chain)
+			}
+		}
+
+		if listener, ok := svc["listener"]; ok {
+			l, ok := listener.(map[string]interface{})
+			if t, _ := l["type"].(string); !ok || t == "" {
+				verr.add(field+".listener.type", CodeRequired, "listener type is required")
+			}
+		}
+
+		if fw, ok := svc["forwarder"].(map[string]interface{}); ok {
+			for j, node := range rawList(fw, "nodes") {
+				if addr, _ := node["addr"].(string); addr == "" {
+					verr.add(fmt.Sprintf("%s.forwarder.nodes[%d].addr", field, j), CodeRequired, "addr is required")
+				}
+			}
+		}
+	}
+
+	return listen
+}
+
+// rawList returns the objects of a list field, skipping entries that are not objects
+func rawList(obj map[string]interface{}, key string) []map[string]interface{} {
+	items, _ := obj[key].([]interface{})
+	out := make([]map[string]interface{}, 0, len(items))
+	for _, item := range items {
+		if m, ok := item.(map[string]interface{}); ok {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// rawName returns an object's name, recording an error if it has none
+func rawName(verr *ValidationError, field string, obj map[string]interface{}) string {
+	name, _ := obj["name"].(string)
+	if name == "" {
+		verr.add(field+".name", CodeRequired, "name is required")
+	}
+	return name
+}
+
+// rawConfigHasMetrics reports whether a raw profile configures its own metrics endpoint
+func rawConfigHasMetrics(profile *database.Profile) bool {
+	cfg, err := parseRawConfig(profile.RawConfig)
+	if err != nil {
+		return false
+	}
+	_, ok := cfg["metrics"]
+	return ok
+}
+
+// createRawGostConfig writes a raw profile's config with Gostly's log block
+// at level injected, so GOST's output stays parseable, and metrics served
+// for Gostly when metrics is set
+func createRawGostConfig(profile *database.Profile, level string, metrics *gostMetricsClient) (string, error) {
+	cfg, err := parseRawConfig(profile.RawConfig)
+	if err != nil {
+		return "", err
+	}
+	cfg["log"] = gostLogConfig(level)
+	if metrics != nil {
+		cfg["metrics"] = metrics.config()
+	}
+	return writeGostConfig(fmt.Sprintf("config_%d.json", profile.ID), cfg)
+}
@@ -0,0 +1,270 @@
+package api
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/imansprn/gostly/pkg/database"
+)
+
+// ProfileState is the lifecycle state of a profile's GOST process
+type ProfileState string
+
+// Profile lifecycle states
+const (
+	StateStopped      ProfileState = "stopped"
+	StateStarting     ProfileState = "starting"      // process launched, listener not confirmed yet
+	StateRunning      ProfileState = "running"       // GOST confirmed its listener is up
+	StateStopping     ProfileState = "stopping"      // StopProfile is draining the process
+	StateRestarting   ProfileState = "restarting"    // waiting out the backoff after an unexpected exit
+	StateFailed       ProfileState = "failed"        // exited before the listener came up
+	StateCrashLooping ProfileState = "crash-looping" // restart budget exhausted
+)
+
+// listenerConfirmTimeout is how long a profile may stay in StateStarting
+// before Gostly warns that its listener hasn't been confirmed. The profile
+// keeps waiting; it is never reported running without confirmation.
+const listenerConfirmTimeout = 10 * time.Second
+
+// Listener probe intervals before and after listenerConfirmTimeout
+const (
+	listenerProbeInterval     = 250 * time.Millisecond
+	listenerSlowProbeInterval = 2 * time.Second
+)
+
+// profileStateTransitions lists the states reachable from each state
+var profileStateTransitions = map[ProfileState][]ProfileState{
+	StateStopped:      {StateStarting},
+	StateStarting:     {StateRunning, StateStopping, StateFailed, StateRestarting, StateCrashLooping},
+	StateRunning:      {StateStopping, StateRestarting, StateCrashLooping},
+	StateRestarting:   {StateStarting, StateStopping, StateCrashLooping},
+	StateStopping:     {StateStopped},
+	StateFailed:       {StateStarting, StateStopping},
+	StateCrashLooping: {StateStarting, StateStopping},
+}
+
+// canTransition reports whether a profile may move from one state to another
+func canTransition(from, to ProfileState) bool {
+	for _, s := range profileStateTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// isTerminal reports whether no GOST process is managed in this state
+func (s ProfileState) isTerminal() bool {
+	return s == StateStopped || s == StateFailed || s == StateCrashLooping
+}
+
+// setState moves the process to a new state, recording lastErr for failure
+// states. Invalid transitions are ignored and reported as false. Caller must
+// hold API.mutex.
+func (p *supervisedProcess) setState(state ProfileState, lastErr string) bool {
+	if !canTransition(p.state, state) {
+		return false
+	}
+	p.state = state
+	switch state {
+	case StateFailed, StateCrashLooping:
+		p.lastError = lastErr
+	case StateRunning:
+		p.lastError = ""
+	}
+	p.events.publish(TopicProfileState, ProfileStateEvent{
+		ProfileID:    p.profileID,
+		ProfileName:  p.profileName,
+		State:        string(state),
+		LastError:    p.lastError,
+		RestartCount: p.restarts,
+	})
+	return true
+}
+
+// markRunning records that GOST confirmed its listener for the profile
+func (a *API) markRunning(proc *supervisedProcess, how string) {
+	id := proc.profileID
+
+	a.mutex.Lock()
+	if proc.state != StateStarting || !proc.setState(StateRunning, "") {
+		a.mutex.Unlock()
+		return
+	}
+	firstStart := proc.restarts == 0
+	elapsed := time.Since(proc.startedAt).Round(time.Millisecond)
+	listen := proc.listen
+	a.mutex.Unlock()
+
+	if proc.group != nil {
+		a.groupReady(proc.group)
+	}
+
+	a.addLog("INFO", "api", fmt.Sprintf("Profile %s is running, listener on %s confirmed by %s", proc.profileName, listen, how), &id, proc.profileName)
+
+	if firstStart {
+		// Create timeline event for profile start
+		a.addTimelineEvent("proxy_action", "Profile Started",
+			fmt.Sprintf("Proxy profile '%s' started on %s", proc.profileName, listen),
+			"success", "admin", elapsed.String(), proc.profileName)
+	}
+}
+
+// awaitListener waits for the profile's listener to come up. GOST's
+// "listening on" log line usually wins; a probe covers log levels that hide
+// it. Listeners that can't be probed, such as reverse listeners bound on the
+// far end of the chain, are only confirmed by the log line. The profile
+// stays starting until one of these confirms it or the process stops.
+func (a *API) awaitListener(proc *supervisedProcess, profile *database.Profile) {
+	deadline := time.Now().Add(listenerConfirmTimeout)
+	probe, how := listenerProbe(profile)
+
+	warned := false
+	for {
+		a.mutex.Lock()
+		state := proc.state
+		a.mutex.Unlock()
+		if state != StateStarting {
+			return
+		}
+
+		if probe != nil && probe() {
+			a.markRunning(proc, how)
+			return
+		}
+
+		interval := listenerProbeInterval
+		if time.Now().After(deadline) {
+			interval = listenerSlowProbeInterval
+			if !warned {
+				warned = true
+				until := "GOST reports it"
+				if probe != nil {
+					until += " or the " + how + " finds it"
+				}
+				a.addLog("WARN", "api", fmt.Sprintf("Could not confirm listener for profile %s within %s, it stays starting until %s", proc.profileName, listenerConfirmTimeout, until), &proc.profileID, proc.profileName)
+			}
+		}
+
+		select {
+		case <-proc.stopCh:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// listenerProbe returns a check that the profile's listener is up and how
+// it confirms it, or nil when only GOST's log can tell. TCP listeners are
+// dialled. UDP ports can't be dialled, and binding them to test would race
+// GOST for the port, so they are looked up in the kernel's socket tables
+// where those are available.
+func listenerProbe(profile *database.Profile) (func() bool, string) {
+	listener, err := profileListener(profile)
+	if err != nil || listener.ReverseListener {
+		return nil, ""
+	}
+	addr := listenerProbeAddr(profile.Listen)
+	if addr == "" {
+		return nil, ""
+	}
+
+	if listener.Network == "udp" {
+		host, portStr, _ := net.SplitHostPort(profile.Listen)
+		port, _ := strconv.Atoi(portStr)
+		// A wildcard or host name listen matches the port on any address
+		ip := net.ParseIP(host)
+		if ip != nil && ip.IsUnspecified() {
+			ip = nil
+		}
+		if _, ok := udpPortBound(ip, port); !ok {
+			return nil, ""
+		}
+		return func() bool {
+			bound, _ := udpPortBound(ip, port)
+			return bound
+		}, "socket table"
+	}
+
+	return func() bool {
+		conn, err := net.DialTimeout("tcp", addr, 250*time.Millisecond)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}, "dial probe"
+}
+
+// udpPortTables are the kernel's UDP socket tables on Linux
+var udpPortTables = []string{"/proc/net/udp", "/proc/net/udp6"}
+
+// udpPortBound reports whether a UDP socket is bound to ip and port, or to
+// port on any address when ip is nil. ok is false when the socket tables
+// can't be read on this platform.
+func udpPortBound(ip net.IP, port int) (bound, ok bool) {
+	for _, table := range udpPortTables {
+		data, err := os.ReadFile(table)
+		if err != nil {
+			continue
+		}
+		ok = true
+		// Entries look like "0: 0100007F:0035 00000000:0000 07 ..."
+		for _, line := range strings.Split(string(data), "\n")[1:] {
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				continue
+			}
+			i := strings.LastIndexByte(fields[1], ':')
+			if i < 0 {
+				continue
+			}
+			p, err := strconv.ParseUint(fields[1][i+1:], 16, 16)
+			if err != nil || int(p) != port {
+				continue
+			}
+			if ip == nil || ip.Equal(parseProcNetIP(fields[1][:i])) {
+				return true, true
+			}
+		}
+	}
+	return false, ok
+}
+
+// parseProcNetIP decodes an address from the kernel's socket tables, which
+// print it as 32-bit words in host byte order
+func parseProcNetIP(s string) net.IP {
+	b, err := hex.DecodeString(s)
+	if err != nil || (len(b) != net.IPv4len && len(b) != net.IPv6len) {
+		return nil
+	}
+	for i := 0; i < len(b); i += 4 {
+		binary.NativeEndian.PutUint32(b[i:], binary.BigEndian.Uint32(b[i:]))
+	}
+	return net.IP(b)
+}
+
+// listenerProbeAddr turns a listen address such as ":1080" or "0.0.0.0:1080"
+// into an address that can be dialled locally
+func listenerProbeAddr(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil || port == "" {
+		return ""
+	}
+	switch host {
+	case "", "0.0.0.0", "::", "[::]":
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// isGostListeningLine reports whether a GOST log line announces a ready listener
+func isGostListeningLine(line string) bool {
+	return strings.Contains(strings.ToLower(line), "listening on")
+}
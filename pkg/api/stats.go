@@ -0,0 +1,498 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Traffic statistics tuning
+const (
+	statsInterval    = 5 * time.Second
+	statsHistorySize = 120 // ten minutes of samples
+	gostMetricsPath  = "/metrics"
+)
+
+// GOST metric names, each labelled with the service it was recorded for
+const (
+	metricBytesIn  = "gost_service_transfer_input_bytes_total"
+	metricBytesOut = "gost_service_transfer_output_bytes_total"
+	metricRequests = "gost_service_requests_total"
+	metricInFlight = "gost_service_requests_in_flight"
+	metricErrors   = "gost_service_handler_errors_total"
+)
+
+// GostMetricsConfig enables GOST's Prometheus metrics endpoint
+type GostMetricsConfig struct {
+	Addr string    `json:"addr"`
+	Path string    `json:"path"`
+	Auth *GostAuth `json:"auth,omitempty"`
+}
+
+// ProfileStats are a profile's traffic counters, accumulated across restarts
+// since Gostly started
+type ProfileStats struct {
+	ProfileID         int64   `json:"profile_id"`
+	BytesIn           int64   `json:"bytes_in"`
+	BytesOut          int64   `json:"bytes_out"`
+	ActiveConnections int64   `json:"active_connections"`
+	TotalConnections  int64   `json:"total_connections"`
+	Errors            int64   `json:"errors"`
+	InRate            float64 `json:"in_rate"`  // bytes per second over the last interval
+	OutRate           float64 `json:"out_rate"` // bytes per second over the last interval
+	UpdatedAt         string  `json:"updated_at,omitempty"`
+}
+
+// StatsSample is a point in a profile's throughput history
+type StatsSample struct {
+	Timestamp         string  `json:"timestamp"`
+	InRate            float64 `json:"in_rate"`
+	OutRate           float64 `json:"out_rate"`
+	ActiveConnections int64   `json:"active_connections"`
+}
+
+// serviceCounters are the raw metric values of one or more GOST services
+type serviceCounters struct {
+	bytesIn, bytesOut, requests, errors, inFlight float64
+}
+
+func (c *serviceCounters) add(o *serviceCounters) {
+	c.bytesIn += o.bytesIn
+	c.bytesOut += o.bytesOut
+	c.requests += o.requests
+	c.errors += o.errors
+	c.inFlight += o.inFlight
+}
+
+// statsTracker turns the counters scraped from a profile's process into
+// totals that survive restarts
+type statsTracker struct {
+	stats   ProfileStats
+	source  *gostMetricsClient // process the last counters came from
+	last    serviceCounters
+	lastAt  time.Time
+	history []StatsSample
+
+	// Processes without a metrics endpoint are counted from their logs
+	fromLogs              bool
+	sampledIn, sampledOut int64 // byte totals at the last log-derived sample
+}
+
+// gostMetricsClient scrapes the metrics endpoint of a GOST process started by Gostly
+type gostMetricsClient struct {
+	addr     string
+	username string
+	password string
+	http     *http.Client
+}
+
+// newGostMetricsClient picks a free loopback port and random credentials for
+// a process's metrics endpoint
+func newGostMetricsClient() (*gostMetricsClient, error) {
+	addr, password, err := loopbackEndpoint()
+	if err != nil {
+		return nil, err
+	}
+	return &gostMetricsClient{
+		addr:     addr,
+		username: "gostly",
+		password: password,
+		http:     &http.Client{Timeout: 2 * time.Second},
+	}, nil
+}
+
+// config returns the metrics block that makes GOST serve this client
+func (c *gostMetricsClient) config() *GostMetricsConfig {
+	return &GostMetricsConfig{
+		Addr: c.addr,
+		Path: gostMetricsPath,
+		Auth: &GostAuth{Username: c.username, Password: c.password},
+	}
+}
+
+// scrape returns the counters of every service in the process
+func (c *gostMetricsClient) scrape() (map[string]*serviceCounters, error) {
+	req, err := http.NewRequest(http.MethodGet, "http://"+c.addr+gostMetricsPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(c.username, c.password)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metrics endpoint returned %d", resp.StatusCode)
+	}
+	return parseGostMetrics(resp.Body)
+}
+
+// parseGostMetrics reads the per-service counters from GOST's Prometheus
+// text output
+func parseGostMetrics(r io.Reader) (map[string]*serviceCounters, error) {
+	services := map[string]*serviceCounters{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, labels, value, ok := parseMetricLine(line)
+		if !ok {
+			continue
+		}
+		service := labels["service"]
+		if service == "" {
+			continue
+		}
+		c := services[service]
+		if c == nil {
+			c = &serviceCounters{}
+			services[service] = c
+		}
+		switch name {
+		case metricBytesIn:
+			c.bytesIn += value
+		case metricBytesOut:
+			c.bytesOut += value
+		case metricRequests:
+			c.requests += value
+		case metricInFlight:
+			c.inFlight += value
+		case metricErrors:
+			c.errors += value
+		}
+	}
+	return services, scanner.Err()
+}
+
+// parseMetricLine splits a sample line such as
+// name{label="value",...} 123 into its parts
+func parseMetricLine(line string) (string, map[string]string, float64, bool) {
+	labels := map[string]string{}
+	name := line
+	rest := ""
+	if i := strings.IndexByte(line, '{'); i >= 0 {
+		name = line[:i]
+		end := i + 1
+		for end < len(line) && line[end] != '}' {
+			eq := strings.IndexByte(line[end:], '=')
+			if eq < 0 || end+eq+1 >= len(line) || line[end+eq+1] != '"' {
+				return "", nil, 0, false
+			}
+			key := strings.TrimSpace(line[end : end+eq])
+			var value strings.Builder
+			j := end + eq + 2
+			for ; j < len(line) && line[j] != '"'; j++ {
+				if line[j] == '\\' && j+1 < len(line) {
+					j++
+					if line[j] == 'n' {
+						value.WriteByte('\n')
+						continue
+					}
+				}
+				value.WriteByte(line[j])
+			}
+			if j >= len(line) {
+				return "", nil, 0, false
+			}
+			labels[key] = value.String()
+			end = j + 1
+			if end < len(line) && line[end] == ',' {
+				end++
+			}
+		}
+		if end >= len(line) {
+			return "", nil, 0, false
+		}
+		rest = line[end+1:]
+	} else if i := strings.IndexAny(line, " \t"); i >= 0 {
+		name, rest = line[:i], line[i:]
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return "", nil, 0, false
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return "", nil, 0, false
+	}
+	return name, labels, value, true
+}
+
+// statsTarget is a process to scrape and the profiles its services belong to
+type statsTarget struct {
+	client    *gostMetricsClient
+	profileID int64            // every service belongs to this profile...
+	owners    map[string]int64 // ...unless the process is shared by a group
+}
+
+// runStatsCollector scrapes every running process until Close
+func (a *API) runStatsCollector() {
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.statsStop:
+			return
+		case <-ticker.C:
+			a.collectStats()
+		}
+	}
+}
+
+// collectStats scrapes the metrics of every running process once
+func (a *API) collectStats() {
+	var targets []statsTarget
+	var unscraped []int64
+	a.mutex.Lock()
+	for id, proc := range a.processes {
+		if proc.state != StateStarting && proc.state != StateRunning {
+			continue
+		}
+		switch {
+		case proc.group == nil && proc.metrics != nil:
+			targets = append(targets, statsTarget{client: proc.metrics, profileID: id})
+		case proc.group == nil && proc.metrics == nil, proc.group != nil && proc.group.metrics == nil:
+			unscraped = append(unscraped, id)
+		}
+	}
+	for _, g := range a.groups {
+		if g.metrics != nil && g.cmd != nil {
+			owners := make(map[string]int64, len(g.services))
+			for service, id := range g.services {
+				owners[service] = id
+			}
+			targets = append(targets, statsTarget{client: g.metrics, owners: owners})
+		}
+	}
+	a.mutex.Unlock()
+
+	results := make([]map[int64]*serviceCounters, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target statsTarget) {
+			defer wg.Done()
+			services, err := target.client.scrape()
+			if err != nil {
+				// The process may still be starting or already gone
+				return
+			}
+			perProfile := map[int64]*serviceCounters{}
+			if target.owners == nil {
+				perProfile[target.profileID] = &serviceCounters{}
+			}
+			for service, counters := range services {
+				id := target.profileID
+				if target.owners != nil {
+					var ok bool
+					if id, ok = target.owners[service]; !ok {
+						continue
+					}
+				}
+				if perProfile[id] == nil {
+					perProfile[id] = &serviceCounters{}
+				}
+				perProfile[id].add(counters)
+			}
+			results[i] = perProfile
+		}(i, target)
+	}
+	wg.Wait()
+
+	now := time.Now()
+	a.statsMutex.Lock()
+	defer a.statsMutex.Unlock()
+
+	seen := map[int64]bool{}
+	for i, perProfile := range results {
+		for id, counters := range perProfile {
+			a.recordStats(id, targets[i].client, counters, now)
+			seen[id] = true
+		}
+	}
+	for _, id := range unscraped {
+		if t := a.stats[id]; t != nil && t.fromLogs {
+			t.sampleLogStats(now)
+			seen[id] = true
+		}
+	}
+	// Profiles that are no longer running keep their totals but carry no traffic
+	for id, t := range a.stats {
+		if !seen[id] {
+			t.stats.ActiveConnections = 0
+			t.stats.InRate = 0
+			t.stats.OutRate = 0
+		}
+	}
+}
+
+// recordStats folds a scrape into a profile's totals. Caller must hold statsMutex.
+func (a *API) recordStats(id int64, source *gostMetricsClient, c *serviceCounters, now time.Time) {
+	t := a.stats[id]
+	if t == nil {
+		t = &statsTracker{stats: ProfileStats{ProfileID: id}}
+		a.stats[id] = t
+	}
+	t.fromLogs = false
+	// A new process starts its counters from zero
+	if t.source != source {
+		t.source = source
+		t.last = serviceCounters{}
+		t.lastAt = time.Time{}
+	}
+
+	delta := func(cur, prev float64) float64 {
+		if cur < prev {
+			return cur
+		}
+		return cur - prev
+	}
+	dIn := delta(c.bytesIn, t.last.bytesIn)
+	dOut := delta(c.bytesOut, t.last.bytesOut)
+
+	elapsed := statsInterval.Seconds()
+	if !t.lastAt.IsZero() {
+		elapsed = now.Sub(t.lastAt).Seconds()
+	}
+
+	t.stats.BytesIn += int64(dIn)
+	t.stats.BytesOut += int64(dOut)
+	t.stats.TotalConnections += int64(delta(c.requests, t.last.requests))
+	t.stats.Errors += int64(delta(c.errors, t.last.errors))
+	t.stats.ActiveConnections = int64(c.inFlight)
+	t.stats.InRate = dIn / elapsed
+	t.stats.OutRate = dOut / elapsed
+	t.stats.UpdatedAt = now.Format(time.RFC3339)
+	t.last = *c
+	t.lastAt = now
+	t.appendSample()
+}
+
+// appendSample adds the current rates to the tracker's history
+func (t *statsTracker) appendSample() {
+	t.history = append(t.history, StatsSample{
+		Timestamp:         t.stats.UpdatedAt,
+		InRate:            t.stats.InRate,
+		OutRate:           t.stats.OutRate,
+		ActiveConnections: t.stats.ActiveConnections,
+	})
+	if len(t.history) > statsHistorySize {
+		t.history = t.history[len(t.history)-statsHistorySize:]
+	}
+}
+
+// recordLogStats counts a GOST log line toward a profile's stats when its
+// process has no metrics endpoint to scrape. Connections are counted when
+// GOST logs them opening ("<>") and their bytes when it logs them closing ("><").
+func (a *API) recordLogStats(id int64, entry LogEntry) {
+	if entry.Fields == nil {
+		return
+	}
+	a.mutex.Lock()
+	proc := a.processes[id]
+	scraped := proc == nil || proc.metrics != nil || (proc.group != nil && proc.group.metrics != nil)
+	a.mutex.Unlock()
+	if scraped {
+		return
+	}
+
+	a.statsMutex.Lock()
+	defer a.statsMutex.Unlock()
+	t := a.stats[id]
+	if t == nil {
+		t = &statsTracker{stats: ProfileStats{ProfileID: id}}
+		a.stats[id] = t
+	}
+	t.fromLogs = true
+
+	switch {
+	case entry.DurationMs > 0 || strings.Contains(entry.Message, "><"):
+		in, out := entry.gostBytes()
+		t.stats.BytesIn += in
+		t.stats.BytesOut += out
+		if t.stats.ActiveConnections > 0 {
+			t.stats.ActiveConnections--
+		}
+	case strings.Contains(entry.Message, "<>"):
+		t.stats.TotalConnections++
+		t.stats.ActiveConnections++
+	}
+	if entry.Level == "ERROR" {
+		t.stats.Errors++
+	}
+}
+
+// sampleLogStats derives rates from the byte totals counted from logs.
+// Caller must hold statsMutex.
+func (t *statsTracker) sampleLogStats(now time.Time) {
+	elapsed := statsInterval.Seconds()
+	if !t.lastAt.IsZero() {
+		elapsed = now.Sub(t.lastAt).Seconds()
+	}
+	t.stats.InRate = float64(t.stats.BytesIn-t.sampledIn) / elapsed
+	t.stats.OutRate = float64(t.stats.BytesOut-t.sampledOut) / elapsed
+	t.stats.UpdatedAt = now.Format(time.RFC3339)
+	t.sampledIn, t.sampledOut = t.stats.BytesIn, t.stats.BytesOut
+	t.lastAt = now
+	t.appendSample()
+}
+
+// GetProfileStats returns a profile's traffic counters
+func (a *API) GetProfileStats(id int64) ProfileStats {
+	a.statsMutex.RLock()
+	defer a.statsMutex.RUnlock()
+	if t, ok := a.stats[id]; ok {
+		return t.stats
+	}
+	return ProfileStats{ProfileID: id}
+}
+
+// GetAllProfileStats returns the traffic counters of every profile that has carried traffic
+func (a *API) GetAllProfileStats() []ProfileStats {
+	a.statsMutex.RLock()
+	stats := make([]ProfileStats, 0, len(a.stats))
+	for _, t := range a.stats {
+		stats = append(stats, t.stats)
+	}
+	a.statsMutex.RUnlock()
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].ProfileID < stats[j].ProfileID })
+	return stats
+}
+
+// GetProfileStatsHistory returns a profile's recent throughput samples, oldest first
+func (a *API) GetProfileStatsHistory(id int64) []StatsSample {
+	a.statsMutex.RLock()
+	defer a.statsMutex.RUnlock()
+	t, ok := a.stats[id]
+	if !ok {
+		return []StatsSample{}
+	}
+	return append([]StatsSample{}, t.history...)
+}
+
+// dropStats forgets a profile's counters
+func (a *API) dropStats(id int64) {
+	a.statsMutex.Lock()
+	delete(a.stats, id)
+	a.statsMutex.Unlock()
+}
+
+// resetStats forgets every profile's counters
+func (a *API) resetStats() {
+	a.statsMutex.Lock()
+	a.stats = make(map[int64]*statsTracker)
+	a.statsMutex.Unlock()
+}
@@ -0,0 +1,435 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/imansprn/gostly/pkg/database"
+)
+
+// Supervisor tuning. A process that stays up for supervisorStableAfter is
+// considered healthy again and gets its restart budget back.
+const (
+	supervisorMaxRestarts = 5
+	supervisorBaseBackoff = 1 * time.Second
+	supervisorMaxBackoff  = 30 * time.Second
+	supervisorStableAfter = 60 * time.Second
+
+	// defaultStopTimeout is how long a GOST process gets to drain after SIGTERM before it is killed
+	defaultStopTimeout = 3 * time.Second
+	stopTimeoutSetting = "stop_timeout" // workspace setting overriding it, in seconds
+)
+
+// supervisedProcess tracks a GOST process for a single profile across restarts.
+// All mutable fields are guarded by API.mutex.
+type supervisedProcess struct {
+	profileID   int64
+	profileName string
+	listen      string
+
+	state         ProfileState
+	lastError     string // error that put the profile into StateFailed/StateCrashLooping
+	lastGostError string // most recent ERROR line logged by GOST
+
+	cmd        *exec.Cmd
+	output     *sync.WaitGroup // stdout/stderr readers, must finish before cmd.Wait
+	configPath string
+	startedAt  time.Time
+
+	stopCh        chan struct{} // closed when StopProfile/Close asks the supervisor to stop
+	done          chan struct{} // closed when the supervisor goroutine returns
+	stopRequested bool
+
+	restarts     int // total restarts since StartProfile
+	failures     int // consecutive unexpected exits, reset after a stable run
+	lastExitCode int
+
+	group   *processGroup      // shared process the profile runs in, nil for its own
+	api     *gostAPIClient     // Web API of the running process, nil when not enabled
+	metrics *gostMetricsClient // metrics endpoint of the running process, nil when not enabled
+	events  *eventBus          // where state changes are published
+}
+
+// newSupervisedProcess creates the supervisor bookkeeping for a profile,
+// publishing its state changes on events
+func newSupervisedProcess(profile *database.Profile, events *eventBus) *supervisedProcess {
+	return &supervisedProcess{
+		events:      events,
+		profileID:   profile.ID,
+		profileName: profile.Name,
+		listen:      profile.Listen,
+		state:       StateStopped,
+		stopCh:      make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// requestStop marks the process as intentionally stopped. Caller must hold API.mutex.
+func (p *supervisedProcess) requestStop() {
+	if !p.stopRequested {
+		p.stopRequested = true
+		p.setState(StateStopping, "")
+		close(p.stopCh)
+	}
+}
+
+// isActive reports whether the supervisor is still managing a process. Caller must hold API.mutex.
+func (p *supervisedProcess) isActive() bool {
+	return !p.state.isTerminal()
+}
+
+// terminate asks the supervised process to exit with SIGTERM and waits up to
+// timeout for the supervisor to reap it, killing the process if it does not
+// drain in time. It returns the process exit code and whether it was killed.
+func (a *API) terminate(proc *supervisedProcess, timeout time.Duration) (int, bool) {
+	if proc.group != nil {
+		return a.leaveGroup(proc, timeout)
+	}
+
+	a.mutex.Lock()
+	proc.requestStop()
+	cmd := proc.cmd
+	a.mutex.Unlock()
+
+	forced := false
+	if cmd != nil && cmd.Process != nil {
+		if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+			// Not supported on every platform (e.g. Windows); fall back to killing
+			a.addLog("DEBUG", "api", fmt.Sprintf("Failed to send SIGTERM to PID %d: %v", cmd.Process.Pid, err), &proc.profileID, proc.profileName)
+			cmd.Process.Kill()
+			forced = true
+		}
+	}
+
+	killed := false
+	select {
+	case <-proc.done:
+	case <-time.After(timeout):
+		killed = true
+		a.addLog("WARN", "api", fmt.Sprintf("Profile %s didn't stop within %s, killing it", proc.profileName, timeout), &proc.profileID, proc.profileName)
+		if cmd != nil && cmd.Process != nil {
+			cmd.Process.Kill()
+		}
+		<-proc.done
+	}
+
+	a.mutex.Lock()
+	proc.setState(StateStopped, "")
+	exitCode := proc.lastExitCode
+	a.mutex.Unlock()
+	if forced {
+		// The kill stood in for SIGTERM, so report it as a signal exit
+		exitCode = -1
+	}
+	return exitCode, killed
+}
+
+// applyProcessStatus fills the runtime fields of a profile from its supervisor. Caller must hold API.mutex.
+func (a *API) applyProcessStatus(profile *database.Profile) {
+	proc, ok := a.processes[profile.ID]
+	if !ok {
+		profile.Status = string(StateStopped)
+		return
+	}
+	profile.Status = string(proc.state)
+	profile.LastError = proc.lastError
+	profile.RestartCount = proc.restarts
+	profile.LastExitCode = proc.lastExitCode
+}
+
+// launchProfileProcess writes the GOST config for a profile and starts the process
+func (a *API) launchProfileProcess(proc *supervisedProcess, profile *database.Profile) error {
+	id := profile.ID
+
+	// Serve GOST's Web API on loopback so edits can be applied live. Raw
+	// configs are the user's own and are left as written.
+	var client *gostAPIClient
+	if !isRawProfile(profile) {
+		var err error
+		if client, err = newGostAPIClient(); err != nil {
+			a.addLog("WARN", "api", fmt.Sprintf("Starting profile %s without the GOST API: %v", profile.Name, err), &id, profile.Name)
+			client = nil
+		}
+	}
+	// Serve metrics on loopback for the traffic statistics. Raw configs that
+	// already expose metrics keep their own endpoint.
+	metrics, err := newGostMetricsClient()
+	if err != nil || (isRawProfile(profile) && rawConfigHasMetrics(profile)) {
+		metrics = nil
+	}
+	// The API and metrics endpoints announce their own listeners, which say
+	// nothing about the profile's
+	isProfileListener := func(line string) bool {
+		return isGostListeningLine(line) &&
+			(client == nil || !strings.Contains(line, client.addr)) &&
+			(metrics == nil || !strings.Contains(line, metrics.addr))
+	}
+
+	// Create config file with logging configuration
+	configPath, err := a.createGostConfigWithLogging(profile, client, metrics)
+	if err != nil {
+		a.addLog("ERROR", "api", fmt.Sprintf("Failed to create config for profile %s: %v", profile.Name, err), &id, profile.Name)
+		return err
+	}
+
+	a.addLog("DEBUG", "api", fmt.Sprintf("Config file created: %s", configPath), &id, profile.Name)
+
+	// Start GOST process with output capture
+	gostPath := a.getGostPath()
+	cmd := exec.Command(gostPath, "-C", configPath)
+
+	// Capture stdout and stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		a.addLog("ERROR", "api", fmt.Sprintf("Failed to create stdout pipe: %v", err), &id, profile.Name)
+		os.Remove(configPath)
+		return err
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		a.addLog("ERROR", "api", fmt.Sprintf("Failed to create stderr pipe: %v", err), &id, profile.Name)
+		os.Remove(configPath)
+		return err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		a.addLog("ERROR", "api", fmt.Sprintf("Failed to start GOST process: %v", err), &id, profile.Name)
+		os.Remove(configPath)
+		return err
+	}
+
+	output := &sync.WaitGroup{}
+	output.Add(2)
+
+	a.mutex.Lock()
+	proc.cmd = cmd
+	proc.output = output
+	proc.configPath = configPath
+	proc.startedAt = time.Now()
+	proc.listen = profile.Listen
+	proc.lastGostError = ""
+	proc.api = client
+	proc.metrics = metrics
+	proc.setState(StateStarting, "")
+	a.mutex.Unlock()
+
+	a.addLog("INFO", "gost", fmt.Sprintf("GOST process started for profile %s (PID: %d)", profile.Name, cmd.Process.Pid), &id, profile.Name)
+
+	// Capture GOST output in goroutines
+	go func() {
+		defer output.Done()
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			line := scanner.Text()
+			entry := parseGostLog(line)
+			entry.Level = "INFO"
+			a.addGostLog(entry, &id, profile.Name)
+			if isProfileListener(line) {
+				a.markRunning(proc, "GOST log")
+			}
+		}
+	}()
+
+	go func() {
+		defer output.Done()
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			line := scanner.Text()
+			entry := parseGostLog(line)
+			a.addGostLog(entry, &id, profile.Name)
+			if entry.Level == "ERROR" {
+				a.mutex.Lock()
+				proc.lastGostError = entry.gostError()
+				a.mutex.Unlock()
+			} else if isProfileListener(line) {
+				a.markRunning(proc, "GOST log")
+			}
+		}
+	}()
+
+	// Only report running once the listener is confirmed
+	go a.awaitListener(proc, profile)
+
+	return nil
+}
+
+// superviseProfile waits for the profile's GOST process and restarts it with
+// exponential backoff when it exits without StopProfile having been called
+func (a *API) superviseProfile(proc *supervisedProcess) {
+	defer close(proc.done)
+	id := proc.profileID
+
+	for {
+		a.mutex.Lock()
+		cmd := proc.cmd
+		output := proc.output
+		a.mutex.Unlock()
+
+		// Drain GOST's output first so its last error is recorded
+		output.Wait()
+		exitCode := waitExitCode(cmd)
+
+		a.mutex.Lock()
+		os.Remove(proc.configPath)
+		proc.lastExitCode = exitCode
+		stopping := proc.stopRequested
+		// A process that dies before its first listener came up is
+		// misconfigured (bad address, port in use); restarting won't help
+		neverStarted := proc.state == StateStarting && proc.restarts == 0
+		if !stopping {
+			if time.Since(proc.startedAt) >= supervisorStableAfter {
+				proc.failures = 0
+			}
+			proc.failures++
+		}
+		failures := proc.failures
+		lastErr := proc.lastGostError
+		a.mutex.Unlock()
+
+		if stopping {
+			a.addLog("INFO", "gost", fmt.Sprintf("GOST process exited for profile %s (exit code %d)", proc.profileName, exitCode), &id, proc.profileName)
+			return
+		}
+
+		if lastErr == "" {
+			lastErr = fmt.Sprintf("GOST exited with code %d", exitCode)
+		}
+
+		if neverStarted {
+			a.markFailed(proc, lastErr)
+			return
+		}
+
+		a.addLog("ERROR", "gost", fmt.Sprintf("GOST process for profile %s exited unexpectedly (exit code %d)", proc.profileName, exitCode), &id, proc.profileName)
+
+		if failures > supervisorMaxRestarts {
+			a.markCrashLooping(proc, lastErr)
+			return
+		}
+
+		if !a.restartAfterBackoff(proc, failures) {
+			return
+		}
+	}
+}
+
+// restartAfterBackoff sleeps for the backoff period and relaunches the profile,
+// retrying launch failures within the same restart budget. It returns false
+// when the supervisor should exit.
+func (a *API) restartAfterBackoff(proc *supervisedProcess, failures int) bool {
+	id := proc.profileID
+
+	for {
+		backoff := supervisorBackoff(failures)
+
+		a.mutex.Lock()
+		proc.setState(StateRestarting, "")
+		a.mutex.Unlock()
+
+		a.addLog("WARN", "api", fmt.Sprintf("Restarting profile %s in %s (attempt %d/%d)", proc.profileName, backoff, failures, supervisorMaxRestarts), &id, proc.profileName)
+
+		select {
+		case <-proc.stopCh:
+			a.addLog("INFO", "api", fmt.Sprintf("Restart of profile %s cancelled", proc.profileName), &id, proc.profileName)
+			return false
+		case <-time.After(backoff):
+		}
+
+		profile, err := a.currentDB().GetProfile(id)
+		if err == nil {
+			err = a.launchProfileProcess(proc, profile)
+		}
+		if err == nil {
+			a.mutex.Lock()
+			proc.restarts++
+			restarts := proc.restarts
+			// StopProfile may have raced with the relaunch
+			if proc.stopRequested && proc.cmd != nil && proc.cmd.Process != nil {
+				proc.cmd.Process.Kill()
+			}
+			a.mutex.Unlock()
+
+			a.addTimelineEvent("proxy_action", "Profile Restarted",
+				fmt.Sprintf("Proxy profile '%s' restarted after unexpected exit (restart #%d)", proc.profileName, restarts),
+				"warning", "system", backoff.String(), proc.profileName)
+			return true
+		}
+
+		a.addLog("ERROR", "api", fmt.Sprintf("Failed to restart profile %s: %v", proc.profileName, err), &id, proc.profileName)
+
+		a.mutex.Lock()
+		proc.failures++
+		failures = proc.failures
+		a.mutex.Unlock()
+
+		if failures > supervisorMaxRestarts {
+			a.markCrashLooping(proc, err.Error())
+			return false
+		}
+	}
+}
+
+// markFailed records that a profile exited before its listener came up
+func (a *API) markFailed(proc *supervisedProcess, lastErr string) {
+	id := proc.profileID
+
+	a.mutex.Lock()
+	proc.setState(StateFailed, lastErr)
+	proc.cmd = nil
+	a.mutex.Unlock()
+
+	a.addLog("ERROR", "api", fmt.Sprintf("Profile %s failed to start: %s", proc.profileName, lastErr), &id, proc.profileName)
+
+	a.addTimelineEvent("error", "Profile Failed",
+		fmt.Sprintf("Proxy profile '%s' failed to start: %s", proc.profileName, lastErr),
+		"error", "system", "", proc.profileName)
+}
+
+// markCrashLooping records that a profile exhausted its restart budget
+func (a *API) markCrashLooping(proc *supervisedProcess, lastErr string) {
+	id := proc.profileID
+
+	a.mutex.Lock()
+	proc.setState(StateCrashLooping, lastErr)
+	proc.cmd = nil
+	restarts := proc.restarts
+	a.mutex.Unlock()
+
+	a.addLog("ERROR", "api", fmt.Sprintf("Profile %s is crash-looping, giving up after %d restarts: %s", proc.profileName, restarts, lastErr), &id, proc.profileName)
+
+	a.addTimelineEvent("error", "Profile Crash-Looping",
+		fmt.Sprintf("Proxy profile '%s' exited %d times in a row (%s) and will not be restarted", proc.profileName, supervisorMaxRestarts+1, lastErr),
+		"error", "system", "", proc.profileName)
+}
+
+// supervisorBackoff returns the delay before the n-th consecutive restart
+func supervisorBackoff(failures int) time.Duration {
+	backoff := supervisorBaseBackoff
+	for i := 1; i < failures; i++ {
+		backoff *= 2
+		if backoff >= supervisorMaxBackoff {
+			return supervisorMaxBackoff
+		}
+	}
+	return backoff
+}
+
+// waitExitCode waits for cmd to exit and returns its exit code (-1 if killed by a signal)
+func waitExitCode(cmd *exec.Cmd) int {
+	if cmd == nil {
+		return -1
+	}
+	cmd.Wait()
+	if cmd.ProcessState == nil {
+		return -1
+	}
+	return cmd.ProcessState.ExitCode()
+}
@@ -0,0 +1,161 @@
+package api
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/imansprn/gostly/pkg/database"
+)
+
+const defaultTailLimit = 100
+
+// LogTail is a batch of log entries that follow a cursor, oldest first
+type LogTail struct {
+	Entries    []LogEntry `json:"entries"`
+	NextCursor string     `json:"next_cursor"` // pass back to get the entries after these
+	HasMore    bool       `json:"has_more"`    // more entries already follow NextCursor
+	Skipped    int64      `json:"skipped"`     // entries before NextCursor that are gone
+}
+
+// TimelineTail is a batch of timeline events that follow a cursor, oldest first
+type TimelineTail struct {
+	Events     []TimelineEvent `json:"events"`
+	NextCursor string          `json:"next_cursor"`
+	HasMore    bool            `json:"has_more"`
+	Skipped    int64           `json:"skipped"`
+}
+
+// parseTailCursor reads a cursor returned by a tail call. Empty means the
+// caller has none yet; "0" asks for everything from the start.
+func parseTailCursor(cursor string) (id int64, ok bool, err error) {
+	if cursor == "" {
+		return 0, false, nil
+	}
+	id, err = strconv.ParseInt(cursor, 10, 64)
+	if err != nil || id < 0 {
+		return 0, false, fmt.Errorf("invalid cursor %q", cursor)
+	}
+	return id, true, nil
+}
+
+// tailLimit clamps a requested batch size
+func tailLimit(limit int) int {
+	if limit <= 0 {
+		return defaultTailLimit
+	}
+	if limit > maxLogQueryLimit {
+		return maxLogQueryLimit
+	}
+	return limit
+}
+
+// GetLogsSince returns up to limit log entries logged after cursor. Without
+// a cursor it returns the newest entries. Following NextCursor from call to
+// call never repeats an entry, and entries that have already left memory are
+// read back from the database. Entries can still be gone by then: pruned by
+// retention, or never written because the database queue was full when they
+// were logged. IDs are sequential, so Skipped counts them.
+func (a *API) GetLogsSince(cursor string, limit int) (*LogTail, error) {
+	after, ok, err := parseTailCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+	limit = tailLimit(limit)
+
+	// Snapshot memory first: anything older than it was queued for the
+	// database before the snapshot, so the flush below is sure to cover it
+	a.logMutex.RLock()
+	oldest := a.lastLogID + 1
+	if len(a.logs) > 0 {
+		oldest = a.logs[0].ID
+	}
+	if !ok {
+		after = a.lastLogID
+		if len(a.logs) > limit {
+			after = a.logs[len(a.logs)-limit-1].ID
+		} else if len(a.logs) > 0 {
+			after = oldest - 1
+		}
+	}
+	start := sort.Search(len(a.logs), func(i int) bool { return a.logs[i].ID > after })
+	recent := make([]LogEntry, 0, limit+1)
+	for _, entry := range a.logs[start:] {
+		if len(recent) > limit {
+			break
+		}
+		recent = append(recent, entry)
+	}
+	a.logMutex.RUnlock()
+
+	entries := []LogEntry{}
+	if after+1 < oldest {
+		a.flushLogs()
+		records, err := a.currentDB().QueryLogs(database.LogFilter{
+			AfterID:   after,
+			BeforeID:  oldest,
+			Ascending: true,
+			Limit:     limit + 1,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			entries = append(entries, logEntryFromRecord(r))
+		}
+	}
+	entries = append(entries, recent...)
+
+	tail := &LogTail{Entries: entries, NextCursor: strconv.FormatInt(after, 10)}
+	if len(entries) > limit {
+		tail.Entries, tail.HasMore = entries[:limit], true
+	}
+	if n := len(tail.Entries); n > 0 {
+		last := tail.Entries[n-1].ID
+		tail.NextCursor = strconv.FormatInt(last, 10)
+		tail.Skipped = last - after - int64(n)
+	}
+	return tail, nil
+}
+
+// GetTimelineEventsSince returns up to limit timeline events recorded after
+// cursor, or the newest events without one, the same way as GetLogsSince.
+// Only the events still in memory can be returned; Skipped counts the older
+// ones a stale cursor has missed.
+func (a *API) GetTimelineEventsSince(cursor string, limit int) (*TimelineTail, error) {
+	after, ok, err := parseTailCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+	limit = tailLimit(limit)
+
+	a.timelineMutex.RLock()
+	defer a.timelineMutex.RUnlock()
+
+	start := sort.Search(len(a.timelineEvents), func(i int) bool { return a.timelineEvents[i].ID > after })
+	if !ok {
+		start = len(a.timelineEvents) - limit
+		if start < 0 {
+			start = 0
+		}
+		after = a.nextEventID - 1
+		if start < len(a.timelineEvents) {
+			after = a.timelineEvents[start].ID - 1
+		}
+	}
+
+	tail := &TimelineTail{Events: []TimelineEvent{}, NextCursor: strconv.FormatInt(after, 10)}
+	for _, event := range a.timelineEvents[start:] {
+		if len(tail.Events) == limit {
+			tail.HasMore = true
+			break
+		}
+		tail.Events = append(tail.Events, event)
+	}
+	if n := len(tail.Events); n > 0 {
+		last := tail.Events[n-1].ID
+		tail.NextCursor = strconv.FormatInt(last, 10)
+		tail.Skipped = last - after - int64(n)
+	}
+	return tail, nil
+}
@@ -0,0 +1,295 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/imansprn/gostly/pkg/database"
+)
+
+// Validation error codes
+const (
+	CodeRequired    = "required"
+	CodeInvalid     = "invalid"
+	CodeUnsupported = "unsupported"
+	CodeOutOfRange  = "out_of_range"
+	CodeDuplicate   = "duplicate"
+	CodePortInUse   = "port_in_use"
+	CodeNotFound    = "not_found"
+)
+
+// FieldError describes a problem with a single profile field
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned when a profile fails validation. It is
+// serialized as-is to the frontend so forms can highlight individual fields.
+type ValidationError struct {
+	Errors []FieldError `json:"errors"`
+}
+
+func (e *ValidationError) Error() string {
+	parts := make([]string, 0, len(e.Errors))
+	for _, fe := range e.Errors {
+		parts = append(parts, fmt.Sprintf("%s: %s", fe.Field, fe.Message))
+	}
+	return "validation failed: " + strings.Join(parts, "; ")
+}
+
+// add records a field error
+func (e *ValidationError) add(field, code, format string, args ...interface{}) {
+	e.Errors = append(e.Errors, FieldError{Field: field, Code: code, Message: fmt.Sprintf(format, args...)})
+}
+
+// errOrNil returns e as an error if it holds any field errors
+func (e *ValidationError) errOrNil() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
+
+// validateProfile checks a profile's fields and that its listen port is not
+// claimed by any of the other profiles
+func validateProfile(p *database.Profile, others []database.Profile) *ValidationError {
+	verr := &ValidationError{}
+
+	if strings.TrimSpace(p.Name) == "" {
+		verr.add("name", CodeRequired, "name is required")
+	}
+
+	if isRawProfile(p) {
+		// Raw profiles listen wherever their first service does
+		if listen := validateRawConfig(verr, p.RawConfig); listen != "" {
+			p.Listen = listen
+		}
+	} else {
+		validateProtocols(verr, p)
+	}
+
+	listenHost, listenPort, listenOK := validateHostPort(verr, "listen", p.Listen, true)
+
+	if p.Remote != "" {
+		validateHostPort(verr, "remote", p.Remote, false)
+	}
+
+	validateUpstreams(verr, p)
+	validateProfileTLS(verr, p)
+
+	if p.Group != "" && !groupNamePattern.MatchString(p.Group) {
+		verr.add("group", CodeInvalid, "invalid group name %q: use up to 64 letters, digits, spaces, '.', '-' or '_'", p.Group)
+	}
+
+	if (p.Username == "") != (p.Password == "") {
+		field := "password"
+		if p.Username == "" {
+			field = "username"
+		}
+		verr.add(field, CodeRequired, "username and password must be set together")
+	}
+
+	if listenOK {
+		network := listenNetwork(p)
+		for _, other := range others {
+			if other.ID == p.ID {
+				continue
+			}
+			if listenAddrsOverlap(network, listenHost, listenPort, &other) {
+				verr.add("listen", CodeDuplicate, "port %d is already used by profile %q", listenPort, other.Name)
+				break
+			}
+		}
+	}
+
+	return verr
+}
+
+// validateUpstreams checks a profile's upstream nodes and selector settings
+func validateUpstreams(verr *ValidationError, p *database.Profile) {
+	for i, n := range p.Nodes {
+		field := fmt.Sprintf("nodes[%d]", i)
+		validateHostPort(verr, field+".addr", n.Addr, false)
+		if n.Weight < 0 {
+			verr.add(field+".weight", CodeOutOfRange, "weight must not be negative")
+		}
+	}
+
+	switch normalizeSelectorStrategy(p.Selector.Strategy) {
+	case "", "round", "rand", "fifo", "hash":
+	default:
+		verr.add("selector.strategy", CodeUnsupported, "unsupported selector strategy %q (use round, rand, fifo or hash)", p.Selector.Strategy)
+	}
+	if p.Selector.MaxFails < 0 {
+		verr.add("selector.max_fails", CodeOutOfRange, "max fails must not be negative")
+	}
+	if p.Selector.FailTimeout < 0 {
+		verr.add("selector.fail_timeout", CodeOutOfRange, "fail timeout must not be negative")
+	}
+}
+
+// validateHostPort checks that addr is a host:port pair. An empty host is
+// only allowed for listen addresses (":1080" means all interfaces).
+func validateHostPort(verr *ValidationError, field, addr string, allowEmptyHost bool) (string, int, bool) {
+	if addr == "" {
+		verr.add(field, CodeRequired, "%s is required", field)
+		return "", 0, false
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		verr.add(field, CodeInvalid, "%q is not a valid host:port address", addr)
+		return "", 0, false
+	}
+
+	if host == "" && !allowEmptyHost {
+		verr.add(field, CodeInvalid, "%q is missing a host", addr)
+		return "", 0, false
+	}
+	if host != "" && net.ParseIP(host) == nil && !isValidHostname(host) {
+		verr.add(field, CodeInvalid, "%q is not a valid IP address or hostname", host)
+		return "", 0, false
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		verr.add(field, CodeInvalid, "port %q is not a number", portStr)
+		return "", 0, false
+	}
+	if port < 1 || port > 65535 {
+		verr.add(field, CodeOutOfRange, "port %d must be between 1 and 65535", port)
+		return "", 0, false
+	}
+
+	return host, port, true
+}
+
+// isValidHostname checks hostname syntax per RFC 1123
+func isValidHostname(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if len(host) == 0 || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// listenAddrsOverlap reports whether another profile listens on the same
+// network and port on an overlapping interface. TCP and UDP ports don't clash.
+func listenAddrsOverlap(network, host string, port int, other *database.Profile) bool {
+	if listenNetwork(other) != network {
+		return false
+	}
+	otherHost, otherPortStr, err := net.SplitHostPort(other.Listen)
+	if err != nil {
+		return false
+	}
+	otherPort, err := strconv.Atoi(otherPortStr)
+	if err != nil || otherPort != port {
+		return false
+	}
+	return isWildcardHost(host) || isWildcardHost(otherHost) || strings.EqualFold(host, otherHost)
+}
+
+// listenNetwork returns the network a profile listens on, tcp when its
+// protocols don't resolve
+func listenNetwork(p *database.Profile) string {
+	listener, err := profileListener(p)
+	if err != nil || listener.Network == "" {
+		return "tcp"
+	}
+	return listener.Network
+}
+
+// isWildcardHost reports whether a listen host binds all interfaces
+func isWildcardHost(host string) bool {
+	return host == "" || host == "0.0.0.0" || host == "::"
+}
+
+// checkListenAvailable verifies at start time that no other running profile
+// or outside process holds the profile's listen port
+func (a *API) checkListenAvailable(p *database.Profile) error {
+	verr := &ValidationError{}
+	host, port, ok := validateHostPort(verr, "listen", p.Listen, true)
+	if !ok {
+		return verr
+	}
+
+	listener, err := profileListener(p)
+	if err != nil {
+		verr.add("type", CodeUnsupported, "%v", err)
+		return verr
+	}
+	if listener.ReverseListener {
+		// The port is bound on the remote end of the chain
+		return nil
+	}
+
+	profiles, err := a.currentDB().GetProfiles()
+	if err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	for _, other := range profiles {
+		if other.ID == p.ID {
+			continue
+		}
+		proc, running := a.processes[other.ID]
+		if running && proc.isActive() && listenAddrsOverlap(listener.Network, host, port, &other) {
+			verr.add("listen", CodePortInUse, "port %d is in use by running profile %q", port, other.Name)
+		}
+	}
+	a.mutex.Unlock()
+	if len(verr.Errors) > 0 {
+		return verr
+	}
+
+	// Probe the port by binding it briefly
+	if listener.Network == "udp" {
+		conn, err := net.ListenPacket("udp", p.Listen)
+		if err != nil {
+			verr.add("listen", CodePortInUse, "port %d is already bound by another process: %v", port, err)
+			return verr
+		}
+		conn.Close()
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", p.Listen)
+	if err != nil {
+		verr.add("listen", CodePortInUse, "port %d is already bound by another process: %v", port, err)
+		return verr
+	}
+	ln.Close()
+	return nil
+}
+
+// ValidateProfile validates a profile without saving it and returns the field errors
+func (a *API) ValidateProfile(profile database.Profile) ([]FieldError, error) {
+	profiles, err := a.currentDB().GetProfiles()
+	if err != nil {
+		return nil, err
+	}
+	errs := validateProfile(&profile, profiles).Errors
+	if errs == nil {
+		errs = []FieldError{}
+	}
+	return errs, nil
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"fmt"
+
+	"github.com/imansprn/gostly/pkg/database"
+)
+
+// DatabaseInfo describes where the open workspace is stored
+type DatabaseInfo struct {
+	Workspace     string `json:"workspace"`
+	Path          string `json:"path"`
+	Dir           string `json:"dir"`
+	SchemaVersion int    `json:"schema_version"`
+}
+
+// GetDatabaseInfo returns the resolved location of the open workspace
+func (a *API) GetDatabaseInfo() (*DatabaseInfo, error) {
+	db := a.currentDB()
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	return &DatabaseInfo{
+		Workspace:     db.Workspace(),
+		Path:          db.Path(),
+		Dir:           db.Dir(),
+		SchemaVersion: version,
+	}, nil
+}
+
+// ListWorkspaces returns the workspaces stored in the data directory
+func (a *API) ListWorkspaces() ([]string, error) {
+	db := a.currentDB()
+	workspaces, err := database.ListWorkspaces(db.Dir())
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range workspaces {
+		if w == db.Workspace() {
+			return workspaces, nil
+		}
+	}
+	return append(workspaces, db.Workspace()), nil
+}
+
+// SwitchWorkspace stops the current workspace's profiles and opens another
+// workspace, creating it if it doesn't exist. Profiles that were running in
+// the new workspace when it was last used are started again.
+func (a *API) SwitchWorkspace(name string) error {
+	if err := database.ValidateWorkspaceName(name); err != nil {
+		return err
+	}
+
+	// Wait for a restore in progress so it can't start the old workspace's
+	// profiles after they have been stopped
+	a.workspaceMu.Lock()
+	defer a.workspaceMu.Unlock()
+
+	previous := a.currentDB().Workspace()
+	if name == previous {
+		return nil
+	}
+
+	// Open the new workspace first so a failure leaves the current one in use
+	db, err := database.Open(name)
+	if err != nil {
+		a.addLog("ERROR", "api", fmt.Sprintf("Failed to open workspace %s: %v", name, err), nil, "")
+		return err
+	}
+
+	// New entries are written to db, so their IDs must not clash with its history
+	a.seedLogID(db)
+	// Supervisors, including their restart backoff, return before their
+	// processes are reported stopped, so none of them uses the old database
+	// after this
+	a.stopAllProcesses()
+	removeGostConfigs()
+	a.resetStats()
+	// The previous workspace's logs belong in its own database
+	a.flushLogs()
+
+	a.dbMutex.Lock()
+	old := a.db
+	a.db = db
+	a.dbMutex.Unlock()
+
+	// Queries already running on the old database finish before it closes
+	if err := old.Close(); err != nil {
+		a.addLog("WARN", "api", fmt.Sprintf("Failed to close workspace %s: %v", previous, err), nil, "")
+	}
+
+	details := fmt.Sprintf("Switched from workspace %s to %s (%s)", previous, name, db.Path())
+	a.addLog("INFO", "api", details, nil, "")
+	a.addTimelineEvent("configuration", "Workspace Switched", details, "success", "admin", "1s", "")
+
+	go a.restoreProfiles()
+	return nil
+}
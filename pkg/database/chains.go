@@ -0,0 +1,263 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Chain is an ordered list of proxy hops that a profile's traffic is sent through
+type Chain struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Hops        []Hop  `json:"hops"`
+}
+
+// Hop is a single upstream proxy in a chain
+type Hop struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	Addr      string `json:"addr"`
+	Connector string `json:"connector"` // proxy protocol spoken to the hop: "http", "socks5", "sshd", ...
+	Dialer    string `json:"dialer"`    // transport used to reach the hop: "tcp", "tls", "ws", "sshd", ...
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+
+	// TLS options for dialers that use TLS
+	TLSServerName string `json:"tls_server_name"`
+	TLSCAFile     string `json:"tls_ca_file"`
+	TLSSecure     bool   `json:"tls_secure"` // verify the hop's certificate
+
+	// Client certificate presented to hops that require client auth
+	TLSCertFile string `json:"tls_cert_file"`
+	TLSKeyFile  string `json:"tls_key_file"`
+}
+
+// createChainSchema creates the chains and chain_hops tables
+func createChainSchema(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS chains (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE,
+			description TEXT
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS chain_hops (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			chain_id INTEGER NOT NULL,
+			position INTEGER NOT NULL,
+			name TEXT,
+			addr TEXT NOT NULL,
+			connector TEXT NOT NULL,
+			dialer TEXT NOT NULL,
+			username TEXT,
+			password TEXT,
+			tls_server_name TEXT,
+			tls_ca_file TEXT,
+			tls_secure INTEGER NOT NULL DEFAULT 0,
+			FOREIGN KEY (chain_id) REFERENCES chains (id) ON DELETE CASCADE
+		)
+	`)
+	return err
+}
+
+// GetChains returns all chains with their hops
+func (db *DB) GetChains() ([]Chain, error) {
+	rows, err := db.conn.Query("SELECT id, name, description FROM chains ORDER BY name ASC")
+	if err != nil {
+		return nil, err
+	}
+
+	var chains []Chain
+	for rows.Next() {
+		var c Chain
+		var description sql.NullString
+		if err := rows.Scan(&c.ID, &c.Name, &description); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		c.Description = description.String
+		chains = append(chains, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range chains {
+		hops, err := db.getChainHops(chains[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		chains[i].Hops = hops
+	}
+	return chains, nil
+}
+
+// GetChain returns a chain and its hops by ID
+func (db *DB) GetChain(id int64) (*Chain, error) {
+	var c Chain
+	var description sql.NullString
+	err := db.conn.QueryRow("SELECT id, name, description FROM chains WHERE id = ?", id).Scan(&c.ID, &c.Name, &description)
+	if err != nil {
+		return nil, err
+	}
+	c.Description = description.String
+
+	hops, err := db.getChainHops(id)
+	if err != nil {
+		return nil, err
+	}
+	c.Hops = hops
+	return &c, nil
+}
+
+// getChainHops returns the hops of a chain in order
+func (db *DB) getChainHops(chainID int64) ([]Hop, error) {
+	rows, err := db.conn.Query(
+		"SELECT id, name, addr, connector, dialer, username, password, tls_server_name, tls_ca_file, tls_secure, tls_cert_file, tls_key_file FROM chain_hops WHERE chain_id = ? ORDER BY position ASC",
+		chainID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hops []Hop
+	for rows.Next() {
+		var h Hop
+		var name, username, password, serverName, caFile, certFile, keyFile sql.NullString
+		var secure int
+		if err := rows.Scan(&h.ID, &name, &h.Addr, &h.Connector, &h.Dialer, &username, &password, &serverName, &caFile, &secure, &certFile, &keyFile); err != nil {
+			return nil, err
+		}
+		h.Name = name.String
+		h.Username = username.String
+		if h.Password, err = db.decryptSecret(password.String); err != nil {
+			return nil, fmt.Errorf("hop %d: %w", h.ID, err)
+		}
+		h.TLSServerName = serverName.String
+		h.TLSCAFile = caFile.String
+		h.TLSSecure = secure == 1
+		h.TLSCertFile = certFile.String
+		h.TLSKeyFile = keyFile.String
+		hops = append(hops, h)
+	}
+	return hops, rows.Err()
+}
+
+// AddChain adds a new chain with its hops
+func (db *DB) AddChain(c *Chain) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO chains (name, description) VALUES (?, ?)", c.Name, c.Description)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	if err := db.insertChainHops(tx, id, c.Hops); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	c.ID = id
+	return nil
+}
+
+// UpdateChain updates a chain and replaces its hops
+func (db *DB) UpdateChain(c *Chain) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE chains SET name = ?, description = ? WHERE id = ?", c.Name, c.Description, c.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("chain %d not found", c.ID)
+	}
+
+	if _, err := tx.Exec("DELETE FROM chain_hops WHERE chain_id = ?", c.ID); err != nil {
+		return err
+	}
+	if err := db.insertChainHops(tx, c.ID, c.Hops); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteChain deletes a chain and its hops
+func (db *DB) DeleteChain(id int64) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM chain_hops WHERE chain_id = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM chains WHERE id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetProfilesUsingChain returns the names of profiles that reference a chain
+func (db *DB) GetProfilesUsingChain(chainID int64) ([]string, error) {
+	rows, err := db.conn.Query("SELECT name FROM profiles WHERE chain_id = ? ORDER BY name ASC", chainID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// insertChainHops writes hops in order for a chain
+func (db *DB) insertChainHops(tx *sql.Tx, chainID int64, hops []Hop) error {
+	for i := range hops {
+		h := &hops[i]
+		password, err := db.encryptSecret(h.Password)
+		if err != nil {
+			return err
+		}
+		res, err := tx.Exec(
+			"INSERT INTO chain_hops (chain_id, position, name, addr, connector, dialer, username, password, tls_server_name, tls_ca_file, tls_secure, tls_cert_file, tls_key_file) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			chainID, i, h.Name, h.Addr, h.Connector, h.Dialer, h.Username, password, h.TLSServerName, h.TLSCAFile, boolToInt(h.TLSSecure), h.TLSCertFile, h.TLSKeyFile,
+		)
+		if err != nil {
+			return err
+		}
+		if id, err := res.LastInsertId(); err == nil {
+			h.ID = id
+		}
+	}
+	return nil
+}
@@ -4,7 +4,6 @@ import (
 	"database/sql"
 	"fmt"
 	"os"
-	"path/filepath"
 
 	_ "github.com/mattn/go-sqlite3" // SQLite driver registration
 )
@@ -13,12 +12,52 @@ import (
 type Profile struct {
 	ID       int64  `json:"id"`
 	Name     string `json:"name"`
-	Type     string `json:"type"` // "forward" or "reverse"
+	Type     string `json:"type"`     // GOST handler type, or a legacy alias such as "forward" or "reverse"
+	Listener string `json:"listener"` // GOST listener type, empty for plain tcp/udp
 	Listen   string `json:"listen"`
 	Remote   string `json:"remote"`
 	Username string `json:"username"`
 	Password string `json:"password"`
-	Status   string `json:"status"` // "running" or "stopped"
+	Status   string `json:"status"` // "stopped", "starting", "running", "stopping", "restarting", "failed" or "crash-looping"
+
+	// Autostart is the persisted desired state: the profile is brought back up when Gostly starts
+	Autostart bool `json:"autostart"`
+
+	// ChainID routes the profile's traffic through a multi-hop chain (0 for none)
+	ChainID int64 `json:"chain_id"`
+
+	// Nodes load-balances forwarding across several upstreams instead of Remote
+	Nodes    []UpstreamNode `json:"nodes"`
+	Selector Selector       `json:"selector"`
+
+	// TLS configures TLS listeners such as tls, wss or h2
+	TLS TLSOptions `json:"tls"`
+
+	// RawConfig is the GOST config body (JSON or YAML) of "raw" profiles
+	RawConfig string `json:"raw_config"`
+
+	// Group runs the profile in one GOST process shared with the other
+	// profiles of the same group (empty for a process of its own)
+	Group string `json:"group"`
+
+	// LogLevel overrides the workspace's GOST log level for this profile
+	// (empty to use the default). Set with SetProfileLogLevel.
+	LogLevel string `json:"log_level"`
+
+	// Runtime supervisor information, not persisted
+	LastError    string `json:"last_error,omitempty"`
+	RestartCount int    `json:"restart_count"`
+	LastExitCode int    `json:"last_exit_code"`
+}
+
+// TLSOptions holds the certificate settings of a TLS listener
+type TLSOptions struct {
+	CertFile   string `json:"cert_file"`
+	KeyFile    string `json:"key_file"`
+	CAFile     string `json:"ca_file"`     // CA used to verify client certificates
+	ServerName string `json:"server_name"` // SNI the listener answers to
+	ClientAuth bool   `json:"client_auth"` // require client certificates signed by CAFile
+	MinVersion string `json:"min_version"` // "1.0" to "1.3", empty for GOST's default
 }
 
 // ActivityLog represents a profile operation log entry
@@ -34,120 +73,103 @@ type ActivityLog struct {
 
 // DB handles database operations
 type DB struct {
-	conn *sql.DB
+	conn      *sql.DB
+	dir       string  // directory holding the workspace databases and the secrets key
+	path      string  // this workspace's database file
+	workspace string  // workspace name, DefaultWorkspace for gostly.db
+	cipher    *Cipher // encrypts stored credentials
 }
 
-// New creates a new database connection
+// New opens the workspace named by GOSTLY_WORKSPACE, or the default one
 func New() (*DB, error) {
-	// Try multiple writable locations in order
-	locations := []struct {
-		desc string
-		prep func() (string, error)
-	}{
-		{desc: "user config dir", prep: os.UserConfigDir},
-		{desc: "user cache dir", prep: os.UserCacheDir},
-		{desc: "user home dir", prep: os.UserHomeDir},
-		{desc: "temp dir", prep: func() (string, error) { return os.TempDir(), nil }},
-		{desc: "current working dir", prep: func() (string, error) { return os.Getwd() }},
-	}
-
-	var lastErr error
-	for _, loc := range locations {
-		base, err := loc.prep()
-		if err != nil || base == "" {
-			if err == nil {
-				err = fmt.Errorf("empty base path")
-			}
-			lastErr = fmt.Errorf("get %s failed: %w", loc.desc, err)
-			continue
-		}
+	return Open(os.Getenv(WorkspaceEnv))
+}
 
-		// Ensure app directory exists
-		dbDir := filepath.Join(base, "gostly")
-		if mkErr := os.MkdirAll(dbDir, 0755); mkErr != nil {
-			lastErr = fmt.Errorf("mkdir %s failed: %w", dbDir, mkErr)
-			continue
-		}
+// Open opens a workspace's database in the data directory, creating it if needed
+func Open(workspace string) (*DB, error) {
+	if workspace == "" {
+		workspace = DefaultWorkspace
+	}
+	if err := ValidateWorkspaceName(workspace); err != nil {
+		return nil, err
+	}
 
-		dbPath := filepath.Join(dbDir, "gostly.db")
-		conn, openErr := sql.Open("sqlite3", dbPath)
-		if openErr != nil {
-			lastErr = fmt.Errorf("open sqlite at %s failed: %w", dbPath, openErr)
-			continue
-		}
+	dir, err := ResolveDir()
+	if err != nil {
+		return nil, err
+	}
 
-		// Verify connection is usable
-		if pingErr := conn.Ping(); pingErr != nil {
-			conn.Close()
-			lastErr = fmt.Errorf("ping sqlite at %s failed: %w", dbPath, pingErr)
-			continue
-		}
+	dbPath := workspacePath(dir, workspace)
+	conn, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite at %s failed: %w", dbPath, err)
+	}
 
-		db := &DB{conn: conn}
-		if schemaErr := db.createSchema(); schemaErr != nil {
-			conn.Close()
-			lastErr = fmt.Errorf("create schema at %s failed: %w", dbPath, schemaErr)
-			continue
-		}
+	// Verify connection is usable
+	if err := conn.Ping(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("ping sqlite at %s failed: %w", dbPath, err)
+	}
 
-		// Log chosen path for visibility
-		fmt.Printf("DB initialized at: %s (location: %s)\n", dbPath, loc.desc)
-		return db, nil
+	// Credentials are encrypted at rest; the key lives next to the database
+	cipher, pending, err := loadCipher(dir)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("load secrets key for %s failed: %w", dbPath, err)
 	}
 
-	if lastErr == nil {
-		lastErr = fmt.Errorf("unknown error creating database")
+	db := &DB{conn: conn, dir: dir, path: dbPath, workspace: workspace, cipher: cipher}
+	if err := db.createSchema(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("create schema at %s failed: %w", dbPath, err)
 	}
-	return nil, lastErr
-}
 
-// createSchema creates the database schema if it doesn't exist
-func (db *DB) createSchema() error {
-	// Create the profiles table
-	_, err := db.conn.Exec(`
-		CREATE TABLE IF NOT EXISTS profiles (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			name TEXT NOT NULL,
-			type TEXT NOT NULL,
-			listen TEXT NOT NULL,
-			remote TEXT NOT NULL,
-			username TEXT,
-			password TEXT
-		)
-	`)
-	if err != nil {
-		return err
+	// Refuse a key that can't read what is stored rather than fail on
+	// every profile later, and don't save a new one over it
+	if err := db.checkSecretsKey(pending != nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if pending != nil {
+		if err := pending.save(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("save secrets key for %s failed: %w", dbPath, err)
+		}
+		fmt.Printf("DB: created secrets key material at %s\n", pending.path)
 	}
 
-	// Create the activity_logs table
-	_, err = db.conn.Exec(`
-		CREATE TABLE IF NOT EXISTS activity_logs (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			profile_id INTEGER,
-			profile_name TEXT NOT NULL,
-			action TEXT NOT NULL,
-			details TEXT,
-			timestamp TEXT NOT NULL,
-			status TEXT NOT NULL DEFAULT 'success',
-			FOREIGN KEY (profile_id) REFERENCES profiles (id) ON DELETE SET NULL
-		)
-	`)
-	if err != nil {
-		return err
+	if err := db.encryptPlaintextSecrets(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("encrypt stored secrets at %s failed: %w", dbPath, err)
+	}
+	if err := db.saveSecretsCheck(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("store secrets key check at %s failed: %w", dbPath, err)
 	}
 
-	// Create the host_mappings table
-	_, err = db.conn.Exec(`
-		CREATE TABLE IF NOT EXISTS host_mappings (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			hostname TEXT NOT NULL UNIQUE,
-			ip TEXT NOT NULL,
-			port INTEGER NOT NULL,
-			protocol TEXT NOT NULL,
-			active INTEGER NOT NULL DEFAULT 1
-		)
-	`)
-	if err != nil {
+	// Log chosen path for visibility
+	fmt.Printf("DB initialized at: %s (workspace: %s)\n", dbPath, workspace)
+	return db, nil
+}
+
+// Path returns the database file of this workspace
+func (db *DB) Path() string {
+	return db.path
+}
+
+// Dir returns the data directory the workspace lives in
+func (db *DB) Dir() string {
+	return db.dir
+}
+
+// Workspace returns the name of the open workspace
+func (db *DB) Workspace() string {
+	return db.workspace
+}
+
+// createSchema brings the database schema up to date
+func (db *DB) createSchema() error {
+	if err := db.migrate(); err != nil {
 		return err
 	}
 
@@ -287,11 +309,55 @@ func (db *DB) Close() error {
 	return db.conn.Close()
 }
 
+// profileColumns is the column list read by scanProfile
+const profileColumns = "id, name, type, listen, remote, username, password, autostart, chain_id, " +
+	"selector_strategy, selector_max_fails, selector_fail_timeout, listener, " +
+	"tls_cert_file, tls_key_file, tls_ca_file, tls_server_name, tls_client_auth, tls_min_version, raw_config, process_group, log_level"
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanProfile reads a profile selected with profileColumns
+func (db *DB) scanProfile(row rowScanner) (Profile, error) {
+	var p Profile
+	var autostart int
+	var chainID sql.NullInt64
+	var clientAuth int
+	err := row.Scan(&p.ID, &p.Name, &p.Type, &p.Listen, &p.Remote, &p.Username, &p.Password, &autostart, &chainID,
+		&p.Selector.Strategy, &p.Selector.MaxFails, &p.Selector.FailTimeout, &p.Listener,
+		&p.TLS.CertFile, &p.TLS.KeyFile, &p.TLS.CAFile, &p.TLS.ServerName, &clientAuth, &p.TLS.MinVersion, &p.RawConfig, &p.Group, &p.LogLevel)
+	if err != nil {
+		return p, err
+	}
+	if p.Password, err = db.decryptSecret(p.Password); err != nil {
+		return p, fmt.Errorf("profile %d: %w", p.ID, err)
+	}
+	if p.RawConfig, err = db.decryptSecret(p.RawConfig); err != nil {
+		return p, fmt.Errorf("profile %d: %w", p.ID, err)
+	}
+	p.Autostart = autostart == 1
+	p.TLS.ClientAuth = clientAuth == 1
+	p.ChainID = chainID.Int64
+	// Default status is stopped
+	p.Status = "stopped"
+	return p, nil
+}
+
+// nullableID stores 0 as NULL for optional foreign keys
+func nullableID(id int64) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
 // GetProfiles returns all profiles
 func (db *DB) GetProfiles() ([]Profile, error) {
 	fmt.Printf("DB: GetProfiles called\n")
 
-	rows, err := db.conn.Query("SELECT id, name, type, listen, remote, username, password FROM profiles")
+	rows, err := db.conn.Query("SELECT " + profileColumns + " FROM profiles")
 	if err != nil {
 		fmt.Printf("DB: GetProfiles query error: %v\n", err)
 		return nil, err
@@ -302,14 +368,11 @@ func (db *DB) GetProfiles() ([]Profile, error) {
 
 	var profiles []Profile
 	for rows.Next() {
-		var p Profile
-		err := rows.Scan(&p.ID, &p.Name, &p.Type, &p.Listen, &p.Remote, &p.Username, &p.Password)
+		p, err := db.scanProfile(rows)
 		if err != nil {
 			fmt.Printf("DB: GetProfiles scan error: %v\n", err)
 			return nil, err
 		}
-		// Default status is stopped
-		p.Status = "stopped"
 		profiles = append(profiles, p)
 		fmt.Printf("DB: GetProfiles scanned profile: %s (ID: %d)\n", p.Name, p.ID)
 	}
@@ -318,6 +381,12 @@ func (db *DB) GetProfiles() ([]Profile, error) {
 		fmt.Printf("DB: GetProfiles rows error: %v\n", err)
 		return nil, err
 	}
+	rows.Close()
+
+	if err := db.attachProfileNodes(profiles); err != nil {
+		fmt.Printf("DB: GetProfiles nodes error: %v\n", err)
+		return nil, err
+	}
 
 	fmt.Printf("DB: GetProfiles returning %d profiles\n", len(profiles))
 	return profiles, nil
@@ -325,27 +394,41 @@ func (db *DB) GetProfiles() ([]Profile, error) {
 
 // GetProfile returns a profile by ID
 func (db *DB) GetProfile(id int64) (*Profile, error) {
-	var p Profile
-	err := db.conn.QueryRow(
-		"SELECT id, name, type, listen, remote, username, password FROM profiles WHERE id = ?",
-		id,
-	).Scan(&p.ID, &p.Name, &p.Type, &p.Listen, &p.Remote, &p.Username, &p.Password)
+	p, err := db.scanProfile(db.conn.QueryRow("SELECT "+profileColumns+" FROM profiles WHERE id = ?", id))
 	if err != nil {
 		return nil, err
 	}
 
-	// Default status is stopped
-	p.Status = "stopped"
-	return &p, nil
+	profiles := []Profile{p}
+	if err := db.attachProfileNodes(profiles); err != nil {
+		return nil, err
+	}
+	return &profiles[0], nil
 }
 
 // AddProfile adds a new profile
 func (db *DB) AddProfile(p *Profile) error {
-	fmt.Printf("DB: AddProfile called with profile: %+v\n", p)
+	password, err := db.encryptSecret(p.Password)
+	if err != nil {
+		return err
+	}
+	rawConfig, err := db.encryptSecret(p.RawConfig)
+	if err != nil {
+		return err
+	}
 
-	res, err := db.conn.Exec(
-		"INSERT INTO profiles (name, type, listen, remote, username, password) VALUES (?, ?, ?, ?, ?, ?)",
-		p.Name, p.Type, p.Listen, p.Remote, p.Username, p.Password,
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		"INSERT INTO profiles (name, type, listen, remote, username, password, autostart, chain_id, selector_strategy, selector_max_fails, selector_fail_timeout, listener, "+
+			"tls_cert_file, tls_key_file, tls_ca_file, tls_server_name, tls_client_auth, tls_min_version, raw_config, process_group, log_level) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		p.Name, p.Type, p.Listen, p.Remote, p.Username, password, boolToInt(p.Autostart), nullableID(p.ChainID),
+		p.Selector.Strategy, p.Selector.MaxFails, p.Selector.FailTimeout, p.Listener,
+		p.TLS.CertFile, p.TLS.KeyFile, p.TLS.CAFile, p.TLS.ServerName, boolToInt(p.TLS.ClientAuth), p.TLS.MinVersion, rawConfig, p.Group, p.LogLevel,
 	)
 	if err != nil {
 		fmt.Printf("DB: AddProfile exec error: %v\n", err)
@@ -358,6 +441,14 @@ func (db *DB) AddProfile(p *Profile) error {
 		return err
 	}
 
+	if err := replaceProfileNodes(tx, id, p.Nodes); err != nil {
+		fmt.Printf("DB: AddProfile nodes error: %v\n", err)
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
 	fmt.Printf("DB: AddProfile successful, inserted ID: %d\n", id)
 	p.ID = id
 	return nil
@@ -365,17 +456,75 @@ func (db *DB) AddProfile(p *Profile) error {
 
 // UpdateProfile updates an existing profile
 func (db *DB) UpdateProfile(p *Profile) error {
-	_, err := db.conn.Exec(
-		"UPDATE profiles SET name = ?, type = ?, listen = ?, remote = ?, username = ?, password = ? WHERE id = ?",
-		p.Name, p.Type, p.Listen, p.Remote, p.Username, p.Password, p.ID,
+	password, err := db.encryptSecret(p.Password)
+	if err != nil {
+		return err
+	}
+	rawConfig, err := db.encryptSecret(p.RawConfig)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"UPDATE profiles SET name = ?, type = ?, listen = ?, remote = ?, username = ?, password = ?, chain_id = ?, selector_strategy = ?, selector_max_fails = ?, selector_fail_timeout = ?, listener = ?, "+
+			"tls_cert_file = ?, tls_key_file = ?, tls_ca_file = ?, tls_server_name = ?, tls_client_auth = ?, tls_min_version = ?, raw_config = ?, process_group = ? WHERE id = ?",
+		p.Name, p.Type, p.Listen, p.Remote, p.Username, password, nullableID(p.ChainID),
+		p.Selector.Strategy, p.Selector.MaxFails, p.Selector.FailTimeout, p.Listener,
+		p.TLS.CertFile, p.TLS.KeyFile, p.TLS.CAFile, p.TLS.ServerName, boolToInt(p.TLS.ClientAuth), p.TLS.MinVersion, rawConfig, p.Group, p.ID,
 	)
+	if err != nil {
+		return err
+	}
+
+	if err := replaceProfileNodes(tx, p.ID, p.Nodes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetProfileAutostart persists whether a profile should be running
+func (db *DB) SetProfileAutostart(id int64, autostart bool) error {
+	_, err := db.conn.Exec("UPDATE profiles SET autostart = ? WHERE id = ?", boolToInt(autostart), id)
 	return err
 }
 
-// DeleteProfile deletes a profile
+// GetAutostartProfiles returns the profiles whose desired state is running
+func (db *DB) GetAutostartProfiles() ([]Profile, error) {
+	profiles, err := db.GetProfiles()
+	if err != nil {
+		return nil, err
+	}
+
+	var autostart []Profile
+	for _, p := range profiles {
+		if p.Autostart {
+			autostart = append(autostart, p)
+		}
+	}
+	return autostart, nil
+}
+
+// DeleteProfile deletes a profile and its upstream nodes
 func (db *DB) DeleteProfile(id int64) error {
-	_, err := db.conn.Exec("DELETE FROM profiles WHERE id = ?", id)
-	return err
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM profile_nodes WHERE profile_id = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM profiles WHERE id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 // AddActivityLog adds a new activity log entry
@@ -0,0 +1,454 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openTestDB opens a database under a temporary config dir
+func openTestDB(t *testing.T) *DB {
+	t.Helper()
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv(DirEnv, "")
+	t.Setenv(PathEnv, "")
+	t.Setenv(WorkspaceEnv, "")
+	t.Setenv(PassphraseEnv, "")
+	t.Setenv(KeyfileEnv, "")
+	db, err := New()
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestCipherRoundTrip(t *testing.T) {
+	c, err := NewCipher(make([]byte, keySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enc, err := c.Encrypt("s3cret")
+	if err != nil || !strings.HasPrefix(enc, secretPrefix) || strings.Contains(enc, "s3cret") {
+		t.Fatalf("unexpected ciphertext %q: %v", enc, err)
+	}
+	if plain, err := c.Decrypt(enc); err != nil || plain != "s3cret" {
+		t.Errorf("round trip gave %q: %v", plain, err)
+	}
+	if plain, err := c.Decrypt("legacy"); err != nil || plain != "legacy" {
+		t.Errorf("plaintext should pass through, got %q: %v", plain, err)
+	}
+
+	other, _ := NewCipher([]byte(strings.Repeat("k", keySize)))
+	if _, err := other.Decrypt(enc); err == nil {
+		t.Error("decrypting with another key should fail")
+	}
+}
+
+func TestSecretsEncryptedAtRest(t *testing.T) {
+	db := openTestDB(t)
+
+	p := &Profile{Name: "secure", Type: "http", Listen: ":18080", Username: "u", Password: "hunter2"}
+	if err := db.AddProfile(p); err != nil {
+		t.Fatalf("AddProfile: %v", err)
+	}
+
+	var stored string
+	if err := db.conn.QueryRow("SELECT password FROM profiles WHERE id = ?", p.ID).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if !isEncrypted(stored) {
+		t.Fatalf("password stored in plaintext: %q", stored)
+	}
+
+	// The seeded default profiles are encrypted on open as well
+	var plaintext int
+	if err := db.conn.QueryRow("SELECT COUNT(*) FROM profiles WHERE password != '' AND password NOT LIKE 'enc:v1:%'").Scan(&plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if plaintext != 0 {
+		t.Errorf("%d passwords left in plaintext", plaintext)
+	}
+
+	if err := db.RotateKey(""); err != nil {
+		t.Fatalf("RotateKey: %v", err)
+	}
+	var rotated string
+	db.conn.QueryRow("SELECT password FROM profiles WHERE id = ?", p.ID).Scan(&rotated)
+	if rotated == stored {
+		t.Error("rotation should re-encrypt the password")
+	}
+
+	got, err := db.GetProfile(p.ID)
+	if err != nil || got.Password != "hunter2" {
+		t.Errorf("GetProfile after rotation gave %q: %v", got.Password, err)
+	}
+}
+
+func TestRawConfigEncryptedAtRest(t *testing.T) {
+	db := openTestDB(t)
+
+	config := `{"services":[{"name":"s","addr":":1080","handler":{"type":"http","auth":{"username":"u","password":"hunter2"}}}]}`
+	p := &Profile{Name: "raw", Type: "raw", Listen: ":1080", RawConfig: config}
+	if err := db.AddProfile(p); err != nil {
+		t.Fatalf("AddProfile: %v", err)
+	}
+	var stored string
+	if err := db.conn.QueryRow("SELECT raw_config FROM profiles WHERE id = ?", p.ID).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if !isEncrypted(stored) {
+		t.Fatalf("raw config stored in plaintext: %q", stored)
+	}
+	if got, err := db.GetProfile(p.ID); err != nil || got.RawConfig != config {
+		t.Errorf("GetProfile gave %q: %v", got.RawConfig, err)
+	}
+}
+
+func TestWrongSecretsKey(t *testing.T) {
+	db := openTestDB(t)
+	dir := db.Dir()
+	if err := db.AddProfile(&Profile{Name: "secure", Type: "http", Listen: ":18080", Username: "u", Password: "hunter2"}); err != nil {
+		t.Fatalf("AddProfile: %v", err)
+	}
+	db.Close()
+
+	// A passphrase on a keyfile install is refused without writing a salt
+	t.Setenv(PassphraseEnv, "not-the-key")
+	if _, err := New(); err == nil || !strings.Contains(err.Error(), "another key") {
+		t.Errorf("New with a passphrase = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, saltName)); !os.IsNotExist(err) {
+		t.Errorf("salt was written: %v", err)
+	}
+	t.Setenv(PassphraseEnv, "")
+
+	// So is a different keyfile
+	other := filepath.Join(t.TempDir(), "other.key")
+	os.WriteFile(other, []byte(strings.Repeat("ab", keySize)+"\n"), 0600)
+	t.Setenv(KeyfileEnv, other)
+	if _, err := New(); err == nil {
+		t.Error("New with another keyfile should fail")
+	}
+	t.Setenv(KeyfileEnv, "")
+
+	reopened, err := New()
+	if err != nil {
+		t.Fatalf("New with the right key: %v", err)
+	}
+	defer reopened.Close()
+	if profiles, err := reopened.GetProfiles(); err != nil || len(profiles) == 0 {
+		t.Errorf("GetProfiles = %d, %v", len(profiles), err)
+	}
+}
+
+// baselineSchema is the schema of the first release, before schema_version existed
+const baselineSchema = `
+	CREATE TABLE profiles (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		type TEXT NOT NULL,
+		listen TEXT NOT NULL,
+		remote TEXT NOT NULL,
+		username TEXT,
+		password TEXT
+	);
+	CREATE TABLE activity_logs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		profile_id INTEGER,
+		profile_name TEXT NOT NULL,
+		action TEXT NOT NULL,
+		details TEXT,
+		timestamp TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'success',
+		FOREIGN KEY (profile_id) REFERENCES profiles (id) ON DELETE SET NULL
+	);
+	CREATE TABLE host_mappings (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		hostname TEXT NOT NULL UNIQUE,
+		ip TEXT NOT NULL,
+		port INTEGER NOT NULL,
+		protocol TEXT NOT NULL,
+		active INTEGER NOT NULL DEFAULT 1
+	);
+	INSERT INTO profiles (name, type, listen, remote, username, password)
+		VALUES ('legacy', 'http', ':3128', 'example.com:80', 'alice', 'plain-pass');
+	INSERT INTO host_mappings (hostname, ip, port, protocol) VALUES ('app.local', '127.0.0.1', 3000, 'HTTP');
+`
+
+func TestMigrateFromBaseline(t *testing.T) {
+	configDir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", configDir)
+	t.Setenv(DirEnv, "")
+	t.Setenv(WorkspaceEnv, "")
+	t.Setenv(PassphraseEnv, "")
+	t.Setenv(KeyfileEnv, "")
+
+	dbDir := filepath.Join(configDir, "gostly")
+	if err := os.MkdirAll(dbDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	fixture, err := sql.Open("sqlite3", filepath.Join(dbDir, "gostly.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fixture.Exec(baselineSchema); err != nil {
+		t.Fatalf("create fixture: %v", err)
+	}
+	fixture.Close()
+
+	db, err := New()
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	if version, err := db.SchemaVersion(); err != nil || version != latestSchemaVersion() {
+		t.Errorf("schema version = %d (%v), want %d", version, err, latestSchemaVersion())
+	}
+	if _, err := os.Stat(filepath.Join(dbDir, "gostly.db.v0.bak")); err != nil {
+		t.Errorf("expected pre-migration backup: %v", err)
+	}
+
+	profiles, err := db.GetProfiles()
+	if err != nil {
+		t.Fatalf("GetProfiles: %v", err)
+	}
+	if len(profiles) != 1 || profiles[0].Name != "legacy" || profiles[0].Password != "plain-pass" || profiles[0].Autostart {
+		t.Errorf("legacy profile not preserved: %+v", profiles)
+	}
+	if mappings, err := db.GetHostMappings(); err != nil || len(mappings) != 1 {
+		t.Errorf("host mappings not preserved: %+v (%v)", mappings, err)
+	}
+
+	// Reopening an up-to-date database applies nothing and takes no backup
+	db.Close()
+	os.Remove(filepath.Join(dbDir, "gostly.db.v0.bak"))
+	db, err = New()
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer db.Close()
+	matches, _ := filepath.Glob(filepath.Join(dbDir, "*.bak"))
+	if len(matches) != 0 {
+		t.Errorf("unexpected backups on reopen: %v", matches)
+	}
+}
+
+func TestWorkspaces(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	t.Setenv(DirEnv, dir)
+	t.Setenv(PathEnv, "")
+	t.Setenv(WorkspaceEnv, "")
+	t.Setenv(PassphraseEnv, "")
+	t.Setenv(KeyfileEnv, "")
+
+	prod, err := New()
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer prod.Close()
+	if prod.Path() != filepath.Join(dir, "gostly.db") || prod.Workspace() != DefaultWorkspace {
+		t.Errorf("default workspace opened at %s (%s)", prod.Path(), prod.Workspace())
+	}
+
+	staging, err := Open("staging")
+	if err != nil {
+		t.Fatalf("Open staging: %v", err)
+	}
+	defer staging.Close()
+	if staging.Path() != filepath.Join(dir, "gostly-staging.db") {
+		t.Errorf("staging workspace opened at %s", staging.Path())
+	}
+
+	p := &Profile{Name: "staging-only", Type: "http", Listen: ":18081", Password: "stage"}
+	if err := staging.AddProfile(p); err != nil {
+		t.Fatalf("AddProfile: %v", err)
+	}
+	prodProfiles, _ := prod.GetProfiles()
+	for _, pp := range prodProfiles {
+		if pp.Name == "staging-only" {
+			t.Error("staging profile leaked into the default workspace")
+		}
+	}
+
+	workspaces, err := ListWorkspaces(dir)
+	if err != nil || strings.Join(workspaces, ",") != "default,staging" {
+		t.Errorf("ListWorkspaces = %v (%v)", workspaces, err)
+	}
+
+	if _, err := Open("../escape"); err == nil {
+		t.Error("workspace names with path separators should be rejected")
+	}
+
+	// Both workspaces share the key, so rotating it re-encrypts both
+	if err := prod.RotateKey(""); err != nil {
+		t.Fatalf("RotateKey: %v", err)
+	}
+	staging.Close()
+	staging, err = Open("staging")
+	if err != nil {
+		t.Fatalf("reopen staging: %v", err)
+	}
+	got, err := staging.GetProfile(p.ID)
+	if err != nil {
+		t.Fatalf("GetProfile after rotation: %v", err)
+	}
+	if got.Password != "stage" {
+		t.Errorf("staging secret after rotation = %q", got.Password)
+	}
+}
+
+func TestDBPath(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "srv")
+	path := filepath.Join(dir, "proxies.sqlite")
+	t.Setenv(DirEnv, t.TempDir())
+	t.Setenv(PathEnv, path)
+	t.Setenv(WorkspaceEnv, "")
+	t.Setenv(PassphraseEnv, "")
+	t.Setenv(KeyfileEnv, "")
+
+	db, err := New()
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer db.Close()
+	if db.Path() != path || db.Dir() != dir {
+		t.Errorf("opened %s in %s, want %s", db.Path(), db.Dir(), path)
+	}
+
+	// Other workspaces live next to the chosen file
+	staging, err := Open("staging")
+	if err != nil {
+		t.Fatalf("Open staging: %v", err)
+	}
+	defer staging.Close()
+	if staging.Path() != filepath.Join(dir, "gostly-staging.db") {
+		t.Errorf("staging workspace opened at %s", staging.Path())
+	}
+	if workspaces, _ := ListWorkspaces(dir); strings.Join(workspaces, ",") != "default,staging" {
+		t.Errorf("ListWorkspaces = %v", workspaces)
+	}
+}
+
+func TestLogs(t *testing.T) {
+	db := openTestDB(t)
+
+	web := int64(3)
+	base := time.Now().Add(-2 * time.Hour)
+	var records []LogRecord
+	for i := 0; i < 10; i++ {
+		r := LogRecord{ID: int64(i + 1), Time: base.Add(time.Duration(i) * 10 * time.Minute), Level: "INFO", Source: "gost", Message: fmt.Sprintf("request %d served", i)}
+		if i%2 == 0 {
+			r.ProfileID = &web
+			r.ProfileName = "web"
+		}
+		if i == 7 {
+			r.Level = "ERROR"
+			r.Message = "Dial 100%_failed"
+		}
+		records = append(records, r)
+	}
+	if err := db.AddLogs(records); err != nil {
+		t.Fatalf("AddLogs: %v", err)
+	}
+
+	ids := func(filter LogFilter) []int64 {
+		t.Helper()
+		got, err := db.QueryLogs(filter)
+		if err != nil {
+			t.Fatalf("QueryLogs(%+v): %v", filter, err)
+		}
+		var ids []int64
+		for _, r := range got {
+			ids = append(ids, r.ID)
+		}
+		return ids
+	}
+	for name, tc := range map[string]struct {
+		filter LogFilter
+		want   string
+	}{
+		"newest first":   {LogFilter{Limit: 3}, "[10 9 8]"},
+		"page":           {LogFilter{Limit: 3, BeforeID: 8}, "[7 6 5]"},
+		"tail":           {LogFilter{Limit: 3, AfterID: 4, Ascending: true}, "[5 6 7]"},
+		"from start":     {LogFilter{Limit: 2, Ascending: true}, "[1 2]"},
+		"time range":     {LogFilter{Since: base.Add(20 * time.Minute), Until: base.Add(50 * time.Minute)}, "[5 4 3]"},
+		"level":          {LogFilter{Levels: []string{"error", "WARN"}}, "[8]"},
+		"profile":        {LogFilter{ProfileID: &web, Limit: 2}, "[9 7]"},
+		"search":         {LogFilter{Search: "REQUEST 1"}, "[2]"},
+		"literal search": {LogFilter{Search: "100%_f"}, "[8]"},
+		"source":         {LogFilter{Source: "api"}, "[]"},
+	} {
+		if got := fmt.Sprint(ids(tc.filter)); got != tc.want {
+			t.Errorf("%s: got %s, want %s", name, got, tc.want)
+		}
+	}
+
+	if last, err := db.LastLogID(); err != nil || last != 10 {
+		t.Errorf("LastLogID = %d, %v", last, err)
+	}
+
+	got, _ := db.QueryLogs(LogFilter{ProfileID: &web, Limit: 1})
+	if r := got[0]; r.ProfileName != "web" || *r.ProfileID != web || !r.Time.Equal(records[8].Time) {
+		t.Errorf("record = %+v", r)
+	}
+
+	// Retention keeps the newest entries within the age limit
+	if removed, err := db.PruneLogs(95*time.Minute, 4); err != nil || removed != 6 {
+		t.Errorf("PruneLogs removed %d: %v", removed, err)
+	}
+	if got := fmt.Sprint(ids(LogFilter{})); got != "[10 9 8 7]" {
+		t.Errorf("after prune got %s", got)
+	}
+	if err := db.ClearLogs(); err != nil || len(ids(LogFilter{})) != 0 {
+		t.Errorf("ClearLogs left records: %v", err)
+	}
+	if last, err := db.LastLogID(); err != nil || last != 10 {
+		t.Errorf("LastLogID after ClearLogs = %d, %v", last, err)
+	}
+}
+
+func TestSettings(t *testing.T) {
+	db := openTestDB(t)
+
+	if value, err := db.GetSetting("gost_log_level"); err != nil || value != "" {
+		t.Errorf("unset setting = %q, %v", value, err)
+	}
+	for _, value := range []string{"debug", "warn"} {
+		if err := db.SetSetting("gost_log_level", value); err != nil {
+			t.Fatalf("SetSetting: %v", err)
+		}
+		if got, _ := db.GetSetting("gost_log_level"); got != value {
+			t.Errorf("setting = %q, want %q", got, value)
+		}
+	}
+	if err := db.SetSetting("gost_log_level", ""); err != nil {
+		t.Fatalf("SetSetting: %v", err)
+	}
+	if got, _ := db.GetSetting("gost_log_level"); got != "" {
+		t.Errorf("cleared setting = %q", got)
+	}
+
+	p := &Profile{Name: "web", Type: "http", Listen: ":8080", LogLevel: "debug"}
+	if err := db.AddProfile(p); err != nil {
+		t.Fatalf("AddProfile: %v", err)
+	}
+	if err := db.SetProfileLogLevel(p.ID, "error"); err != nil {
+		t.Fatalf("SetProfileLogLevel: %v", err)
+	}
+	// Saving the rest of the profile keeps its log level
+	if err := db.UpdateProfile(p); err != nil {
+		t.Fatalf("UpdateProfile: %v", err)
+	}
+	if got, _ := db.GetProfile(p.ID); got.LogLevel != "error" {
+		t.Errorf("log level = %q", got.LogLevel)
+	}
+	if err := db.SetProfileLogLevel(p.ID+1000, "debug"); err != sql.ErrNoRows {
+		t.Errorf("SetProfileLogLevel of a missing profile: %v", err)
+	}
+}
@@ -0,0 +1,282 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// LogRecord is a persisted application or GOST log line
+type LogRecord struct {
+	ID          int64
+	Time        time.Time
+	Level       string
+	Source      string
+	Message     string
+	ProfileID   *int64
+	ProfileName string
+
+	// Structured fields of GOST log lines
+	Src        string
+	Dst        string
+	DurationMs float64
+	Fields     map[string]string
+}
+
+// LogFilter selects persisted log records. Zero fields don't filter.
+type LogFilter struct {
+	Since     time.Time
+	Until     time.Time
+	Levels    []string
+	Source    string
+	ProfileID *int64
+	Search    string // case-insensitive substring of the message
+	Src       string // client address, or just its host
+	Dst       string // destination address, or just its host
+	BeforeID  int64  // only records older than this ID, for paging
+	AfterID   int64  // only records newer than this ID, for tailing
+	Ascending bool   // oldest first instead of newest first
+	Limit     int
+}
+
+// createLogSchema creates the logs table
+func createLogSchema(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS logs (
+			id INTEGER PRIMARY KEY,
+			time INTEGER NOT NULL,
+			level TEXT NOT NULL,
+			source TEXT NOT NULL,
+			message TEXT NOT NULL,
+			profile_id INTEGER,
+			profile_name TEXT NOT NULL DEFAULT ''
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("CREATE INDEX IF NOT EXISTS logs_time ON logs (time)")
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("CREATE INDEX IF NOT EXISTS logs_profile ON logs (profile_id, id)")
+	return err
+}
+
+// migrateLogFields adds the structured fields parsed from GOST log lines
+func migrateLogFields(tx *sql.Tx) error {
+	for _, column := range []struct{ name, definition string }{
+		{"src", "TEXT NOT NULL DEFAULT ''"},
+		{"dst", "TEXT NOT NULL DEFAULT ''"},
+		{"duration_ms", "REAL NOT NULL DEFAULT 0"},
+		{"fields", "TEXT NOT NULL DEFAULT ''"},
+	} {
+		if err := addColumnIfMissing(tx, "logs", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec("CREATE INDEX IF NOT EXISTS logs_dst ON logs (dst)")
+	return err
+}
+
+// escapeLike escapes the LIKE wildcards in s, for use with ESCAPE '\'
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// addressFilter matches an address column against a full address or just its host
+func addressFilter(column, value string) (string, []interface{}) {
+	escaped := escapeLike(value)
+	return "(" + column + " = ? OR " + column + ` LIKE ? ESCAPE '\' OR ` + column + ` LIKE ? ESCAPE '\')`,
+		[]interface{}{value, escaped + ":%", "[" + escaped + "]:%"}
+}
+
+// AddLogs stores log records in one transaction. Records keep the IDs they
+// were given, so callers can reference them before they are written.
+func (db *DB) AddLogs(records []LogRecord) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("INSERT OR IGNORE INTO logs (id, time, level, source, message, profile_id, profile_name, src, dst, duration_ms, fields) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, r := range records {
+		var profileID interface{}
+		if r.ProfileID != nil {
+			profileID = *r.ProfileID
+		}
+		fields := ""
+		if len(r.Fields) > 0 {
+			data, err := json.Marshal(r.Fields)
+			if err != nil {
+				return err
+			}
+			fields = string(data)
+		}
+		if _, err := stmt.Exec(r.ID, r.Time.UnixNano(), r.Level, r.Source, r.Message, profileID, r.ProfileName, r.Src, r.Dst, r.DurationMs, fields); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// lastLogIDSetting remembers the highest record ID once records are deleted
+const lastLogIDSetting = "last_log_id"
+
+// LastLogID returns the highest record ID ever persisted, or 0 when there
+// were none, so IDs keep increasing after pruning or clearing
+func (db *DB) LastLogID() (int64, error) {
+	var id int64
+	err := db.conn.QueryRow(`
+		SELECT MAX(
+			COALESCE((SELECT MAX(id) FROM logs), 0),
+			COALESCE((SELECT CAST(value AS INTEGER) FROM settings WHERE key = ?), 0)
+		)`, lastLogIDSetting).Scan(&id)
+	return id, err
+}
+
+// saveLastLogID stores the highest record ID before records are deleted
+func (db *DB) saveLastLogID() error {
+	_, err := db.conn.Exec(`
+		INSERT INTO settings (key, value)
+		SELECT ?, id FROM logs WHERE true ORDER BY id DESC LIMIT 1
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value
+		WHERE CAST(excluded.value AS INTEGER) > CAST(settings.value AS INTEGER)`, lastLogIDSetting)
+	return err
+}
+
+// QueryLogs returns the records matching filter, newest first unless
+// filter.Ascending is set
+func (db *DB) QueryLogs(filter LogFilter) ([]LogRecord, error) {
+	var where []string
+	var args []interface{}
+	if !filter.Since.IsZero() {
+		where = append(where, "time >= ?")
+		args = append(args, filter.Since.UnixNano())
+	}
+	if !filter.Until.IsZero() {
+		where = append(where, "time < ?")
+		args = append(args, filter.Until.UnixNano())
+	}
+	if len(filter.Levels) > 0 {
+		where = append(where, "level IN (?"+strings.Repeat(", ?", len(filter.Levels)-1)+")")
+		for _, level := range filter.Levels {
+			args = append(args, strings.ToUpper(level))
+		}
+	}
+	if filter.Source != "" {
+		where = append(where, "source = ?")
+		args = append(args, filter.Source)
+	}
+	if filter.ProfileID != nil {
+		where = append(where, "profile_id = ?")
+		args = append(args, *filter.ProfileID)
+	}
+	if filter.Search != "" {
+		where = append(where, `message LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+escapeLike(filter.Search)+"%")
+	}
+	if filter.Src != "" {
+		clause, clauseArgs := addressFilter("src", filter.Src)
+		where = append(where, clause)
+		args = append(args, clauseArgs...)
+	}
+	if filter.Dst != "" {
+		clause, clauseArgs := addressFilter("dst", filter.Dst)
+		where = append(where, clause)
+		args = append(args, clauseArgs...)
+	}
+	if filter.BeforeID > 0 {
+		where = append(where, "id < ?")
+		args = append(args, filter.BeforeID)
+	}
+	if filter.AfterID > 0 {
+		where = append(where, "id > ?")
+		args = append(args, filter.AfterID)
+	}
+
+	query := "SELECT id, time, level, source, message, profile_id, profile_name, src, dst, duration_ms, fields FROM logs"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	if filter.Ascending {
+		query += " ORDER BY id"
+	} else {
+		query += " ORDER BY id DESC"
+	}
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []LogRecord{}
+	for rows.Next() {
+		var r LogRecord
+		var nanos int64
+		var profileID sql.NullInt64
+		var fields string
+		if err := rows.Scan(&r.ID, &nanos, &r.Level, &r.Source, &r.Message, &profileID, &r.ProfileName, &r.Src, &r.Dst, &r.DurationMs, &fields); err != nil {
+			return nil, err
+		}
+		if fields != "" {
+			if err := json.Unmarshal([]byte(fields), &r.Fields); err != nil {
+				return nil, err
+			}
+		}
+		r.Time = time.Unix(0, nanos)
+		if profileID.Valid {
+			id := profileID.Int64
+			r.ProfileID = &id
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// PruneLogs deletes records older than maxAge and all but the newest
+// maxEntries records. Zero limits are not applied.
+func (db *DB) PruneLogs(maxAge time.Duration, maxEntries int) (int64, error) {
+	var removed int64
+	if err := db.saveLastLogID(); err != nil {
+		return removed, err
+	}
+	if maxAge > 0 {
+		res, err := db.conn.Exec("DELETE FROM logs WHERE time < ?", time.Now().Add(-maxAge).UnixNano())
+		if err != nil {
+			return removed, err
+		}
+		n, _ := res.RowsAffected()
+		removed += n
+	}
+	if maxEntries > 0 {
+		res, err := db.conn.Exec("DELETE FROM logs WHERE id <= (SELECT id FROM logs ORDER BY id DESC LIMIT 1 OFFSET ?)", maxEntries)
+		if err != nil {
+			return removed, err
+		}
+		n, _ := res.RowsAffected()
+		removed += n
+	}
+	return removed, nil
+}
+
+// ClearLogs deletes every persisted log record
+func (db *DB) ClearLogs() error {
+	if err := db.saveLastLogID(); err != nil {
+		return err
+	}
+	_, err := db.conn.Exec("DELETE FROM logs")
+	return err
+}
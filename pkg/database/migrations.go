@@ -0,0 +1,260 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+)
+
+// migration is a forward-only schema change. Migrations must be idempotent:
+// databases created before schema_version existed start at version 0 and
+// may already have some of the tables and columns a migration adds.
+type migration struct {
+	version     int
+	description string
+	up          func(tx *sql.Tx) error
+}
+
+// migrations lists every schema change in the order it is applied.
+// Append new migrations to the end; never edit or reorder released ones.
+var migrations = []migration{
+	{1, "create profiles, activity_logs and host_mappings", migrateBaseline},
+	{2, "add profile autostart", func(tx *sql.Tx) error {
+		return addColumnIfMissing(tx, "profiles", "autostart", "INTEGER NOT NULL DEFAULT 0")
+	}},
+	{3, "add proxy chains", func(tx *sql.Tx) error {
+		if err := createChainSchema(tx); err != nil {
+			return err
+		}
+		return addColumnIfMissing(tx, "profiles", "chain_id", "INTEGER REFERENCES chains (id) ON DELETE SET NULL")
+	}},
+	{4, "add load-balanced upstream nodes", migrateNodes},
+	{5, "add listener and TLS settings", migrateTLS},
+	{6, "add raw GOST configs", func(tx *sql.Tx) error {
+		return addColumnIfMissing(tx, "profiles", "raw_config", "TEXT NOT NULL DEFAULT ''")
+	}},
+	{7, "add shared process groups", func(tx *sql.Tx) error {
+		return addColumnIfMissing(tx, "profiles", "process_group", "TEXT NOT NULL DEFAULT ''")
+	}},
+	{8, "add persistent logs", createLogSchema},
+	{9, "add structured log fields", migrateLogFields},
+	{10, "add GOST log levels", migrateLogLevels},
+}
+
+// latestSchemaVersion is the version a fully migrated database is at
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// migrate applies pending migrations in a single transaction, after taking
+// a backup copy of an existing database
+func (db *DB) migrate() error {
+	_, err := db.conn.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			description TEXT NOT NULL,
+			applied_at TEXT NOT NULL
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	current, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	latest := latestSchemaVersion()
+	if current > latest {
+		return fmt.Errorf("database schema is at version %d but this build only supports up to %d", current, latest)
+	}
+	if current == latest {
+		return nil
+	}
+
+	existing, err := db.tableExists("profiles")
+	if err != nil {
+		return err
+	}
+	if existing {
+		backup, err := db.backup(current)
+		if err != nil {
+			return fmt.Errorf("backup before migration failed: %w", err)
+		}
+		fmt.Printf("DB: backed up schema v%d database to %s\n", current, backup)
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := m.up(tx); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.description, err)
+		}
+		_, err := tx.Exec(
+			"INSERT INTO schema_version (version, description, applied_at) VALUES (?, ?, ?)",
+			m.version, m.description, time.Now().Format(time.RFC3339),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	fmt.Printf("DB: migrated schema from v%d to v%d\n", current, latest)
+	return nil
+}
+
+// SchemaVersion returns the version of the last applied migration
+func (db *DB) SchemaVersion() (int, error) {
+	var version sql.NullInt64
+	if err := db.conn.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&version); err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// backup copies the database next to itself and returns the copy's path
+func (db *DB) backup(version int) (string, error) {
+	path := fmt.Sprintf("%s.v%d.bak", db.path, version)
+	// VACUUM INTO refuses to overwrite, and an older backup of the same
+	// version is superseded by this one
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if _, err := db.conn.Exec("VACUUM INTO ?", path); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// tableExists reports whether a table is present in the database
+func (db *DB) tableExists(table string) (bool, error) {
+	var count int
+	err := db.conn.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&count)
+	return count > 0, err
+}
+
+// migrateBaseline creates the tables of the first release
+func migrateBaseline(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS profiles (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			type TEXT NOT NULL,
+			listen TEXT NOT NULL,
+			remote TEXT NOT NULL,
+			username TEXT,
+			password TEXT
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS activity_logs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			profile_id INTEGER,
+			profile_name TEXT NOT NULL,
+			action TEXT NOT NULL,
+			details TEXT,
+			timestamp TEXT NOT NULL,
+			status TEXT NOT NULL DEFAULT 'success',
+			FOREIGN KEY (profile_id) REFERENCES profiles (id) ON DELETE SET NULL
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS host_mappings (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			hostname TEXT NOT NULL UNIQUE,
+			ip TEXT NOT NULL,
+			port INTEGER NOT NULL,
+			protocol TEXT NOT NULL,
+			active INTEGER NOT NULL DEFAULT 1
+		)
+	`)
+	return err
+}
+
+// migrateNodes adds upstream nodes and the selector that picks among them
+func migrateNodes(tx *sql.Tx) error {
+	if err := createNodeSchema(tx); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(tx, "profiles", "selector_strategy", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(tx, "profiles", "selector_max_fails", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	return addColumnIfMissing(tx, "profiles", "selector_fail_timeout", "INTEGER NOT NULL DEFAULT 0")
+}
+
+// migrateTLS adds listener types and TLS settings for profiles and hops
+func migrateTLS(tx *sql.Tx) error {
+	if err := addColumnIfMissing(tx, "profiles", "listener", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	for _, column := range []string{"tls_cert_file", "tls_key_file", "tls_ca_file", "tls_server_name", "tls_min_version"} {
+		if err := addColumnIfMissing(tx, "profiles", column, "TEXT NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+	}
+	if err := addColumnIfMissing(tx, "profiles", "tls_client_auth", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(tx, "chain_hops", "tls_cert_file", "TEXT"); err != nil {
+		return err
+	}
+	return addColumnIfMissing(tx, "chain_hops", "tls_key_file", "TEXT")
+}
+
+// addColumnIfMissing adds a column to an existing table if it is not there yet
+func addColumnIfMissing(tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
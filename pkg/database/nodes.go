@@ -0,0 +1,97 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// UpstreamNode is one of several backends a profile forwards to
+type UpstreamNode struct {
+	ID     int64  `json:"id"`
+	Name   string `json:"name"`
+	Addr   string `json:"addr"`
+	Weight int    `json:"weight"` // relative weight for weighted selection, 0 means default
+}
+
+// Selector configures how GOST picks among a profile's upstream nodes
+type Selector struct {
+	Strategy    string `json:"strategy"`     // "round", "rand", "fifo" or "hash"; empty uses GOST's default
+	MaxFails    int    `json:"max_fails"`    // failures before a node is marked dead
+	FailTimeout int    `json:"fail_timeout"` // seconds a dead node is skipped
+}
+
+// createNodeSchema creates the profile_nodes table
+func createNodeSchema(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS profile_nodes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			profile_id INTEGER NOT NULL,
+			position INTEGER NOT NULL,
+			name TEXT,
+			addr TEXT NOT NULL,
+			weight INTEGER NOT NULL DEFAULT 0,
+			FOREIGN KEY (profile_id) REFERENCES profiles (id) ON DELETE CASCADE
+		)
+	`)
+	return err
+}
+
+// attachProfileNodes loads the upstream nodes of the given profiles
+func (db *DB) attachProfileNodes(profiles []Profile) error {
+	if len(profiles) == 0 {
+		return nil
+	}
+
+	index := make(map[int64]int, len(profiles))
+	args := make([]interface{}, 0, len(profiles))
+	for i := range profiles {
+		index[profiles[i].ID] = i
+		args = append(args, profiles[i].ID)
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", ")
+	rows, err := db.conn.Query(
+		"SELECT id, profile_id, name, addr, weight FROM profile_nodes WHERE profile_id IN ("+placeholders+") ORDER BY profile_id, position ASC",
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var n UpstreamNode
+		var profileID int64
+		var name sql.NullString
+		if err := rows.Scan(&n.ID, &profileID, &name, &n.Addr, &n.Weight); err != nil {
+			return err
+		}
+		n.Name = name.String
+		if i, ok := index[profileID]; ok {
+			profiles[i].Nodes = append(profiles[i].Nodes, n)
+		}
+	}
+	return rows.Err()
+}
+
+// replaceProfileNodes rewrites the upstream nodes of a profile in order
+func replaceProfileNodes(tx *sql.Tx, profileID int64, nodes []UpstreamNode) error {
+	if _, err := tx.Exec("DELETE FROM profile_nodes WHERE profile_id = ?", profileID); err != nil {
+		return err
+	}
+
+	for i := range nodes {
+		n := &nodes[i]
+		res, err := tx.Exec(
+			"INSERT INTO profile_nodes (profile_id, position, name, addr, weight) VALUES (?, ?, ?, ?, ?)",
+			profileID, i, n.Name, n.Addr, n.Weight,
+		)
+		if err != nil {
+			return err
+		}
+		if id, err := res.LastInsertId(); err == nil {
+			n.ID = id
+		}
+	}
+	return nil
+}
@@ -0,0 +1,452 @@
+package database
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Environment variables that select the secrets key
+const (
+	PassphraseEnv = "GOSTLY_PASSPHRASE" // derive the key from a passphrase
+	KeyfileEnv    = "GOSTLY_KEYFILE"    // read the key from this file instead of gostly.key
+)
+
+// secretPrefix marks an encrypted value; values without it are legacy plaintext
+const secretPrefix = "enc:v1:"
+
+const (
+	keyfileName = "gostly.key"
+	saltName    = "gostly.salt"
+	keySize     = 32
+)
+
+// secretsCheckSetting holds secretsCheckValue encrypted with the workspace's
+// key, so a wrong key is caught when the database is opened
+const (
+	secretsCheckSetting = "secrets_check"
+	secretsCheckValue   = "gostly-secrets"
+)
+
+// Cipher encrypts secrets stored in the database with AES-256-GCM
+type Cipher struct {
+	aead  cipher.AEAD
+	keyID string
+}
+
+// NewCipher creates a cipher from a 32 byte key
+func NewCipher(key []byte) (*Cipher, error) {
+	if len(key) != keySize {
+		return nil, fmt.Errorf("secrets key must be %d bytes, got %d", keySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &Cipher{aead: aead, keyID: hex.EncodeToString(sum[:4])}, nil
+}
+
+// Encrypt returns the stored form of a secret. Empty secrets stay empty.
+func (c *Cipher) Encrypt(plain string) (string, error) {
+	if plain == "" {
+		return "", nil
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := c.aead.Seal(nonce, nonce, []byte(plain), []byte(c.keyID))
+	return secretPrefix + c.keyID + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt reverses Encrypt. Legacy plaintext values are returned unchanged.
+func (c *Cipher) Decrypt(stored string) (string, error) {
+	if !isEncrypted(stored) {
+		return stored, nil
+	}
+	keyID, payload, ok := strings.Cut(strings.TrimPrefix(stored, secretPrefix), ":")
+	if !ok {
+		return "", fmt.Errorf("malformed encrypted secret")
+	}
+	if keyID != c.keyID {
+		return "", fmt.Errorf("secret was encrypted with a different key (%s), check %s or %s", keyID, PassphraseEnv, KeyfileEnv)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil || len(sealed) < c.aead.NonceSize() {
+		return "", fmt.Errorf("malformed encrypted secret")
+	}
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	plain, err := c.aead.Open(nil, nonce, ciphertext, []byte(keyID))
+	if err != nil {
+		return "", fmt.Errorf("decrypt secret: %w", err)
+	}
+	return string(plain), nil
+}
+
+// isEncrypted reports whether a stored value was written by Encrypt
+func isEncrypted(stored string) bool {
+	return strings.HasPrefix(stored, secretPrefix)
+}
+
+// keyMaterial is a secrets key together with the file that persists it:
+// the keyfile itself, or the salt a passphrase is stretched with
+type keyMaterial struct {
+	key  []byte
+	path string
+	data []byte
+}
+
+// save writes the key material, readable only by the owner
+func (km *keyMaterial) save() error {
+	return os.WriteFile(km.path, km.data, 0600)
+}
+
+// loadCipher returns the cipher for the database in dir. A passphrase from
+// GOSTLY_PASSPHRASE takes precedence; otherwise the keyfile is read. When
+// there is no salt or keyfile yet a new key is generated and returned as
+// pending, to be saved once it is known not to replace the key of secrets
+// that are already stored.
+func loadCipher(dir string) (c *Cipher, pending *keyMaterial, err error) {
+	var key []byte
+	if passphrase := os.Getenv(PassphraseEnv); passphrase != "" {
+		salt, err := os.ReadFile(filepath.Join(dir, saltName))
+		if os.IsNotExist(err) {
+			if pending, err = passphraseKey(dir, passphrase); err != nil {
+				return nil, nil, err
+			}
+			key = pending.key
+		} else if err != nil {
+			return nil, nil, err
+		} else if key, err = DeriveKey(passphrase, salt); err != nil {
+			return nil, nil, err
+		}
+		c, err := NewCipher(key)
+		return c, pending, err
+	}
+
+	path := keyfilePath(dir)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		if pending, err = randomKey(dir); err != nil {
+			return nil, nil, err
+		}
+		c, err := NewCipher(pending.key)
+		return c, pending, err
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if key, err = hex.DecodeString(strings.TrimSpace(string(data))); err != nil {
+		return nil, nil, fmt.Errorf("keyfile %s is not hex encoded: %w", path, err)
+	}
+	c, err = NewCipher(key)
+	return c, nil, err
+}
+
+// checkSecretsKey verifies the cipher against the secrets already stored.
+// A newly generated key is checked against the other workspaces next to
+// this one too, since it would replace the key they were encrypted with.
+func (db *DB) checkSecretsKey(newKey bool) error {
+	if err := db.verifySecretsKey(); err != nil {
+		return err
+	}
+	if !newKey {
+		return nil
+	}
+
+	workspaces, err := ListWorkspaces(db.dir)
+	if err != nil {
+		return err
+	}
+	for _, workspace := range workspaces {
+		if workspace == db.workspace {
+			continue
+		}
+		conn, err := sql.Open("sqlite3", workspacePath(db.dir, workspace))
+		if err != nil {
+			return fmt.Errorf("open workspace %s: %w", workspace, err)
+		}
+		other := &DB{conn: conn, dir: db.dir, workspace: workspace, cipher: db.cipher}
+		err = other.verifySecretsKey()
+		conn.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifySecretsKey checks that the cipher decrypts the workspace's check
+// value, or its secrets when it was encrypted before the check value was
+// stored. Workspaces at any schema version can be checked.
+func (db *DB) verifySecretsKey() error {
+	wrongKey := fmt.Errorf("workspace %s has secrets encrypted with another key, set %s or %s to the one they were encrypted with", db.workspace, PassphraseEnv, KeyfileEnv)
+
+	if ok, err := columnExists(db.conn, "settings", "value"); err != nil {
+		return err
+	} else if ok {
+		check, err := db.GetSetting(secretsCheckSetting)
+		if err != nil {
+			return err
+		}
+		if check != "" {
+			if plain, err := db.cipher.Decrypt(check); err != nil || plain != secretsCheckValue {
+				return wrongKey
+			}
+			return nil
+		}
+	}
+
+	for _, sc := range secretColumns {
+		if ok, err := columnExists(db.conn, sc.table, sc.column); err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+		rows, err := db.conn.Query(fmt.Sprintf("SELECT %s FROM %s WHERE %s LIKE ?", sc.column, sc.table, sc.column), secretPrefix+"%")
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var stored string
+			if err := rows.Scan(&stored); err != nil {
+				rows.Close()
+				return err
+			}
+			if _, err := db.cipher.Decrypt(stored); err != nil {
+				rows.Close()
+				return wrongKey
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveSecretsCheck stores the check value for the current key unless the
+// workspace already has one
+func (db *DB) saveSecretsCheck() error {
+	check, err := db.cipher.Encrypt(secretsCheckValue)
+	if err != nil {
+		return err
+	}
+	_, err = db.conn.Exec("INSERT INTO settings (key, value) VALUES (?, ?) ON CONFLICT (key) DO NOTHING", secretsCheckSetting, check)
+	return err
+}
+
+// rowQuerier is implemented by *sql.DB and *sql.Tx
+type rowQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// columnExists reports whether table has column; a missing table has none
+func columnExists(q rowQuerier, table, column string) (bool, error) {
+	var n int
+	err := q.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&n)
+	return n > 0, err
+}
+
+// DeriveKey stretches a passphrase into a key for NewCipher
+func DeriveKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, keySize)
+}
+
+// keyfilePath returns GOSTLY_KEYFILE or gostly.key next to the database
+func keyfilePath(dir string) string {
+	if path := os.Getenv(KeyfileEnv); path != "" {
+		return path
+	}
+	return filepath.Join(dir, keyfileName)
+}
+
+// randomKey generates a new keyfile key
+func randomKey(dir string) (*keyMaterial, error) {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return &keyMaterial{key: key, path: keyfilePath(dir), data: []byte(hex.EncodeToString(key) + "\n")}, nil
+}
+
+// passphraseKey stretches a passphrase with a fresh salt
+func passphraseKey(dir, passphrase string) (*keyMaterial, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key, err := DeriveKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	return &keyMaterial{key: key, path: filepath.Join(dir, saltName), data: salt}, nil
+}
+
+// secretColumns lists the tables and columns holding encrypted secrets
+var secretColumns = []struct{ table, column string }{
+	{"profiles", "password"},
+	{"profiles", "raw_config"}, // raw GOST configs embed their credentials
+	{"chain_hops", "password"},
+}
+
+// encryptPlaintextSecrets encrypts secrets written before encryption was enabled
+func (db *DB) encryptPlaintextSecrets() error {
+	return db.reencryptSecrets(db.cipher, func(stored string) bool { return !isEncrypted(stored) })
+}
+
+// reencryptSecrets rewrites the selected secrets with next in one transaction
+func (db *DB) reencryptSecrets(next *Cipher, selected func(stored string) bool) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, sc := range secretColumns {
+		// Other workspaces may not be migrated to the latest schema yet
+		if ok, err := columnExists(tx, sc.table, sc.column); err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+		rows, err := tx.Query(fmt.Sprintf("SELECT id, %s FROM %s WHERE %s IS NOT NULL AND %s != ''", sc.column, sc.table, sc.column, sc.column))
+		if err != nil {
+			return err
+		}
+		stored := map[int64]string{}
+		for rows.Next() {
+			var id int64
+			var value string
+			if err := rows.Scan(&id, &value); err != nil {
+				rows.Close()
+				return err
+			}
+			if selected(value) {
+				stored[id] = value
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for id, value := range stored {
+			plain, err := db.cipher.Decrypt(value)
+			if err != nil {
+				return fmt.Errorf("%s %d: %w", sc.table, id, err)
+			}
+			enc, err := next.Encrypt(plain)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(fmt.Sprintf("UPDATE %s SET %s = ? WHERE id = ?", sc.table, sc.column), enc, id); err != nil {
+				return err
+			}
+		}
+	}
+
+	if ok, err := columnExists(tx, "settings", "value"); err != nil {
+		return err
+	} else if ok {
+		check, err := next.Encrypt(secretsCheckValue)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO settings (key, value) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET value = excluded.value", secretsCheckSetting, check); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// RotateKey re-encrypts every stored secret, in this and every other
+// workspace sharing the key, under a new key. With a passphrase the key is
+// derived from it (set GOSTLY_PASSPHRASE to it on the next start); otherwise
+// a new random keyfile replaces the current one.
+func (db *DB) RotateKey(newPassphrase string) error {
+	var km *keyMaterial
+	var err error
+	if newPassphrase != "" {
+		km, err = passphraseKey(db.dir, newPassphrase)
+	} else {
+		km, err = randomKey(db.dir)
+	}
+	if err != nil {
+		return err
+	}
+	next, err := NewCipher(km.key)
+	if err != nil {
+		return err
+	}
+
+	// Stage the new key file so a failed write leaves the database untouched
+	tmpPath := km.path + ".new"
+	if err := os.WriteFile(tmpPath, km.data, 0600); err != nil {
+		return err
+	}
+	if err := db.reencryptSecrets(next, func(string) bool { return true }); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := db.reencryptOtherWorkspaces(next); err != nil {
+		return fmt.Errorf("%w; the new key is in %s, restore the workspace backups or move it to %s once resolved", err, tmpPath, km.path)
+	}
+	if err := os.Rename(tmpPath, km.path); err != nil {
+		return fmt.Errorf("secrets were re-encrypted but the new key could not be saved to %s (it is in %s): %w", km.path, tmpPath, err)
+	}
+
+	db.cipher = next
+	return nil
+}
+
+// reencryptOtherWorkspaces re-encrypts the secrets of the workspaces next to db
+func (db *DB) reencryptOtherWorkspaces(next *Cipher) error {
+	workspaces, err := ListWorkspaces(db.dir)
+	if err != nil {
+		return err
+	}
+	for _, workspace := range workspaces {
+		if workspace == db.workspace {
+			continue
+		}
+		path := workspacePath(db.dir, workspace)
+		conn, err := sql.Open("sqlite3", path)
+		if err != nil {
+			return fmt.Errorf("open workspace %s: %w", workspace, err)
+		}
+		other := &DB{conn: conn, dir: db.dir, path: path, workspace: workspace, cipher: db.cipher}
+		err = other.reencryptSecrets(next, func(string) bool { return true })
+		conn.Close()
+		if err != nil {
+			return fmt.Errorf("workspace %s: %w", workspace, err)
+		}
+	}
+	return nil
+}
+
+// encryptSecret encrypts a secret for storage
+func (db *DB) encryptSecret(plain string) (string, error) {
+	return db.cipher.Encrypt(plain)
+}
+
+// decryptSecret decrypts a stored secret
+func (db *DB) decryptSecret(stored string) (string, error) {
+	return db.cipher.Decrypt(stored)
+}
@@ -0,0 +1,52 @@
+package database
+
+import (
+	"database/sql"
+)
+
+// migrateLogLevels adds workspace settings and per-profile GOST log levels
+func migrateLogLevels(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS settings (
+			key TEXT PRIMARY KEY,
+			value TEXT NOT NULL
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	return addColumnIfMissing(tx, "profiles", "log_level", "TEXT NOT NULL DEFAULT ''")
+}
+
+// GetSetting returns a workspace setting, or "" when it isn't set
+func (db *DB) GetSetting(key string) (string, error) {
+	var value string
+	err := db.conn.QueryRow("SELECT value FROM settings WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+// SetSetting stores a workspace setting; an empty value removes it
+func (db *DB) SetSetting(key, value string) error {
+	if value == "" {
+		_, err := db.conn.Exec("DELETE FROM settings WHERE key = ?", key)
+		return err
+	}
+	_, err := db.conn.Exec("INSERT INTO settings (key, value) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET value = excluded.value", key, value)
+	return err
+}
+
+// SetProfileLogLevel overrides the GOST log level of a profile; an empty
+// level falls back to the workspace default
+func (db *DB) SetProfileLogLevel(id int64, level string) error {
+	res, err := db.conn.Exec("UPDATE profiles SET log_level = ? WHERE id = ?", level, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Environment variables that select where data is stored
+const (
+	DirEnv       = "GOSTLY_DB_DIR"    // data directory, instead of searching for one
+	PathEnv      = "GOSTLY_DB_PATH"   // database file of the default workspace, instead of gostly.db in the data directory
+	WorkspaceEnv = "GOSTLY_WORKSPACE" // workspace opened on startup
+)
+
+// DefaultWorkspace is the workspace stored in gostly.db
+const DefaultWorkspace = "default"
+
+var workspaceNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// ValidateWorkspaceName checks that a workspace name is safe to use in a file name
+func ValidateWorkspaceName(name string) error {
+	if !workspaceNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid workspace name %q: use up to 32 lowercase letters, digits, '-' or '_'", name)
+	}
+	return nil
+}
+
+// workspacePath returns the database file of a workspace. The default
+// workspace keeps the original gostly.db name unless GOSTLY_DB_PATH names
+// its file.
+func workspacePath(dir, workspace string) string {
+	if workspace == DefaultWorkspace {
+		if path := os.Getenv(PathEnv); path != "" {
+			return path
+		}
+		return filepath.Join(dir, "gostly.db")
+	}
+	return filepath.Join(dir, "gostly-"+workspace+".db")
+}
+
+// ListWorkspaces returns the workspaces that have a database in dir
+func ListWorkspaces(dir string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "gostly-*.db"))
+	if err != nil {
+		return nil, err
+	}
+
+	var workspaces []string
+	if _, err := os.Stat(workspacePath(dir, DefaultWorkspace)); err == nil {
+		workspaces = append(workspaces, DefaultWorkspace)
+	}
+	for _, path := range matches {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "gostly-"), ".db")
+		if ValidateWorkspaceName(name) == nil && name != DefaultWorkspace {
+			workspaces = append(workspaces, name)
+		}
+	}
+	sort.Strings(workspaces)
+	return workspaces, nil
+}
+
+// ResolveDir returns the data directory. The directory of GOSTLY_DB_PATH,
+// then GOSTLY_DB_DIR, is used as is and is an error if unusable; otherwise
+// the first writable of the user config, cache and home directories, temp
+// dir and working directory is picked.
+func ResolveDir() (string, error) {
+	if path := os.Getenv(PathEnv); path != "" {
+		dir := filepath.Dir(path)
+		if err := ensureWritableDir(dir); err != nil {
+			return "", fmt.Errorf("%s=%s is not usable: %w", PathEnv, path, err)
+		}
+		return dir, nil
+	}
+	if dir := os.Getenv(DirEnv); dir != "" {
+		if err := ensureWritableDir(dir); err != nil {
+			return "", fmt.Errorf("%s=%s is not usable: %w", DirEnv, dir, err)
+		}
+		return dir, nil
+	}
+
+	// Try multiple writable locations in order
+	locations := []struct {
+		desc string
+		prep func() (string, error)
+	}{
+		{desc: "user config dir", prep: os.UserConfigDir},
+		{desc: "user cache dir", prep: os.UserCacheDir},
+		{desc: "user home dir", prep: os.UserHomeDir},
+		{desc: "temp dir", prep: func() (string, error) { return os.TempDir(), nil }},
+		{desc: "current working dir", prep: func() (string, error) { return os.Getwd() }},
+	}
+
+	var lastErr error
+	for i, loc := range locations {
+		base, err := loc.prep()
+		if err != nil || base == "" {
+			if err == nil {
+				err = fmt.Errorf("empty base path")
+			}
+			lastErr = fmt.Errorf("get %s failed: %w", loc.desc, err)
+			continue
+		}
+
+		dir := filepath.Join(base, "gostly")
+		if err := ensureWritableDir(dir); err != nil {
+			lastErr = fmt.Errorf("%s %s is not usable: %w", loc.desc, dir, err)
+			continue
+		}
+		if i > 0 {
+			fmt.Printf("Warning: user config dir is not usable (%v), storing data in %s %s; set %s to choose a location\n", lastErr, loc.desc, dir, DirEnv)
+		}
+		return dir, nil
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("unknown error creating database")
+	}
+	return "", lastErr
+}
+
+// ensureWritableDir creates dir if needed and checks files can be created in it
+func ensureWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	probe, err := os.CreateTemp(dir, ".probe-*")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}